@@ -0,0 +1,540 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// ErrCorruptBackup is returned by Load when the backup is truncated, or fails its checksums.
+var ErrCorruptBackup = errors.New("Backup is truncated or corrupt")
+
+// A backup starts with backupMagic and the format version as a 4 byte integer. Then come the
+// records, each framed by the length of its payload and the CRC32-C of the payload, as 4 byte
+// integers. The first byte of the payload is the record kind. The first record is backupStart,
+// and the last one backupEnd, which has the number of records in between, so a truncated backup
+// is detected.
+const (
+	backupMagic   = "badgerbk"
+	backupVersion = 1
+
+	backupEntry       byte = 1 // Key, value, user meta, CAS counter and expiry of a key.
+	backupEnd         byte = 2 // Number of records, and the BackupPoint the backup is up to.
+	backupStart       byte = 3 // BackupPoint an incremental backup starts from. Zero if full.
+	backupDelete      byte = 4 // Key deleted since the start of an incremental backup.
+	backupDeleteRange byte = 5 // Start and end of a range deleted since then.
+
+	// maxBackupRecordSize bounds the payload of a record, so a corrupt length is caught before
+	// it is allocated.
+	maxBackupRecordSize = 1 << 30
+)
+
+// BackupPoint is the point a backup is up to, and an incremental backup can start from.
+type BackupPoint struct {
+	Version uint64 // Writes up to this version are in the backup.
+	Fid     uint32 // The value log position right after those writes.
+	Offset  uint64
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type backupWriter struct {
+	w     *bufio.Writer
+	buf   bytes.Buffer
+	count uint64
+}
+
+func newBackupWriter(w io.Writer) (*backupWriter, error) {
+	bw := &backupWriter{w: bufio.NewWriterSize(w, 1<<20)}
+	var version [4]byte
+	binary.BigEndian.PutUint32(version[:], backupVersion)
+	bw.w.WriteString(backupMagic)
+	_, err := bw.w.Write(version[:])
+	return bw, err
+}
+
+// writeRecord frames and writes the payload in bw.buf.
+func (bw *backupWriter) writeRecord() error {
+	if bw.buf.Len() > maxBackupRecordSize {
+		return y.Errorf("Backup record of %d bytes is bigger than the maximum of %d",
+			bw.buf.Len(), maxBackupRecordSize)
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(bw.buf.Len()))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(bw.buf.Bytes(), castagnoli))
+	bw.w.Write(header[:])
+	_, err := bw.w.Write(bw.buf.Bytes())
+	return err
+}
+
+func (bw *backupWriter) putUvarint(x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	bw.buf.Write(b[:binary.PutUvarint(b[:], x)])
+}
+
+func (bw *backupWriter) putUint64(x uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], x)
+	bw.buf.Write(b[:])
+}
+
+func (bw *backupWriter) putBytes(b []byte) {
+	bw.putUvarint(uint64(len(b)))
+	bw.buf.Write(b)
+}
+
+func (bw *backupWriter) putPoint(p BackupPoint) {
+	bw.putUint64(p.Version)
+	bw.putUint64(uint64(p.Fid))
+	bw.putUint64(p.Offset)
+}
+
+func (bw *backupWriter) start(since BackupPoint) error {
+	bw.buf.Reset()
+	bw.buf.WriteByte(backupStart)
+	bw.putPoint(since)
+	return bw.writeRecord()
+}
+
+func (bw *backupWriter) writeEntry(key, value []byte, userMeta byte, cas, expiresAt uint64) error {
+	bw.buf.Reset()
+	bw.buf.WriteByte(backupEntry)
+	bw.putBytes(key)
+	bw.putBytes(value)
+	bw.buf.WriteByte(userMeta)
+	bw.putUint64(cas)
+	bw.putUint64(expiresAt)
+	bw.count++
+	return bw.writeRecord()
+}
+
+func (bw *backupWriter) writeDelete(key []byte) error {
+	bw.buf.Reset()
+	bw.buf.WriteByte(backupDelete)
+	bw.putBytes(key)
+	bw.count++
+	return bw.writeRecord()
+}
+
+func (bw *backupWriter) writeDeleteRange(start, end []byte) error {
+	bw.buf.Reset()
+	bw.buf.WriteByte(backupDeleteRange)
+	bw.putBytes(start)
+	bw.putBytes(end)
+	bw.count++
+	return bw.writeRecord()
+}
+
+// finish writes the backupEnd record, and flushes the backup.
+func (bw *backupWriter) finish(until BackupPoint) error {
+	bw.buf.Reset()
+	bw.buf.WriteByte(backupEnd)
+	bw.putUint64(bw.count)
+	bw.putPoint(until)
+	if err := bw.writeRecord(); err != nil {
+		return err
+	}
+	return bw.w.Flush()
+}
+
+// backupPoint returns the point the KV is at, with the IDs of the value log files up to it.
+func (s *KV) backupPoint() (BackupPoint, []int32, error) {
+	var p BackupPoint
+	var fids []int32
+	point := func() error {
+		var vp valuePointer
+		vp, fids = s.vlog.end()
+		p = BackupPoint{Version: s.Version(), Fid: vp.Fid, Offset: vp.Offset}
+		return nil
+	}
+	if s.opt.ReadOnly {
+		// There is no writer goroutine to run it, and no writes to keep out.
+		return p, fids, point()
+	}
+	err := s.runExclusive(point)
+	return p, fids, err
+}
+
+// Backup writes all the keys visible when it is called to w, with their values, user meta, CAS
+// counters and expiry. Writes can go on meanwhile; they are not part of the backup. The backup can
+// be restored with Load. It returns the point BackupSince can carry on from.
+func (s *KV) Backup(w io.Writer) (BackupPoint, error) {
+	until, _, err := s.backupPoint()
+	if err != nil {
+		return until, err
+	}
+	bw, err := newBackupWriter(w)
+	if err != nil {
+		return until, err
+	}
+	if err := bw.start(BackupPoint{}); err != nil {
+		return until, err
+	}
+	opt := DefaultIteratorOptions
+	opt.ReadTs = until.Version
+	it := s.NewIterator(opt)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if item.meta&BitDelete != 0 || bytes.Equal(item.Key(), head) {
+			continue
+		}
+		val, err := item.Value()
+		if err != nil {
+			return until, err
+		}
+		err = bw.writeEntry(item.Key(), val, item.UserMeta(), item.Counter(), item.ExpiresAt())
+		if err != nil {
+			return until, err
+		}
+	}
+	return until, bw.finish(until)
+}
+
+// BackupSince writes an incremental backup to w, with the keys written after since, the point a
+// previous backup returned. It finds them by reading the value log from there, so it needs
+// Options.SyncWrites, without which small values only go to the memtable. Values in files added
+// with IngestFiles which were small enough to stay in the table are left out. If value log GC has
+// removed a file the backup needs, it fails, and a full backup is needed instead.
+func (s *KV) BackupSince(w io.Writer, since BackupPoint) (BackupPoint, error) {
+	if !s.opt.SyncWrites {
+		return since, y.Errorf("Incremental backups need Options.SyncWrites")
+	}
+	until, fids, err := s.backupPoint()
+	if err != nil {
+		return until, err
+	}
+	bw, err := newBackupWriter(w)
+	if err != nil {
+		return until, err
+	}
+	if err := bw.start(since); err != nil {
+		return until, err
+	}
+	for _, fid := range fids {
+		if uint32(fid) < since.Fid {
+			continue
+		}
+		var start int64
+		if uint32(fid) == since.Fid {
+			start = int64(since.Offset)
+		}
+		if err := s.backupLogFile(bw, fid, start, since, until); err != nil {
+			return until, err
+		}
+	}
+	return until, bw.finish(until)
+}
+
+// backupLogFile writes the entries of value log file fid from offset start, up to until, which
+// are the newest version of their key at until.
+func (s *KV) backupLogFile(
+	bw *backupWriter, fid int32, start int64, since, until BackupPoint) error {
+	path := s.vlog.fpath(fid)
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return y.Errorf("Value log file %s needed by the backup has been garbage collected", path)
+	}
+	if err != nil {
+		return y.Wrapf(err, "Unable to open value log file: %s", path)
+	}
+	defer fd.Close()
+	end := int64(until.Offset)
+	if uint32(fid) != until.Fid {
+		fi, err := fd.Stat()
+		if err != nil {
+			return y.Wrapf(err, "Unable to stat value log file: %s", path)
+		}
+		end = fi.Size()
+	}
+
+	var backupErr error
+	fn := func(e Entry) bool {
+		if e.version <= since.Version || e.Meta&BitFinTxn != 0 {
+			return true
+		}
+		// Only write the version of a key visible at until, so the moves of value log GC, which
+		// keep the version, and older writes don't overwrite it.
+		vs, err := s.get(y.KeyWithTs(e.Key, until.Version))
+		if err != nil {
+			backupErr = err
+			return false
+		}
+		if vs.Version != e.version {
+			return true
+		}
+		switch {
+		case vs.Meta&BitRangeDelete != 0:
+			var t rangeTombstone
+			if t, err = parseRangeDelKey(y.KeyWithTs(e.Key, e.version)); err == nil {
+				err = bw.writeDeleteRange(t.start, t.end)
+			}
+		case vs.Meta&BitDelete != 0 || isExpired(vs.ExpiresAt) ||
+			s.rangeDels.covers(e.Key, vs.Version, until.Version):
+			err = bw.writeDelete(e.Key)
+		default:
+			var item *KVItem
+			if item, err = s.getItem(context.Background(), e.Key, until.Version, true); err == nil {
+				err = bw.writeEntry(e.Key, item.val, vs.UserMeta, vs.CASCounter, vs.ExpiresAt)
+			}
+		}
+		backupErr = err
+		return err == nil
+	}
+	lf := &logFile{path: path, fd: fd, fid: fid, format: s.vlog.formats.of(fid)}
+	if lf.format >= 5 {
+		if err := lf.readHeader(s.registry); err != nil {
+			return err
+		}
+	}
+	if start < lf.dataStart() {
+		start = lf.dataStart()
+	}
+	r := io.NewSectionReader(fd, start, end-start)
+	if err := iterateLog(r, lf, start, end, fn); err != nil {
+		return y.Wrapf(err, "Unable to read value log file: %s", path)
+	}
+	return backupErr
+}
+
+type backupReader struct {
+	r       *bufio.Reader
+	payload []byte
+}
+
+func newBackupReader(r io.Reader) (*backupReader, error) {
+	br := &backupReader{r: bufio.NewReaderSize(r, 1<<20)}
+	var header [len(backupMagic) + 4]byte
+	if _, err := io.ReadFull(br.r, header[:]); err != nil {
+		return nil, ErrCorruptBackup
+	}
+	if string(header[:len(backupMagic)]) != backupMagic {
+		return nil, y.Errorf("Not a badger backup")
+	}
+	if v := binary.BigEndian.Uint32(header[len(backupMagic):]); v != backupVersion {
+		return nil, y.Errorf("Unsupported backup format version: %d", v)
+	}
+	return br, nil
+}
+
+// next reads the next record, and returns its kind. The rest of the payload is left in
+// br.payload.
+func (br *backupReader) next() (byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(br.r, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, ErrCorruptBackup
+		}
+		return 0, err
+	}
+	n := binary.BigEndian.Uint32(header[0:4])
+	if n == 0 || n > maxBackupRecordSize {
+		return 0, ErrCorruptBackup
+	}
+	if cap(br.payload) < int(n) {
+		br.payload = make([]byte, n)
+	}
+	br.payload = br.payload[:n]
+	if _, err := io.ReadFull(br.r, br.payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, ErrCorruptBackup
+		}
+		return 0, err
+	}
+	if crc32.Checksum(br.payload, castagnoli) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, ErrCorruptBackup
+	}
+	kind := br.payload[0]
+	br.payload = br.payload[1:]
+	return kind, nil
+}
+
+func (br *backupReader) bytes() ([]byte, error) {
+	n, sz := binary.Uvarint(br.payload)
+	if sz <= 0 || uint64(len(br.payload)-sz) < n {
+		return nil, ErrCorruptBackup
+	}
+	b := br.payload[sz : sz+int(n)]
+	br.payload = br.payload[sz+int(n):]
+	return b, nil
+}
+
+func (br *backupReader) uint64() (uint64, error) {
+	if len(br.payload) < 8 {
+		return 0, ErrCorruptBackup
+	}
+	x := binary.BigEndian.Uint64(br.payload)
+	br.payload = br.payload[8:]
+	return x, nil
+}
+
+func (br *backupReader) point() (BackupPoint, error) {
+	if len(br.payload) != 3*8 {
+		return BackupPoint{}, ErrCorruptBackup
+	}
+	version, _ := br.uint64()
+	fid, _ := br.uint64()
+	offset, _ := br.uint64()
+	return BackupPoint{Version: version, Fid: uint32(fid), Offset: offset}, nil
+}
+
+// readEntry parses the payload of a backupEntry record. The key and value are copied.
+func (br *backupReader) readEntry() (*Entry, error) {
+	key, err := br.bytes()
+	if err != nil {
+		return nil, err
+	}
+	val, err := br.bytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(br.payload) != 1+8+8 {
+		return nil, ErrCorruptBackup
+	}
+	e := &Entry{
+		Key:      y.Safecopy(nil, key),
+		Value:    y.Safecopy(nil, val),
+		UserMeta: br.payload[0],
+	}
+	br.payload = br.payload[1:]
+	br.uint64() // The CAS counter. Written entries get new ones.
+	e.ExpiresAt, _ = br.uint64()
+	return e, nil
+}
+
+// Load writes the keys in a backup made by Backup or BackupSince to the KV, in batches, over
+// whatever is already there. The keys get new versions, and so new CAS counters. An incremental
+// backup must be loaded after the backups it builds on; LoadChain checks that. If the backup turns
+// out to be truncated or corrupt, ErrCorruptBackup is returned, and the batches written before
+// stay.
+func (s *KV) Load(r io.Reader) error {
+	_, err := s.load(r, nil)
+	return err
+}
+
+// LoadChain loads a full backup, and then the incremental backups taken after it, in order. It
+// fails before loading a backup which doesn't start where the one before it ended.
+func (s *KV) LoadChain(backups ...io.Reader) error {
+	var prev BackupPoint
+	for _, r := range backups {
+		until, err := s.load(r, &prev)
+		if err != nil {
+			return err
+		}
+		prev = until
+	}
+	return nil
+}
+
+// load loads the backup in r. If since is not nil, the backup must start from it. It returns the
+// point the backup is up to.
+func (s *KV) load(r io.Reader, since *BackupPoint) (BackupPoint, error) {
+	var until BackupPoint
+	br, err := newBackupReader(r)
+	if err != nil {
+		return until, err
+	}
+	if kind, err := br.next(); err != nil {
+		return until, err
+	} else if kind != backupStart {
+		return until, ErrCorruptBackup
+	}
+	start, err := br.point()
+	if err != nil {
+		return until, err
+	}
+	if since != nil && start != *since {
+		return until, y.Errorf("Backup starts from %+v, not from %+v", start, *since)
+	}
+
+	var entries []*Entry
+	var size int
+	var count uint64
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		err := s.BatchSet(entries)
+		entries, size = entries[:0], 0
+		return err
+	}
+	for {
+		kind, err := br.next()
+		if err != nil {
+			return until, err
+		}
+		if kind != backupEnd {
+			count++
+		}
+		switch kind {
+		case backupEntry:
+			e, err := br.readEntry()
+			if err != nil {
+				return until, err
+			}
+			entries = append(entries, e)
+			size += len(e.Key) + len(e.Value)
+		case backupDelete:
+			key, err := br.bytes()
+			if err != nil {
+				return until, err
+			}
+			entries = append(entries, &Entry{Key: y.Safecopy(nil, key), Meta: BitDelete})
+			size += len(key)
+		case backupDeleteRange:
+			start, err := br.bytes()
+			if err != nil {
+				return until, err
+			}
+			end, err := br.bytes()
+			if err != nil {
+				return until, err
+			}
+			// Keys set before the range was deleted have to be written first.
+			if err := flush(); err != nil {
+				return until, err
+			}
+			if err := s.DeleteRange(start, end); err != nil {
+				return until, err
+			}
+		case backupEnd:
+			if n, err := br.uint64(); err != nil || n != count {
+				return until, ErrCorruptBackup
+			}
+			if until, err = br.point(); err != nil {
+				return until, err
+			}
+			return until, flush()
+		default:
+			return until, y.Errorf("Unknown backup record kind: %d", kind)
+		}
+		if len(entries) >= 1000 || size >= 4<<20 {
+			if err := flush(); err != nil {
+				return until, err
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	val := func(i int) []byte {
+		if i%3 == 0 { // Goes to the value log.
+			return []byte(strings.Repeat(fmt.Sprintf("%05d", i), 10))
+		}
+		return []byte(fmt.Sprintf("%05d", i))
+	}
+	var entries []*Entry
+	for i := 0; i < 3000; i++ {
+		entries = append(entries, &Entry{Key: key(i), Value: val(i), UserMeta: byte(i)})
+	}
+	require.NoError(t, kv.BatchSet(entries))
+	for i := 0; i < 3000; i += 7 {
+		require.NoError(t, kv.Delete(key(i)))
+	}
+
+	var buf bytes.Buffer
+	_, err = kv.Backup(&buf)
+	require.NoError(t, err)
+	// Not part of the backup.
+	require.NoError(t, kv.Set(key(5000), val(5000)))
+
+	dir2, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir2)
+	kv2, err := NewKV(getTestOptions(dir2))
+	require.NoError(t, err)
+	defer kv2.Close()
+	require.NoError(t, kv2.Load(bytes.NewReader(buf.Bytes())))
+
+	for i := 0; i < 5001; i++ {
+		item, err := kv2.GetItem(key(i))
+		if i%7 == 0 || i >= 3000 {
+			require.Equal(t, ErrKeyNotFound, err, string(key(i)))
+			continue
+		}
+		require.NoError(t, err)
+		v, err := item.Value()
+		require.NoError(t, err)
+		require.Equal(t, val(i), v)
+		require.Equal(t, byte(i), item.UserMeta())
+	}
+
+	// Truncated and corrupt backups are detected.
+	data := buf.Bytes()
+	require.Equal(t, ErrCorruptBackup, kv2.Load(bytes.NewReader(data[:len(data)-3])))
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)/2]++
+	require.Equal(t, ErrCorruptBackup, kv2.Load(bytes.NewReader(corrupt)))
+	// A record length which is way too big is rejected before it is allocated.
+	huge := append([]byte{}, data[:len(backupMagic)+4]...)
+	huge = append(huge, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0)
+	require.Equal(t, ErrCorruptBackup, kv2.Load(bytes.NewReader(huge)))
+}
+
+func TestBackupReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	var entries []*Entry
+	for i := 0; i < 1000; i++ {
+		entries = append(entries, &Entry{Key: key(i), Value: key(i)})
+	}
+	require.NoError(t, kv.BatchSet(entries))
+	require.NoError(t, kv.Close())
+
+	// There is no writer goroutine to wait for.
+	opt.ReadOnly = true
+	ro, err := NewKV(opt)
+	require.NoError(t, err)
+	defer ro.Close()
+	var full, inc bytes.Buffer
+	p, err := ro.Backup(&full)
+	require.NoError(t, err)
+	_, err = ro.BackupSince(&inc, p)
+	require.NoError(t, err)
+
+	dir2, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir2)
+	kv2, err := NewKV(getTestOptions(dir2))
+	require.NoError(t, err)
+	defer kv2.Close()
+	require.NoError(t, kv2.LoadChain(&full, &inc))
+	for i := 0; i < 1000; i++ {
+		v, _, err := kv2.Get(key(i))
+		require.NoError(t, err)
+		require.Equal(t, key(i), v)
+	}
+}
+
+func TestBackupSince(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	set := func(from, to int, v string) {
+		var entries []*Entry
+		for i := from; i < to; i++ {
+			entries = append(entries, &Entry{Key: key(i), Value: []byte(v + string(key(i)))})
+		}
+		require.NoError(t, kv.BatchSet(entries))
+	}
+	set(0, 1000, "a")
+	var full, inc1, inc2 bytes.Buffer
+	p, err := kv.Backup(&full)
+	require.NoError(t, err)
+
+	set(500, 1500, strings.Repeat("b", 50))
+	for i := 0; i < 1500; i += 10 {
+		require.NoError(t, kv.Delete(key(i)))
+	}
+	p, err = kv.BackupSince(&inc1, p)
+	require.NoError(t, err)
+
+	set(1400, 1600, "c")
+	require.NoError(t, kv.Delete(key(1))) // Was in the full backup only.
+	require.NoError(t, kv.DeleteRange(key(700), key(800)))
+	set(750, 760, "d") // Written after the range was deleted.
+	_, err = kv.BackupSince(&inc2, p)
+	require.NoError(t, err)
+
+	dir2, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir2)
+	kv2, err := NewKV(getTestOptions(dir2))
+	require.NoError(t, err)
+	defer kv2.Close()
+	// The incremental backups have to come in order, after the full one.
+	err = kv2.LoadChain(bytes.NewReader(full.Bytes()), bytes.NewReader(inc2.Bytes()))
+	require.Error(t, err)
+	require.NoError(t, kv2.LoadChain(bytes.NewReader(full.Bytes()),
+		bytes.NewReader(inc1.Bytes()), bytes.NewReader(inc2.Bytes())))
+
+	for i := 0; i < 1700; i++ {
+		want, err := kv.GetItem(key(i))
+		got, err2 := kv2.GetItem(key(i))
+		if err == ErrKeyNotFound {
+			require.Equal(t, ErrKeyNotFound, err2, string(key(i)))
+			continue
+		}
+		require.NoError(t, err)
+		require.NoError(t, err2, string(key(i)))
+		wantVal, err := want.Value()
+		require.NoError(t, err)
+		gotVal, err := got.Value()
+		require.NoError(t, err)
+		require.Equal(t, wantVal, gotVal, string(key(i)))
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/skl"
+	"github.com/dgraph-io/badger/table"
+	"github.com/dgraph-io/badger/y"
+)
+
+// Checkpoint creates a copy of the KV in dir, which NewKV can open right away. The copy has all
+// the writes made before Checkpoint was called. Writes can go on meanwhile, though compactions
+// wait until the tables have been linked. dir must be empty or not exist yet, and be on the same
+// filesystem as Options.Dir, as the tables and the value log files which are no longer written
+// to are hard linked. The memtables are written to a new table in dir, and the value log file
+// being written to is copied. An encrypted KV gives an encrypted copy, which is opened with the
+// same Options.EncryptionKey.
+func (s *KV) Checkpoint(dir string) error {
+	if s.opt.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return y.Wrapf(err, "Unable to create checkpoint directory: %s", dir)
+	}
+	if fileInfos, err := ioutil.ReadDir(dir); err != nil {
+		return y.Wrapf(err, "Unable to read checkpoint directory: %s", dir)
+	} else if len(fileInfos) > 0 {
+		return y.Errorf("Checkpoint directory %s is not empty", dir)
+	}
+
+	claimed := false
+	defer func() {
+		if claimed {
+			s.lc.releaseAllLevels()
+		}
+	}()
+
+	var mts []*skl.Skiplist
+	var decrMts func()
+	var tables []*table.Table
+	var end valuePointer
+	var vlogFiles []*logFile
+	var version, memtableID uint64
+	err := s.runExclusive(func() error {
+		// Keep compactions from changing the tables until they are linked. Claiming before the
+		// writes stop could deadlock: a write waiting on a flush, which waits for level 0 to drain.
+		s.lc.claimAllLevels()
+		claimed = true
+		// The memtables first: one could be flushed to a table before we get to the tables.
+		mts, decrMts = s.getMemTables()
+		for _, level := range s.lc.levels {
+			level.RLock()
+			for _, t := range level.tables {
+				t.IncrRef()
+				tables = append(tables, t)
+			}
+			level.RUnlock()
+		}
+		// Pinned, so that value log GC doesn't close them before they are linked.
+		end, vlogFiles = s.vlog.pinFiles()
+		version = s.Version()
+		memtableID, _ = s.lc.reserveFileIDs(1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer decrMts()
+	defer closeTables(tables)
+	defer func() {
+		for _, lf := range vlogFiles {
+			lf.decrRef()
+		}
+	}()
+
+	for _, t := range tables {
+		fname := table.NewFilename(t.ID(), dir)
+		if err := os.Link(t.Filename(), fname); err != nil {
+			return y.Wrapf(err, "Unable to link table %s to %s", t.Filename(), fname)
+		}
+	}
+	s.lc.releaseAllLevels()
+	claimed = false
+
+	fname := table.NewFilename(memtableID, dir)
+	fd, err := y.OpenSyncedFile(fname, true)
+	if err != nil {
+		return y.Wrapf(err, "Unable to create table: %s", fname)
+	}
+	err = s.writeCheckpointTable(mts, version, end, fd)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return y.Wrapf(err, "Unable to write table: %s", fname)
+	}
+
+	for _, lf := range vlogFiles {
+		dst := vlogFilePath(dir, lf.fid)
+		var err error
+		if uint32(lf.fid) == end.Fid {
+			err = s.vlog.copyFile(lf, dst, int64(end.Offset))
+		} else if os.Link(s.vlog.fpath(lf.fid), dst) != nil {
+			// Value log GC may have removed it.
+			err = s.vlog.copyFile(lf, dst, lf.size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The compaction log would only list the files of unfinished compactions, which aren't linked.
+	clog, err := y.OpenSyncedFile(filepath.Join(dir, "clog"), true)
+	if err != nil {
+		return y.Wrapf(err, "Unable to create compact log in %s", dir)
+	}
+	if err := clog.Close(); err != nil {
+		return err
+	}
+	// After the table and the value log files, so it has the data keys they were encrypted with.
+	if err := s.registry.copyTo(dir); err != nil {
+		return err
+	}
+	return writeFormat(filepath.Join(dir, formatFilename), s.vlog.formats)
+}
+
+// writeCheckpointTable writes the entries of the memtables up to version to a level 0 table, with
+// a head pointing to the end of the value log, so nothing is replayed.
+func (s *KV) writeCheckpointTable(mts []*skl.Skiplist, version uint64, end valuePointer,
+	f *os.File) error {
+	b, err := s.newTableBuilder()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	var iters []y.Iterator
+	for _, mt := range mts {
+		iters = append(iters, mt.NewUniRangeIterator(false, y.KeyRange{}))
+	}
+	it := y.NewMergeIterator(iters, false)
+	defer it.Close()
+
+	headKey := y.KeyWithTs(head, version)
+	var offset [16]byte
+	headVs := y.ValueStruct{Value: end.Encode(offset[:])}
+	headAdded := false
+	for it.Rewind(); it.Valid(); it.Next() {
+		key := it.Key()
+		if y.ParseTs(key) > version || bytes.Equal(y.ParseKey(key), head) {
+			continue
+		}
+		if !headAdded && y.CompareKeys(headKey, key) < 0 {
+			if err := b.Add(headKey, headVs); err != nil {
+				return err
+			}
+			headAdded = true
+		}
+		if err := b.Add(key, it.Value()); err != nil {
+			return err
+		}
+	}
+	if !headAdded {
+		if err := b.Add(headKey, headVs); err != nil {
+			return err
+		}
+	}
+	var level [2]byte // Level 0, as it is newer than all the other tables.
+	data, err := b.Finish(level[:])
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// copyFile copies the first n bytes of the value log file lf to dst, which must not exist. If
+// value log GC has removed the file since it was pinned, it is copied from the open file.
+func (l *valueLog) copyFile(lf *logFile, dst string, n int64) error {
+	src := l.fpath(lf.fid)
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		lf.RLock() // It is no longer written to, so this doesn't hold up the writes.
+		defer lf.RUnlock()
+		return copyN(io.NewSectionReader(lf.fd, 0, n), src, dst, n)
+	}
+	if err != nil {
+		return y.Wrapf(err, "Unable to open %s", src)
+	}
+	defer in.Close()
+	return copyN(in, src, dst, n)
+}
+
+// copyFile copies the first n bytes of src to dst, which must not exist.
+func copyFile(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return y.Wrapf(err, "Unable to open %s", src)
+	}
+	defer in.Close()
+	return copyN(in, src, dst, n)
+}
+
+// copyN copies n bytes of src, read from in, to dst, which must not exist.
+func copyN(in io.Reader, src, dst string, n int64) error {
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return y.Wrapf(err, "Unable to create %s", dst)
+	}
+	if _, err = io.CopyN(out, in, n); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return y.Wrapf(err, "Unable to copy %s to %s", src, dst)
+	}
+	return nil
+}
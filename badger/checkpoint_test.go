@@ -0,0 +1,134 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	val := func(i int, v string) []byte {
+		if i%3 == 0 { // Goes to the value log.
+			return []byte(strings.Repeat(v, 50))
+		}
+		return []byte(v)
+	}
+	set := func(from, to int, v string) {
+		var entries []*Entry
+		for i := from; i < to; i++ {
+			entries = append(entries, &Entry{Key: key(i), Value: val(i, v)})
+		}
+		require.NoError(t, kv.BatchSet(entries))
+	}
+	set(0, 3000, "a")
+	require.NoError(t, kv.Close())
+	kv, err = NewKV(opt) // The first writes are in tables now.
+	require.NoError(t, err)
+	defer kv.Close()
+	set(2000, 4000, "b") // In the memtable.
+	require.NoError(t, kv.Delete(key(10)))
+
+	cpDir := filepath.Join(dir, "checkpoint")
+	require.NoError(t, kv.Checkpoint(cpDir))
+	require.Error(t, kv.Checkpoint(cpDir)) // Not empty anymore.
+	set(0, 5000, "c")                      // Not part of the checkpoint.
+
+	cpOpt := getTestOptions(cpDir)
+	cp, err := NewKV(cpOpt)
+	require.NoError(t, err)
+	check := func() {
+		for i := 0; i < 5000; i++ {
+			item, err := cp.GetItem(key(i))
+			if i == 10 || i >= 4000 {
+				require.Equal(t, ErrKeyNotFound, err, string(key(i)))
+				continue
+			}
+			require.NoError(t, err, string(key(i)))
+			v, err := item.Value()
+			require.NoError(t, err)
+			if i < 2000 {
+				require.Equal(t, val(i, "a"), v)
+			} else {
+				require.Equal(t, val(i, "b"), v)
+			}
+		}
+	}
+	check()
+	// The checkpoint takes writes of its own, and opens again.
+	require.NoError(t, cp.Set(key(4000), []byte("d")))
+	require.NoError(t, cp.Close())
+	cp, err = NewKV(cpOpt)
+	require.NoError(t, err)
+	defer cp.Close()
+	require.NoError(t, cp.Delete(key(4000)))
+	check()
+}
+
+func TestCheckpointPinsValueLog(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 10 // A file per value.
+	opt.ValueCompression = nil
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, kv.Set([]byte("key"), []byte(strings.Repeat("v", 1<<10))))
+	}
+	require.NoError(t, kv.Close())
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	_, files := kv.vlog.pinFiles()
+	defer func() {
+		for _, lf := range files {
+			require.NoError(t, lf.decrRef())
+		}
+	}()
+	lf := files[0]
+	data, err := ioutil.ReadFile(kv.vlog.fpath(lf.fid))
+	require.NoError(t, err)
+
+	// Value log GC removes the file, which stays open, so it can still be copied.
+	require.NoError(t, kv.vlog.rewrite(lf))
+	_, err = os.Stat(kv.vlog.fpath(lf.fid))
+	require.True(t, os.IsNotExist(err))
+	cpDir := filepath.Join(dir, "checkpoint")
+	require.NoError(t, os.Mkdir(cpDir, 0755))
+	dst := vlogFilePath(cpDir, lf.fid)
+	require.NoError(t, kv.vlog.copyFile(lf, dst, lf.size))
+	copied, err := ioutil.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, data, copied)
+}
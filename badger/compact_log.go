@@ -24,14 +24,20 @@ type compaction struct {
 	toInsert  []uint64
 }
 
-func (s *compactLog) init(filename string) {
+func (s *compactLog) init(filename string) error {
 	fd, err := y.OpenSyncedFile(filename, true)
-	y.Check(err)
+	if err != nil {
+		return y.Wrapf(err, "Unable to open compact log: %s", filename)
+	}
 	s.fd = fd
+	return nil
 }
 
-func (s *compactLog) close() {
-	s.fd.Close()
+func (s *compactLog) close() error {
+	if s.fd == nil { // Never opened, as the KV is read-only.
+		return nil
+	}
+	return s.fd.Close()
 }
 
 func (s *compactLog) add(c *compaction) error {
@@ -112,56 +118,76 @@ func compactLogIterate(filename string, f func(c *compaction)) error {
 	return nil
 }
 
-// replay uses the compactLog to clean up the directory. Two cases.
-// 1) Compaction is done: We will delete files that are in compaction.toDelete.
-//    Some files may linger around because of iterators holding references.
-// 2) Compaction is not done: We need to undo the compaction.
-
-func deleteIfPresent(id uint64, dir string) {
+func deleteIfPresent(id uint64, dir string) error {
 	fn := table.NewFilename(id, dir)
 	_, err := os.Stat(fn)
 	if err == nil {
 		y.Printf("CLEANUP: Del %s\n", fn)
-		y.Check(os.Remove(fn))
+		return os.Remove(fn)
+	}
+	if os.IsNotExist(err) {
+		return nil
 	}
+	return err
 }
 
-func compactLogReplay(filename, dir string, idMap map[uint64]struct{}) {
+// compactLogReplay goes over the compact log, and returns the IDs of the tables which should no
+// longer be there, so they can be deleted. Two cases.
+// 1) Compaction is done: The tables in compaction.toDelete.
+//    Some files may linger around because of iterators holding references.
+// 2) Compaction is not done: We need to undo the compaction, so the tables in
+//    compaction.toInsert. The tables in compaction.toDelete must all be there.
+func compactLogReplay(filename, dir string) (map[uint64]struct{}, error) {
+	obsolete := make(map[uint64]struct{})
 	cMap := make(map[uint64]*compaction)
-	y.Check(compactLogIterate(filename, func(c *compaction) {
+	var replayErr error
+	err := compactLogIterate(filename, func(c *compaction) {
+		if replayErr != nil {
+			return
+		}
 		if c.done == 0 {
 			cMap[c.compactID] = c
 			return
 		}
 		cRef, found := cMap[c.compactID]
-		y.AssertTruef(found,
-			"Trying to end compaction that is never present: %d", c.compactID)
-		// A compaction is done. Check the files that are supposed to be deleted.
+		if !found {
+			replayErr = y.Errorf("Trying to end compaction that is never present: %d", c.compactID)
+			return
+		}
+		// A compaction is done. The files that are supposed to be deleted are obsolete.
 		for _, id := range cRef.toDelete {
-			deleteIfPresent(id, dir)
+			obsolete[id] = struct{}{}
 		}
 		// Files inserted by compaction may be deleted. We don't track this.
 		delete(cMap, c.compactID)
-	}))
+	})
+	if err != nil {
+		return nil, y.Wrapf(err, "While iterating over compact log: %s", filename)
+	}
+	if replayErr != nil {
+		return nil, replayErr
+	}
 
 	if len(cMap) == 0 {
 		y.Printf("All compactions in compact log are done.\n")
-		return
+		return obsolete, nil
 	}
 
 	// Anything left in cMap are unterminated compactions. We want to undo these
-	// compactions. Inserted files should be deleted. Deleted files are expected
+	// compactions. Inserted files are obsolete. Deleted files are expected
 	// to be present.
 	for _, c := range cMap {
 		y.Printf("CLEANUP: Undo compaction ID %d\n", c.compactID)
 		for _, id := range c.toInsert {
-			deleteIfPresent(id, dir)
+			obsolete[id] = struct{}{}
 		}
 		for _, id := range c.toDelete {
-			_, err := os.Stat(table.NewFilename(id, dir))
-			y.Check(err)
+			if _, err := os.Stat(table.NewFilename(id, dir)); err != nil {
+				return nil, y.Wrapf(err, "Unable to undo compaction ID %d", c.compactID)
+			}
 		}
 	}
+	return obsolete, nil
 }
 
 func (s *levelsController) buildCompaction(def *compactDef) *compaction {
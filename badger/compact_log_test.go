@@ -55,23 +55,27 @@ func TestCompactLogBasic(t *testing.T) {
 
 	opt := getTestOptions(dir)
 	{
-		kv := NewKV(opt)
+		kv, err := NewKV(opt)
+		require.NoError(t, err)
 		n := 5000
 		for i := 0; i < n; i++ {
 			if (i % 10000) == 0 {
 				fmt.Printf("Putting i=%d\n", i)
 			}
 			k := []byte(fmt.Sprintf("%16x", rand.Int63()))
-			kv.Set(k, k)
+			require.NoError(t, kv.Set(k, k))
 		}
-		kv.Set([]byte("testkey"), []byte("testval"))
+		require.NoError(t, kv.Set([]byte("testkey"), []byte("testval")))
 		kv.validate()
 		kv.debugPrintMore()
 		kv.Close()
 	}
 
-	kv := NewKV(opt)
-	val, _ := kv.Get([]byte("testkey"))
+	kv, err := NewKV(opt)
+
+	require.NoError(t, err)
+	val, _, err := kv.Get([]byte("testkey"))
+	require.NoError(t, err)
 	require.EqualValues(t, "testval", string(val))
 	kv.Close()
 }
@@ -91,7 +95,8 @@ func TestCompactLogUnclosedIter(t *testing.T) {
 	opt := getTestOptions(dir)
 	var sum *summary
 	{
-		kv := NewKV(opt)
+		kv, err := NewKV(opt)
+		require.NoError(t, err)
 		n := 5000
 		for i := 0; i < n; i++ {
 			if (i % 1000) == 0 {
@@ -99,16 +104,22 @@ func TestCompactLogUnclosedIter(t *testing.T) {
 				kv.NewIterator(iterOpt) // NOTE: Hold reference for test.
 			}
 			k := []byte(fmt.Sprintf("%16x", rand.Int63()))
-			kv.Set(k, k)
+			require.NoError(t, kv.Set(k, k))
 		}
 		// Don't close kv.
+		kv.dirLock.release() // As if the process had died, so the directory can be opened again.
+		defer closeCrashed(kv)
 		sum = kv.lc.getSummary()
 	}
 
 	// Make sure our test makes sense. There should be dirty files.
-	require.True(t, len(sum.fileIDs) < len(getIDMap(dir)))
+	idMap, err := getIDMap(dir)
+	require.NoError(t, err)
+	require.True(t, len(sum.fileIDs) < len(idMap))
 
-	kv := NewKV(opt) // This should clean up.
+	kv, err := NewKV(opt) // This should clean up.
+	require.NoError(t, err)
+	defer kv.Close()
 	summary2 := kv.lc.getSummary()
 	require.Len(t, sum.fileIDs, len(summary2.fileIDs))
 }
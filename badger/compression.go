@@ -0,0 +1,145 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bkaradzic/go-lz4"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// Compressor compresses value log entries. See Options.ValueCompression. Its ID is written along
+// with every entry it compresses, so they can be read whatever Options.ValueCompression is set to
+// later on, as long as it is registered with RegisterCompressor.
+type Compressor interface {
+	// ID identifies the compressor. IDs below 16 are reserved for the ones built in.
+	ID() byte
+	// Compress returns the compressed src, in dst if it has the capacity.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress returns the decompressed src, in dst if it has the capacity.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// The built-in compressors, which are registered already.
+var (
+	LZ4Compressor    Compressor = lz4Compressor{}
+	SnappyCompressor Compressor = snappyCompressor{}
+	ZstdCompressor   Compressor = &zstdCompressor{}
+)
+
+var compressors = struct {
+	sync.RWMutex
+	byID map[byte]Compressor
+}{byID: make(map[byte]Compressor)}
+
+func init() {
+	RegisterCompressor(LZ4Compressor)
+	RegisterCompressor(SnappyCompressor)
+	RegisterCompressor(ZstdCompressor)
+}
+
+// RegisterCompressor makes c available to read the entries it compressed. It panics if another
+// compressor has the same ID.
+func RegisterCompressor(c Compressor) {
+	compressors.Lock()
+	defer compressors.Unlock()
+	if _, ok := compressors.byID[c.ID()]; ok {
+		panic(fmt.Sprintf("Compressor with ID %d registered twice", c.ID()))
+	}
+	compressors.byID[c.ID()] = c
+}
+
+// decompress decompresses the payload of a compressed entry, read from a value log file in the
+// given format version, into dst if it has the capacity.
+func decompress(dst, payload []byte, format int) ([]byte, error) {
+	if format < 4 { // The compressor ID wasn't written yet, as there only was LZ4.
+		return LZ4Compressor.Decompress(dst, payload)
+	}
+	if len(payload) == 0 {
+		return nil, y.Errorf("Compressed entry has no compressor ID")
+	}
+	compressors.RLock()
+	c, ok := compressors.byID[payload[0]]
+	compressors.RUnlock()
+	if !ok {
+		return nil, y.Errorf("Entry was compressed by unknown compressor with ID %d", payload[0])
+	}
+	return c.Decompress(dst, payload[1:])
+}
+
+type lz4Compressor struct{}
+
+func (lz4Compressor) ID() byte { return 1 }
+
+func (lz4Compressor) Compress(dst, src []byte) ([]byte, error) {
+	return lz4.Encode(dst[:cap(dst)], src)
+}
+
+func (lz4Compressor) Decompress(dst, src []byte) ([]byte, error) {
+	return lz4.Decode(dst[:cap(dst)], src)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) ID() byte { return 2 }
+
+func (snappyCompressor) Compress(dst, src []byte) ([]byte, error) {
+	return snappy.Encode(dst[:cap(dst)], src), nil
+}
+
+func (snappyCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	return snappy.Decode(dst[:cap(dst)], src)
+}
+
+// zstdCompressor creates its encoder and decoder on first use, as they start goroutines.
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (c *zstdCompressor) init() error {
+	c.once.Do(func() {
+		if c.encoder, c.err = zstd.NewWriter(nil); c.err != nil {
+			return
+		}
+		c.decoder, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+func (c *zstdCompressor) ID() byte { return 3 }
+
+func (c *zstdCompressor) Compress(dst, src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.encoder.EncodeAll(src, dst[:0]), nil
+}
+
+func (c *zstdCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.decoder.DecodeAll(src, dst[:0])
+}
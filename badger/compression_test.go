@@ -0,0 +1,106 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+func TestValueCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.ValueCompressionMinSize = 64
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+
+	compressors := []Compressor{nil, LZ4Compressor, SnappyCompressor, ZstdCompressor}
+	key := func(round, c, i int) []byte { return []byte(fmt.Sprintf("key%d-%d-%03d", round, c, i)) }
+	val := func(round, c, i int) []byte {
+		return []byte(strings.Repeat(fmt.Sprintf("value%d-%d-%03d,", round, c, i), 20))
+	}
+	write := func(round, c int) {
+		var entries []*Entry
+		for i := 0; i < 20; i++ {
+			entries = append(entries, &Entry{Key: key(round, c, i), Value: val(round, c, i)})
+		}
+		require.NoError(t, kv.BatchSet(entries))
+	}
+	check := func() {
+		for round := 0; round < 2; round++ {
+			for c := range compressors {
+				for i := 0; i < 20; i++ {
+					v, _, err := kv.Get(key(round, c, i))
+					require.NoError(t, err)
+					require.Equal(t, val(round, c, i), v, string(key(round, c, i)))
+				}
+			}
+		}
+	}
+	// Each batch is written with another compressor. In the first round, they are read from the
+	// value log. In the second one, they are replayed from it, as if the process had died.
+	for c, compressor := range compressors {
+		opt.ValueCompression = compressor
+		require.NoError(t, kv.Close())
+		kv, err = NewKV(opt)
+		require.NoError(t, err)
+		write(0, c)
+	}
+	for c, compressor := range compressors {
+		kv.vlog.opt.ValueCompression = compressor
+		write(1, c)
+	}
+	kv.dirLock.release() // As if the process had died, so the directory can be opened again.
+	// Stop it before reopening, or its compactions would take the same table IDs.
+	closeCrashed(kv)
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	check()
+
+	opt.ValueCompression = nil
+	require.NoError(t, kv.Close())
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	check()
+	// Entries are decompressed into the buffer of the slice, which is reused.
+	var s y.Slice
+	for c, compressor := range compressors {
+		kv.vlog.opt.ValueCompression = compressor
+		write(2, c)
+	}
+	for c := range compressors {
+		item, err := kv.GetItemWithOptions(key(2, c, 0), GetOptions{})
+		require.NoError(t, err)
+		require.True(t, item.meta&BitValuePointer != 0)
+		var vp valuePointer
+		vp.Decode(item.vptr)
+		e, err := kv.vlog.Read(vp, &s)
+		require.NoError(t, err)
+		require.Equal(t, val(2, c, 0), e.Value)
+		require.Equal(t, c > 0, e.Meta&BitCompressed != 0)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// ErrInvalidRange is returned by DeleteRange when start is not smaller than end.
+var ErrInvalidRange = errors.New("DeleteRange needs start to be smaller than end")
+
+// rangeDelPrefix is the key prefix of range tombstones. The rest of the key is the length of the
+// start key as a 4 byte integer, the start key and the end key. The tombstone needs no value, and
+// tombstones for different ranges never shadow each other.
+var rangeDelPrefix = []byte("!badger!rangedel!")
+
+// rangeTombstone deletes the versions older than version of all the keys from start (inclusive)
+// to end (exclusive).
+type rangeTombstone struct {
+	start   []byte
+	end     []byte
+	version uint64
+}
+
+func rangeDelKey(start, end []byte) []byte {
+	key := make([]byte, 0, len(rangeDelPrefix)+4+len(start)+len(end))
+	key = append(key, rangeDelPrefix...)
+	var sz [4]byte
+	binary.BigEndian.PutUint32(sz[:], uint32(len(start)))
+	key = append(key, sz[:]...)
+	key = append(key, start...)
+	return append(key, end...)
+}
+
+// parseRangeDelKey parses the tombstone in key, which has a version.
+func parseRangeDelKey(key []byte) (rangeTombstone, error) {
+	t := rangeTombstone{version: y.ParseTs(key)}
+	k := y.ParseKey(key)
+	if !bytes.HasPrefix(k, rangeDelPrefix) || len(k) < len(rangeDelPrefix)+4 {
+		return t, y.Errorf("Invalid range tombstone key: %q", k)
+	}
+	k = k[len(rangeDelPrefix):]
+	sz := binary.BigEndian.Uint32(k)
+	k = k[4:]
+	if uint32(len(k)) < sz {
+		return t, y.Errorf("Invalid range tombstone key: %q", key)
+	}
+	t.start = y.Safecopy(nil, k[:sz])
+	t.end = y.Safecopy(nil, k[sz:])
+	return t, nil
+}
+
+func (t rangeTombstone) keyRange() y.KeyRange {
+	return y.KeyRange{Lower: t.start, Upper: t.end}
+}
+
+// covers returns true if the tombstone deletes the given version of key when reading at readTs.
+func (t rangeTombstone) covers(key []byte, version, readTs uint64) bool {
+	return version < t.version && t.version <= readTs &&
+		bytes.Compare(key, t.start) >= 0 && bytes.Compare(key, t.end) < 0
+}
+
+// rangeDels has all the range tombstones in the memtables and the LSM tree, sorted by start key,
+// so reads and compactions don't have to look for them.
+type rangeDels struct {
+	sync.RWMutex
+	list []rangeTombstone
+}
+
+// add adds t, unless it is already there. Replay can run into a tombstone which has been loaded
+// from the LSM tree already.
+func (r *rangeDels) add(t rangeTombstone) {
+	r.Lock()
+	defer r.Unlock()
+	idx := sort.Search(len(r.list), func(i int) bool {
+		return bytes.Compare(r.list[i].start, t.start) > 0
+	})
+	for i := idx - 1; i >= 0 && bytes.Equal(r.list[i].start, t.start); i-- {
+		if r.list[i].version == t.version && bytes.Equal(r.list[i].end, t.end) {
+			return
+		}
+	}
+	r.list = append(r.list, rangeTombstone{})
+	copy(r.list[idx+1:], r.list[idx:])
+	r.list[idx] = t
+}
+
+func (r *rangeDels) remove(t rangeTombstone) {
+	r.Lock()
+	defer r.Unlock()
+	for i, o := range r.list {
+		if o.version == t.version && bytes.Equal(o.start, t.start) && bytes.Equal(o.end, t.end) {
+			r.list = append(r.list[:i], r.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// covers returns true if the given version of key is deleted by a tombstone visible at readTs.
+func (r *rangeDels) covers(key []byte, version, readTs uint64) bool {
+	r.RLock()
+	defer r.RUnlock()
+	for _, t := range r.list {
+		if bytes.Compare(t.start, key) > 0 {
+			break
+		}
+		if t.covers(key, version, readTs) {
+			return true
+		}
+	}
+	return false
+}
+
+// newerThan returns true if key is covered by a tombstone newer than readTs.
+func (r *rangeDels) newerThan(key []byte, readTs uint64) bool {
+	return r.covers(key, readTs, math.MaxUint64)
+}
+
+// overlapsSince returns true if a tombstone at or after version deletes any key in kr, which
+// must be bounded.
+func (r *rangeDels) overlapsSince(kr y.KeyRange, version uint64) bool {
+	r.RLock()
+	defer r.RUnlock()
+	for _, t := range r.list {
+		if t.version >= version &&
+			bytes.Compare(t.start, kr.Upper) < 0 && bytes.Compare(t.end, kr.Lower) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRangeDels finds all the range tombstones in the LSM tree.
+func (s *KV) loadRangeDels() error {
+	r := y.KeyRange{Lower: rangeDelPrefix, Upper: prefixEnd(rangeDelPrefix)}
+	it := y.NewMergeRangeIterator(s.lc.appendIterators(nil, false, r), false, r)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		if it.Value().Meta&BitRangeDelete == 0 {
+			continue
+		}
+		t, err := parseRangeDelKey(it.Key())
+		if err != nil {
+			return err
+		}
+		s.rangeDels.add(t)
+	}
+	return nil
+}
+
+// DeleteRange deletes all the keys from start (inclusive) to end (exclusive), with a single range
+// tombstone, instead of one tombstone for each key. Keys written later, even within the range,
+// are not affected. The deleted keys are dropped by compactions, and the tombstone once it has
+// reached the last level.
+func (s *KV) DeleteRange(start, end []byte) error {
+	if bytes.Compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+	return s.BatchSet([]*Entry{{Key: rangeDelKey(start, end), Meta: BitRangeDelete}})
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func rangeKey(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+
+func setRangeKeys(t *testing.T, kv *KV, n int, prefix string) {
+	var entries []*Entry
+	for i := 0; i < n; i++ {
+		val := []byte(fmt.Sprintf("%s%d", prefix, i))
+		entries = append(entries, &Entry{Key: rangeKey(i), Value: val})
+		if len(entries) == 100 || i == n-1 {
+			require.NoError(t, kv.BatchSet(entries))
+			entries = entries[:0]
+		}
+	}
+}
+
+// checkRangeKeys checks that exactly the keys for which deleted returns false are visible, both
+// through Get and through iteration.
+func checkRangeKeys(t *testing.T, kv *KV, n int, deleted func(i int) bool) {
+	var want []string
+	for i := 0; i < n; i++ {
+		val, _, err := kv.Get(rangeKey(i))
+		require.NoError(t, err)
+		if deleted(i) {
+			require.Nil(t, val, "key%04d", i)
+		} else {
+			require.NotNil(t, val, "key%04d", i)
+			want = append(want, string(rangeKey(i)))
+		}
+	}
+	var got []string
+	it := kv.NewIterator(IteratorOptions{Prefix: []byte("key")})
+	for it.Rewind(); it.Valid(); it.Next() {
+		got = append(got, string(it.Item().Key()))
+	}
+	it.Close()
+	require.Equal(t, want, got)
+}
+
+func TestDeleteRange(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+
+	setRangeKeys(t, kv, 1000, "val")
+	before := kv.Version()
+	require.Equal(t, ErrInvalidRange, kv.DeleteRange(rangeKey(200), rangeKey(100)))
+	require.NoError(t, kv.DeleteRange(rangeKey(100), rangeKey(200)))
+	require.NoError(t, kv.Set(rangeKey(150), []byte("again")))
+
+	deleted := func(i int) bool { return i >= 100 && i < 200 && i != 150 }
+	checkRangeKeys(t, kv, 1000, deleted)
+	val, _, err := kv.GetAt(rangeKey(120), before)
+	require.NoError(t, err)
+	require.Equal(t, "val120", string(val), "Older reads don't see the tombstone.")
+
+	// The tombstone itself is not a key.
+	it := kv.NewIterator(DefaultIteratorOptions)
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.False(t, bytes.HasPrefix(it.Item().Key(), rangeDelPrefix))
+	}
+	it.Close()
+
+	// A transaction which read a key in the range conflicts.
+	txn := kv.NewTransaction(true)
+	_, err = txn.Get(rangeKey(300))
+	require.NoError(t, err)
+	require.NoError(t, txn.Set(rangeKey(300), []byte("txn")))
+	require.NoError(t, kv.DeleteRange(rangeKey(250), rangeKey(350)))
+	require.Equal(t, ErrConflict, txn.Commit())
+	deleted = func(i int) bool {
+		return (i >= 100 && i < 200 && i != 150) || (i >= 250 && i < 350)
+	}
+	checkRangeKeys(t, kv, 1000, deleted)
+	require.NoError(t, kv.Close())
+
+	kv, err = NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+	checkRangeKeys(t, kv, 1000, deleted)
+}
+
+func TestDeleteRangeCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.MaxLevels = 2
+	opt.DoNotCompact = true
+
+	// Put the keys and the tombstone in separate tables on level 0.
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	setRangeKeys(t, kv, 1000, "val")
+	require.NoError(t, kv.Close())
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	require.NoError(t, kv.DeleteRange(rangeKey(100), rangeKey(900)))
+	require.NoError(t, kv.Close())
+
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(kv.rangeDels.list), "The tombstone should be loaded from its table.")
+	deleted := func(i int) bool { return i >= 100 && i < 900 }
+	checkRangeKeys(t, kv, 1000, deleted)
+
+	// Level 1 is the last level, so the tombstone goes away with the keys it deletes.
+	require.NoError(t, kv.lc.doCompact(0))
+	require.Equal(t, 0, len(kv.rangeDels.list))
+	var count int
+	for _, tbl := range kv.lc.levels[1].tables {
+		it := tbl.NewIterator(false)
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.False(t, bytes.HasPrefix(it.Key(), rangeDelPrefix))
+			count++
+		}
+		it.Close()
+	}
+	require.Equal(t, 201, count, "Only the keys outside the range and head should be left.")
+	checkRangeKeys(t, kv, 1000, deleted)
+	require.NoError(t, kv.Close())
+}
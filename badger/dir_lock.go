@@ -0,0 +1,72 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// lockFilename is the file in Options.Dir which NewKV locks, so that two processes never write
+// to the same directory.
+const lockFilename = "LOCK"
+
+// ErrDirLocked is returned by NewKV when another KV, in this process or another one, is using
+// Options.Dir. A directory can be used by a single KV, or by any number of read-only ones.
+var ErrDirLocked = errors.New("Directory is in use by another KV")
+
+// dirLock is an advisory lock on a directory. It is released by the OS if the process dies.
+type dirLock struct {
+	fd *os.File
+}
+
+// acquireDirLock locks dir, exclusively unless readOnly is set. The lock file is created if
+// needed, even by a read-only KV, so that a writer can't open dir while it is being read.
+func acquireDirLock(dir string, readOnly bool) (*dirLock, error) {
+	path := filepath.Join(dir, lockFilename)
+	flag, how := os.O_RDWR, syscall.LOCK_EX
+	if readOnly {
+		flag, how = os.O_RDONLY, syscall.LOCK_SH
+	}
+	fd, err := os.OpenFile(path, flag|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, y.Wrapf(err, "Unable to open %q", path)
+	}
+	if err := syscall.Flock(int(fd.Fd()), how|syscall.LOCK_NB); err != nil {
+		fd.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrDirLocked
+		}
+		return nil, y.Wrapf(err, "Unable to lock %q", path)
+	}
+	return &dirLock{fd: fd}, nil
+}
+
+// release unlocks the directory. It can be called more than once.
+func (l *dirLock) release() error {
+	if l.fd == nil {
+		return nil
+	}
+	// Closing the file releases the lock.
+	err := l.fd.Close()
+	l.fd = nil
+	return err
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+const discardFilename = "DISCARD"
+
+// discardStats has the number of bytes in each value log file taken by entries which are garbage.
+// Either compactions dropped the keys pointing to them, or nothing ever pointed to them, such as
+// small values kept in the LSM tree, and transaction markers. See KV.mtDiscards. Value log GC
+// rewrites the file with the highest share of them.
+//
+// The stats are kept in the DISCARD file, as the file ID (4 bytes) and the number of bytes (8) of
+// each value log file, followed by their CRC32C. They only guide GC, so they are started over if
+// the file is corrupt.
+type discardStats struct {
+	sync.Mutex
+	path     string
+	readOnly bool
+	bytes    map[int32]int64
+}
+
+func openDiscardStats(dir string, readOnly bool) (*discardStats, error) {
+	d := &discardStats{
+		path:     filepath.Join(dir, discardFilename),
+		readOnly: readOnly,
+		bytes:    make(map[int32]int64),
+	}
+	buf, err := ioutil.ReadFile(d.path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, y.Wrapf(err, "Unable to read %s", d.path)
+	}
+	n := len(buf) - crcSize
+	if n < 0 || n%12 != 0 || crc32.Checksum(buf[:n], castagnoli) != binary.BigEndian.Uint32(buf[n:]) {
+		y.Printf("Ignoring corrupt value log discard stats in %s\n", d.path)
+		return d, nil
+	}
+	for i := 0; i < n; i += 12 {
+		fid := int32(binary.BigEndian.Uint32(buf[i : i+4]))
+		d.bytes[fid] = int64(binary.BigEndian.Uint64(buf[i+4 : i+12]))
+	}
+	return d, nil
+}
+
+// get returns the number of bytes discarded in the value log file fid.
+func (d *discardStats) get(fid int32) int64 {
+	d.Lock()
+	defer d.Unlock()
+	return d.bytes[fid]
+}
+
+// add adds the number of bytes discarded per value log file, and saves the stats.
+func (d *discardStats) add(discards map[int32]int64) error {
+	if len(discards) == 0 {
+		return nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	for fid, n := range discards {
+		d.bytes[fid] += n
+	}
+	return d.save()
+}
+
+// remove forgets about the value log file fid, once it has been garbage collected.
+func (d *discardStats) remove(fid int32) error {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.bytes[fid]; !ok {
+		return nil
+	}
+	delete(d.bytes, fid)
+	return d.save()
+}
+
+// save writes the stats to a temporary file, which then replaces the DISCARD file. d must be
+// locked.
+func (d *discardStats) save() error {
+	if d.readOnly {
+		return nil
+	}
+	buf := make([]byte, 0, 12*len(d.bytes)+crcSize)
+	var rec [12]byte
+	for fid, n := range d.bytes {
+		binary.BigEndian.PutUint32(rec[0:4], uint32(fid))
+		binary.BigEndian.PutUint64(rec[4:12], uint64(n))
+		buf = append(buf, rec[:]...)
+	}
+	var crcBuf [crcSize]byte
+	binary.BigEndian.PutUint32(crcBuf[:], crc32.Checksum(buf, castagnoli))
+	buf = append(buf, crcBuf[:]...)
+
+	tmpName := d.path + ".tmp"
+	fd, err := y.OpenSyncedFile(tmpName, true)
+	if err != nil {
+		return y.Wrapf(err, "Unable to create %s", tmpName)
+	}
+	if err := fd.Truncate(0); err != nil {
+		fd.Close()
+		return y.Wrapf(err, "Unable to truncate %s", tmpName)
+	}
+	if _, err := fd.Write(buf); err != nil {
+		fd.Close()
+		return y.Wrapf(err, "Unable to write %s", tmpName)
+	}
+	if err := fd.Close(); err != nil {
+		return y.Wrapf(err, "Unable to close %s", tmpName)
+	}
+	return y.Wrapf(os.Rename(tmpName, d.path), "Unable to rename %s to %s", tmpName, d.path)
+}
@@ -2,6 +2,8 @@ package badger_test
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	"github.com/dgraph-io/badger/badger"
 )
@@ -9,22 +11,30 @@ import (
 var d string = "doc"
 
 func Example() {
+	dir, _ := ioutil.TempDir("", "badger")
+	defer os.RemoveAll(dir)
 	opt := badger.DefaultOptions
-	opt.Dir = "/tmp"
-	kv := badger.NewKV(&opt)
+	opt.Dir = dir
+	kv, err := badger.NewKV(&opt)
+	if err != nil {
+		fmt.Printf("Error while opening: %v\n", err)
+		return
+	}
 
 	key := []byte("hello")
 
-	kv.Set(key, []byte("world"))
+	if err := kv.Set(key, []byte("world")); err != nil {
+		fmt.Printf("Error while setting: %v\n", err)
+	}
 	fmt.Printf("SET %s world\n", key)
 
-	val, cas := kv.Get(key)
+	val, cas, _ := kv.Get(key)
 	fmt.Printf("GET %s %s\n", key, val)
 
 	if err := kv.CompareAndSet(key, []byte("venus"), 100); err != nil {
 		fmt.Println("CAS counter mismatch")
 	} else {
-		val, _ = kv.Get(key)
+		val, _, _ = kv.Get(key)
 		fmt.Printf("Set to %s\n", val)
 	}
 	if err := kv.CompareAndSet(key, []byte("mars"), cas); err == nil {
@@ -43,7 +53,7 @@ func Example() {
 // func ExampleNewIterator() {
 // 	opt := DefaultOptions
 // 	opt.Dir = "/tmp/badger"
-// 	kv := NewKV(&opt)
+// 	kv, _ := NewKV(&opt)
 
 // 	itrOpt := IteratorOptions{
 // 		PrefetchSize: 1000,
@@ -54,6 +64,6 @@ func Example() {
 // 	for itr.Rewind(); itr.Valid(); itr.Next() {
 // 		item := itr.Item()
 // 		item.Key()
-// 		item.Value()
+// 		item.Value() // Returns ([]byte, error).
 // 	}
 // }
@@ -0,0 +1,295 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/dgraph-io/badger/table"
+	"github.com/dgraph-io/badger/y"
+)
+
+// ErrIngestOverlap is returned by IngestFiles when a file has keys which have been written to the
+// KV since its SSTWriter was created, or which are in another of the files.
+var ErrIngestOverlap = errors.New("Ingested file overlaps with newer writes or other files")
+
+// errIngestUnchecked is returned on the writer goroutine when tables which could overlap the
+// ingested ones came in since they were scanned. See KV.ingestTables.
+var errIngestUnchecked = errors.New("Tables came in since the ingested ranges were scanned")
+
+// IngestFiles adds the files written by SSTWriters of this KV to the LSM tree, each at the
+// deepest level it fits in without overlapping the tables above. Either all the files are
+// ingested or none. The files are hard linked into Options.Dir when possible, so they must not be
+// changed afterwards, though they can be removed.
+//
+// Keys of a file must not have been written since its SSTWriter was created. That includes the
+// writes still in the memtables, so IngestFiles can fail with ErrIngestOverlap even when the
+// writes came before the SSTWriter. The files of one call must not overlap with each other.
+func (s *KV) IngestFiles(paths []string) error {
+	if s.opt.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	// Log the ingest like a compaction which only inserts tables. If we crash before it is done,
+	// replaying the compact log deletes the tables.
+	c := &compaction{compactID: s.lc.reserveCompactID()}
+	first, _ := s.lc.reserveFileIDs(len(paths))
+	for i := range paths {
+		c.toInsert = append(c.toInsert, first+uint64(i))
+	}
+	if err := s.lc.clog.add(c); err != nil {
+		return y.Wrapf(err, "While writing to compact log")
+	}
+
+	tables, err := s.openIngestTables(paths, c.toInsert)
+	if err == nil {
+		err = s.ingestTables(tables)
+	}
+	// The levels hold their own references. Tables which weren't ingested get deleted.
+	closeTables(tables)
+
+	c.done = 1
+	if cerr := s.lc.clog.add(c); cerr != nil && err == nil {
+		err = y.Wrapf(cerr, "While writing to compact log")
+	}
+	return err
+}
+
+// ingestTables scans the tables of the LSM tree in the ranges of the ingested tables for versions
+// which are as new as them, and then ingests them on the writer goroutine. Writes are stopped
+// there, so it only looks at the memtables, and the ranges of the tables which came in since the
+// scan. If any of those could overlap, it goes back to scan them.
+func (s *KV) ingestTables(tables []*table.Table) error {
+	scanned := make(map[uint64]bool) // IDs of the tables scanned.
+	for {
+		if err := s.lc.scanIngest(tables, scanned); err != nil {
+			return err
+		}
+		err := s.runExclusive(func() error {
+			return s.lc.ingest(tables, scanned)
+		})
+		if err != errIngestUnchecked {
+			return err
+		}
+	}
+}
+
+// openIngestTables links or copies each file into the directory under the given ID, and opens it.
+func (s *KV) openIngestTables(paths []string, ids []uint64) ([]*table.Table, error) {
+	var tables []*table.Table
+	for i, path := range paths {
+		fname := table.NewFilename(ids[i], s.opt.Dir)
+		if err := linkOrCopy(path, fname); err != nil {
+			closeTables(tables)
+			return nil, err
+		}
+		fd, err := y.OpenSyncedFile(fname, true)
+		if err != nil {
+			os.Remove(fname)
+			closeTables(tables)
+			return nil, y.Wrapf(err, "Unable to open table: %s", fname)
+		}
+		tbl, err := s.openTable(fd)
+		if err != nil {
+			fd.Close()
+			os.Remove(fname)
+			closeTables(tables)
+			return nil, y.Wrapf(err, "Unable to open SST file: %s", path)
+		}
+		tables = append(tables, tbl)
+
+		version := y.ParseTs(tbl.Smallest())
+		if version == 0 || version != y.ParseTs(tbl.Biggest()) || version > s.Version() {
+			closeTables(tables)
+			return nil, y.Errorf("File %s was not written by an SSTWriter of this KV", path)
+		}
+	}
+	return tables, nil
+}
+
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return y.Wrapf(err, "Unable to open SST file: %s", src)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return y.Wrapf(err, "Unable to create table: %s", dst)
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return y.Wrapf(err, "Unable to copy %s to %s", src, dst)
+	}
+	return nil
+}
+
+// ingestRange returns the range of the user keys in t.
+func ingestRange(t *table.Table) y.KeyRange {
+	biggest := y.ParseKey(t.Biggest())
+	return y.KeyRange{
+		Lower: y.ParseKey(t.Smallest()),
+		Upper: append(y.Safecopy(nil, biggest), 0), // The first key after biggest.
+	}
+}
+
+// scanIngest returns ErrIngestOverlap if a table of the LSM tree, other than the scanned ones, has
+// a version of a key in the range of an ingested table which isn't older than it. The tables
+// it scans are added to scanned.
+func (s *levelsController) scanIngest(tables []*table.Table, scanned map[uint64]bool) error {
+	overlaps := func(t *table.Table) bool {
+		for _, it := range tables {
+			if ingestRange(it).Overlaps(t.Smallest(), t.Biggest()) {
+				return true
+			}
+		}
+		return false
+	}
+	var toScan []*table.Table
+	for _, level := range s.levels {
+		level.RLock()
+		for _, t := range level.tables {
+			if !scanned[t.ID()] && overlaps(t) {
+				t.IncrRef()
+				toScan = append(toScan, t)
+			}
+		}
+		level.RUnlock()
+	}
+	defer closeTables(toScan)
+
+	for _, t := range toScan {
+		for _, it := range tables {
+			r, version := ingestRange(it), y.ParseTs(it.Smallest())
+			if err := scanIngestRange(t, r, version); err != nil {
+				return err
+			}
+		}
+		scanned[t.ID()] = true
+	}
+	return nil
+}
+
+// scanIngestRange returns ErrIngestOverlap if t has a version of a key in r which isn't older than
+// version.
+func scanIngestRange(t *table.Table, r y.KeyRange, version uint64) error {
+	it := table.NewConcatRangeIterator([]*table.Table{t}, false, r)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		if y.ParseTs(it.Key()) >= version && !bytes.Equal(y.ParseKey(it.Key()), head) {
+			return ErrIngestOverlap
+		}
+	}
+	return nil
+}
+
+// ingest adds tables to the LSM tree. It runs on the writer goroutine, so no write can land in
+// their key ranges while it checks for overlaps. The tables of the LSM tree which could overlap
+// them must have been scanned already. See KV.ingestTables.
+func (s *levelsController) ingest(tables []*table.Table, scanned map[uint64]bool) error {
+	sorted := make([]*table.Table, len(tables))
+	copy(sorted, tables)
+	sort.Slice(sorted, func(i, j int) bool {
+		return y.CompareKeys(sorted[i].Smallest(), sorted[j].Smallest()) < 0
+	})
+	for i := 1; i < len(sorted); i++ {
+		if ingestRange(sorted[i-1]).Overlaps(sorted[i].Smallest(), sorted[i].Biggest()) {
+			return ErrIngestOverlap
+		}
+	}
+
+	s.claimAllLevels()
+	levels := make([]int, len(sorted))
+	for i, t := range sorted {
+		r := ingestRange(t)
+		if err := s.checkIngest(r, y.ParseTs(t.Smallest()), scanned); err != nil {
+			s.releaseAllLevels()
+			return err
+		}
+		levels[i] = s.ingestLevel(r)
+		if err := updateLevel(t, levels[i]); err != nil {
+			s.releaseAllLevels()
+			return err
+		}
+	}
+	for i, t := range sorted {
+		if levels[i] > 0 {
+			s.levels[levels[i]].replaceTables([]*table.Table{t})
+		}
+	}
+	// Level 0 can stall until compactions catch up, so they need the levels back.
+	s.releaseAllLevels()
+	for i, t := range sorted {
+		if levels[i] == 0 {
+			s.addLevel0Table(t)
+		}
+	}
+	return nil
+}
+
+// checkIngest returns ErrIngestOverlap if the memtables have any key in r, or a range tombstone
+// covers a key in r, and isn't older than version. It returns errIngestUnchecked if a table which
+// hasn't been scanned could have a key in r, going by its smallest and biggest keys. Only the
+// ends of the tables are looked at, as it runs on the writer goroutine.
+func (s *levelsController) checkIngest(
+	r y.KeyRange, version uint64, scanned map[uint64]bool) error {
+	if s.kv.rangeDels.overlapsSince(r, version) {
+		return ErrIngestOverlap
+	}
+	isHead := func(key []byte) bool { return bytes.Equal(y.ParseKey(key), head) }
+
+	mts, decr := s.kv.getMemTables()
+	defer decr()
+	for _, mt := range mts {
+		it := mt.NewUniRangeIterator(false, r)
+		it.Rewind()
+		for ; it.Valid() && isHead(it.Key()); it.Next() {
+		}
+		found := it.Valid()
+		it.Close()
+		if found {
+			return ErrIngestOverlap
+		}
+	}
+
+	for _, level := range s.levels {
+		level.RLock()
+		for _, t := range level.tables {
+			if !scanned[t.ID()] && r.Overlaps(t.Smallest(), t.Biggest()) {
+				level.RUnlock()
+				return errIngestUnchecked
+			}
+		}
+		level.RUnlock()
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sstDir, err := ioutil.TempDir("/tmp", "badger-sst")
+	require.NoError(t, err)
+	defer os.RemoveAll(sstDir)
+	opt := getTestOptions(dir)
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	val := func(i int) []byte {
+		if i%3 == 0 { // Goes to the value log.
+			return []byte(strings.Repeat(fmt.Sprintf("%05d", i), 10))
+		}
+		return []byte(fmt.Sprintf("%05d", i))
+	}
+	for i := 0; i < 100; i++ {
+		require.NoError(t, kv.Set(key(i), []byte("old")))
+	}
+	require.NoError(t, kv.Close())
+	kv, err = NewKV(opt) // Flushes the memtable.
+	require.NoError(t, err)
+
+	writeFile := func(name string, from, to int) string {
+		path := filepath.Join(sstDir, name)
+		w, err := kv.NewSSTWriter(path)
+		require.NoError(t, err)
+		for i := from; i < to; i++ {
+			require.NoError(t, w.Add(key(i), val(i), byte(i)))
+		}
+		require.Equal(t, ErrUnsortedKeys, w.Add(key(from), val(from), 0))
+		require.NoError(t, w.Finish())
+		return path
+	}
+	// Overlaps the old keys, and doesn't.
+	first := writeFile("first.sst", 50, 1000)
+	second := writeFile("second.sst", 2000, 3000)
+	require.NoError(t, kv.IngestFiles([]string{second, first}))
+	// It has already been ingested.
+	require.Equal(t, ErrIngestOverlap, kv.IngestFiles([]string{second}))
+
+	// Keys written after the writer was created can't be overwritten by the file.
+	w, err := kv.NewSSTWriter(filepath.Join(sstDir, "third.sst"))
+	require.NoError(t, err)
+	require.NoError(t, kv.Set(key(4500), []byte("newer")))
+	for i := 4000; i < 5000; i++ {
+		require.NoError(t, w.Add(key(i), val(i), 0))
+	}
+	require.NoError(t, w.Finish())
+	require.Equal(t, ErrIngestOverlap, kv.IngestFiles([]string{filepath.Join(sstDir, "third.sst")}))
+
+	check := func() {
+		for i := 0; i < 5000; i++ {
+			item, err := kv.GetItem(key(i))
+			switch {
+			case i < 50:
+				require.NoError(t, err)
+				v, err := item.Value()
+				require.NoError(t, err)
+				require.Equal(t, "old", string(v))
+			case i < 1000 || (i >= 2000 && i < 3000):
+				require.NoError(t, err, string(key(i)))
+				v, err := item.Value()
+				require.NoError(t, err)
+				require.Equal(t, val(i), v)
+				require.Equal(t, byte(i), item.UserMeta())
+			case i == 4500:
+				require.NoError(t, err)
+			default:
+				require.Equal(t, ErrKeyNotFound, err, string(key(i)))
+			}
+		}
+	}
+	check()
+	// The second file doesn't overlap anything, so it goes to the last level.
+	require.Equal(t, 1, kv.lc.levels[opt.MaxLevels-1].numTables())
+	require.NoError(t, kv.Close())
+
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	check()
+}
+
+func TestIngestScansNewTables(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sstDir, err := ioutil.TempDir("/tmp", "badger-sst")
+	require.NoError(t, err)
+	defer os.RemoveAll(sstDir)
+	opt := getTestOptions(dir)
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	for i := 0; i < 100; i++ {
+		require.NoError(t, kv.Set(key(i), []byte("old")))
+	}
+	require.NoError(t, kv.Close())
+	kv, err = NewKV(opt) // Flushes the memtable.
+	require.NoError(t, err)
+	defer kv.Close()
+
+	path := filepath.Join(sstDir, "new.sst")
+	w, err := kv.NewSSTWriter(path)
+	require.NoError(t, err)
+	for i := 50; i < 150; i++ {
+		require.NoError(t, w.Add(key(i), []byte("new"), 0))
+	}
+	require.NoError(t, w.Finish())
+	first, _ := kv.lc.reserveFileIDs(1)
+	tables, err := kv.openIngestTables([]string{path}, []uint64{first})
+	require.NoError(t, err)
+	defer closeTables(tables)
+
+	// The table of the old keys hasn't been scanned, so it can't be ingested yet.
+	scanned := make(map[uint64]bool)
+	require.Equal(t, errIngestUnchecked, kv.runExclusive(func() error {
+		return kv.lc.ingest(tables, scanned)
+	}))
+	require.NoError(t, kv.lc.scanIngest(tables, scanned))
+	require.NotEmpty(t, scanned)
+	require.NoError(t, kv.runExclusive(func() error {
+		return kv.lc.ingest(tables, scanned)
+	}))
+	for i := 0; i < 150; i++ {
+		v, _, err := kv.Get(key(i))
+		require.NoError(t, err)
+		if i < 50 {
+			require.Equal(t, "old", string(v))
+		} else {
+			require.Equal(t, "new", string(v))
+		}
+	}
+}
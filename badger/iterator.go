@@ -1,6 +1,9 @@
 package badger
 
 import (
+	"bytes"
+	"context"
+	"math"
 	"sync"
 
 	"github.com/dgraph-io/badger/y"
@@ -10,26 +13,96 @@ import (
 // iterator.Next() is called.
 type KVItem struct {
 	wg         sync.WaitGroup
-	key        []byte
+	kv         *KV
+	key        []byte // Points into fullKey, without the version.
+	fullKey    []byte
 	vptr       []byte
 	meta       byte
+	userMeta   byte
 	val        []byte
-	casCounter uint16
+	err        error // Set if the value could not be fetched.
+	fetched    bool  // Set once val holds the value.
+	casCounter uint64
+	version    uint64
+	expiresAt  uint64
+	readTs     uint64
 	slice      *y.Slice
+	lf         *logFile // Set if val points into the mapping of this value log file.
 	next       *KVItem
 }
 
+// release lets go of the value log file val points into, if any.
+func (item *KVItem) release() {
+	if item.lf != nil {
+		item.lf.decrRef()
+		item.lf = nil
+	}
+}
+
 // Key returns the key. Remember to copy if you need to access it outside the iteration loop.
 func (item *KVItem) Key() []byte {
 	return item.key
 }
 
+// Version returns the version of the key-value pair, which is the newest one visible at the
+// read timestamp of the iterator.
+func (item *KVItem) Version() uint64 {
+	return item.version
+}
+
+// UserMeta returns the user metadata set on the Entry.
+func (item *KVItem) UserMeta() byte {
+	return item.userMeta
+}
+
+// Counter returns the CAS counter of the key-value pair.
+func (item *KVItem) Counter() uint64 {
+	return item.casCounter
+}
+
+// ExpiresAt returns the Unix time in seconds at which the key expires. Zero means it never does.
+func (item *KVItem) ExpiresAt() uint64 {
+	return item.expiresAt
+}
+
 // Value returns the value, generally fetched from the value log. This call can block while
 // the value is populated asynchronously via a disk read. Remember to parse or copy it if you
-// need to access it outside the iterator loop.
-func (item *KVItem) Value() []byte {
+// need to access it outside the iterator loop. An error is returned if the value could not be
+// read from the value log.
+func (item *KVItem) Value() ([]byte, error) {
+	item.wg.Wait()
+	return item.val, item.err
+}
+
+// ValueSize returns the size of the value. If the value has not been fetched, it is worked out
+// without reading the value itself from the value log, unless it was stored compressed there, or
+// has to be folded from merge operands.
+func (item *KVItem) ValueSize() (int, error) {
 	item.wg.Wait()
-	return item.val
+	switch {
+	case item.fetched:
+		return len(item.val), item.err
+	case item.meta&BitDelete != 0:
+		return 0, nil
+	case item.meta&BitMergeOperand != 0:
+		val, err := item.kv.foldMerges(item.key, item.valueStruct(), item.readTs)
+		return len(val), err
+	case item.meta&BitValuePointer == 0:
+		return len(item.vptr), nil
+	}
+	var vp valuePointer
+	vp.Decode(item.vptr)
+	return item.kv.vlog.valueSize(vp)
+}
+
+// valueStruct returns the value of the item as found in the LSM tree.
+func (item *KVItem) valueStruct() y.ValueStruct {
+	return y.ValueStruct{
+		Value:     item.vptr,
+		Meta:      item.meta,
+		Version:   item.version,
+		ExpiresAt: item.expiresAt,
+	}
 }
 
 type list struct {
@@ -67,6 +140,46 @@ type IteratorOptions struct {
 	PrefetchSize int  // How many KV pairs to prefetch while iterating.
 	FetchValues  bool // Controls whether the values should be fetched from the value log.
 	Reverse      bool // Direction of iteration. False is forward, true is backward.
+
+	// Only versions not newer than ReadTs are visible. Zero means KV.Version() at the time the
+	// iterator is created.
+	ReadTs uint64
+
+	// Only keys from LowerBound (inclusive) to UpperBound (exclusive) that start with Prefix are
+	// returned, in either direction. Empty means no restriction. Tables which can't have such
+	// keys are never read.
+	LowerBound []byte
+	UpperBound []byte
+	Prefix     []byte
+}
+
+// keyRange returns the range of keys the iterator is restricted to.
+func (opt *IteratorOptions) keyRange() y.KeyRange {
+	r := y.KeyRange{Lower: opt.LowerBound, Upper: opt.UpperBound}
+	if len(opt.Prefix) == 0 {
+		return r
+	}
+	if bytes.Compare(opt.Prefix, r.Lower) > 0 {
+		r.Lower = opt.Prefix
+	}
+	if end := prefixEnd(opt.Prefix); end != nil &&
+		(len(r.Upper) == 0 || bytes.Compare(end, r.Upper) < 0) {
+		r.Upper = end
+	}
+	return r
+}
+
+// prefixEnd returns the smallest key bigger than all the keys starting with prefix, or nil if
+// there is none, because prefix is all 0xff.
+func prefixEnd(prefix []byte) []byte {
+	end := y.Safecopy(nil, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
 }
 
 var DefaultIteratorOptions = IteratorOptions{
@@ -77,8 +190,10 @@ var DefaultIteratorOptions = IteratorOptions{
 
 // Iterator helps iterating over the KV pairs in a lexicographically sorted order.
 type Iterator struct {
-	kv   *KV
-	iitr y.Iterator
+	kv     *KV
+	iitr   y.Iterator
+	ctx    context.Context
+	readTs uint64
 
 	opt   IteratorOptions
 	item  *KVItem
@@ -89,13 +204,23 @@ type Iterator struct {
 func (it *Iterator) newItem() *KVItem {
 	item := it.waste.pop()
 	if item == nil {
-		item = &KVItem{slice: new(y.Slice)}
+		item = &KVItem{kv: it.kv, slice: new(y.Slice)}
 	}
 	return item
 }
 
 func (it *Iterator) fetchOneValue(item *KVItem) {
-	item.val = it.kv.decodeValue(item.vptr, item.meta, item.slice)
+	if err := it.ctx.Err(); err != nil {
+		item.val, item.err = nil, err
+		item.wg.Done()
+		return
+	}
+	if item.meta&BitMergeOperand != 0 {
+		item.val, item.err = it.kv.foldMerges(item.key, item.valueStruct(), it.readTs)
+	} else {
+		item.val, item.lf, item.err = it.kv.readValue(item.vptr, item.meta, item.slice, true)
+	}
+	item.fetched = true
 	item.wg.Done()
 }
 
@@ -103,11 +228,21 @@ func (it *Iterator) fetchOneValue(item *KVItem) {
 // This item is only valid until it.Next() gets called.
 func (it *Iterator) Item() *KVItem { return it.item }
 
-// Valid returns false when iteration is done.
-func (it *Iterator) Valid() bool { return it.item != nil }
+// Valid returns false when iteration is done, or the iterator's context is done.
+func (it *Iterator) Valid() bool { return it.item != nil && it.ctx.Err() == nil }
+
+// Err returns the error from the iterator's context, if any. Check it once Valid returns false,
+// to tell a canceled iteration apart from a finished one.
+func (it *Iterator) Err() error { return it.ctx.Err() }
 
 // Close would close the iterator. It is important to call this when you're done with iteration.
 func (it *Iterator) Close() {
+	for _, l := range []list{{head: it.item}, it.data, it.waste} {
+		for item := l.head; item != nil; item = item.next {
+			item.wg.Wait()
+			item.release()
+		}
+	}
 	it.iitr.Close()
 }
 
@@ -121,39 +256,73 @@ func (it *Iterator) Next() {
 	// Set next item to current
 	it.item = it.data.pop()
 
-	// Advance internal iterator
-	if it.iitr.Valid() {
-		it.iitr.Next()
+	item := it.newItem()
+	if it.parseItem(item) {
+		it.data.push(item)
+	} else {
+		it.waste.push(item)
 	}
-	if !it.iitr.Valid() {
-		return
+}
+
+// parseItem fills item with the version of the next key which is visible at it.readTs, and
+// moves the internal iterator past all the versions of that key. Keys whose visible version has
+// expired are skipped. It returns false if there is no such key left.
+func (it *Iterator) parseItem(item *KVItem) bool {
+	for it.iitr.Valid() {
+		if y.ParseTs(it.iitr.Key()) > it.readTs {
+			it.iitr.Next()
+			continue
+		}
+		it.fill(item)
+		it.iitr.Next()
+		// Versions of a key come newest first, so going forward we already have the one we
+		// want. Going backward, they come oldest first, so keep the last visible one.
+		for it.iitr.Valid() && y.SameKey(it.iitr.Key(), item.fullKey) {
+			if it.opt.Reverse && y.ParseTs(it.iitr.Key()) <= it.readTs {
+				it.fill(item)
+			}
+			it.iitr.Next()
+		}
+		if isExpired(item.expiresAt) || item.meta&BitRangeDelete != 0 ||
+			it.kv.rangeDels.covers(item.key, item.version, it.readTs) {
+			continue
+		}
+		if it.opt.FetchValues {
+			item.wg.Add(1)
+			go it.fetchOneValue(item)
+		}
+		return true
 	}
-	item := it.newItem()
-	it.fill(item)
-	it.data.push(item)
+	return false
 }
 
 func (it *Iterator) fill(item *KVItem) {
+	item.release()
 	vs := it.iitr.Value()
 	item.meta = vs.Meta
+	item.userMeta = vs.UserMeta
+	item.val = nil
+	item.err = nil
+	item.fetched = false
 	item.casCounter = vs.CASCounter
-	item.key = y.Safecopy(item.key, it.iitr.Key())
+	item.fullKey = y.Safecopy(item.fullKey, it.iitr.Key())
+	item.key = y.ParseKey(item.fullKey)
+	item.version = y.ParseTs(item.fullKey)
+	item.expiresAt = vs.ExpiresAt
+	item.readTs = it.readTs
 	item.vptr = y.Safecopy(item.vptr, vs.Value)
-	if it.opt.FetchValues {
-		item.wg.Add(1)
-		go it.fetchOneValue(item)
-	}
 }
 
 func (it *Iterator) prefetch() {
-	i := it.iitr
 	var count int
 	it.item = nil
-	for ; i.Valid(); i.Next() {
-		count++
-
+	for {
 		item := it.newItem()
-		it.fill(item)
+		if !it.parseItem(item) {
+			it.waste.push(item)
+			break
+		}
+		count++
 		if it.item == nil {
 			it.item = item
 		} else {
@@ -169,11 +338,16 @@ func (it *Iterator) prefetch() {
 // greater than provided if iterating in the forward direction. Behavior would be reversed is
 // iterating backwards.
 func (it *Iterator) Seek(key []byte) {
-	for i := it.data.pop(); i != nil; {
+	for i := it.data.pop(); i != nil; i = it.data.pop() {
 		i.wg.Wait()
 		it.waste.push(i)
 	}
-	it.iitr.Seek(key)
+	// Position before all the versions of key, in the direction of iteration.
+	if !it.opt.Reverse {
+		it.iitr.Seek(y.KeyWithTs(key, math.MaxUint64))
+	} else {
+		it.iitr.Seek(y.KeyWithTs(key, 0))
+	}
 	it.prefetch()
 }
 
@@ -200,26 +374,38 @@ func (it *Iterator) Rewind() {
 //   for itr.Rewind(); itr.Valid(); itr.Next() {
 //     item := itr.Item()
 //     key := item.Key()
-//     val := item.Value() // This could block while value is fetched from value log.
-//                         // For key only iteration, set opt.FetchValues to false, and don't call
-//                         // item.Value().
+//     val, err := item.Value() // This could block while value is fetched from value log.
+//                              // For key only iteration, set opt.FetchValues to false, and don't
+//                              // call item.Value().
 //
 //     // Remember that both key, val would become invalid in the next iteration of the loop.
 //     // So, if you need access to them outside, copy them or parse them.
 //   }
 //   itr.Close()
 func (s *KV) NewIterator(opt IteratorOptions) *Iterator {
+	return s.NewIteratorContext(context.Background(), opt)
+}
+
+// NewIteratorContext is like NewIterator, but the iterator becomes invalid once ctx is done,
+// and it.Err() returns ctx.Err(). Values not yet fetched would then return ctx.Err() as well.
+func (s *KV) NewIteratorContext(ctx context.Context, opt IteratorOptions) *Iterator {
 	tables, decr := s.getMemTables()
 	defer decr()
+	r := opt.keyRange()
 	var iters []y.Iterator
 	for i := 0; i < len(tables); i++ {
-		iters = append(iters, tables[i].NewUniIterator(opt.Reverse))
+		iters = append(iters, tables[i].NewUniRangeIterator(opt.Reverse, r))
 	}
-	iters = s.lc.appendIterators(iters, opt.Reverse) // This will increment references.
+	iters = s.lc.appendIterators(iters, opt.Reverse, r) // This will increment references.
 	res := &Iterator{
-		kv:   s,
-		iitr: y.NewMergeIterator(iters, opt.Reverse),
-		opt:  opt,
+		kv:     s,
+		iitr:   y.NewMergeRangeIterator(iters, opt.Reverse, r),
+		ctx:    ctx,
+		readTs: opt.ReadTs,
+		opt:    opt,
+	}
+	if res.readTs == 0 {
+		res.readTs = s.Version()
 	}
 	return res
 }
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+const (
+	keyRegistryFilename = "KEYREGISTRY"
+	keyRegistryMagic    = "badgerkr"
+	keyRegistryVersion  = 1
+	// keyRegistryHeaderSize is the size of the magic and the version the key registry starts with.
+	keyRegistryHeaderSize = len(keyRegistryMagic) + 4
+)
+
+// ErrInvalidEncryptionKey is returned by NewKV when Options.EncryptionKey isn't 16, 24 or 32 bytes
+// long.
+var ErrInvalidEncryptionKey = errors.New("Encryption key must be 16, 24 or 32 bytes long")
+
+// ErrEncryptionKeyMismatch is returned by NewKV when the data keys of Options.Dir were encrypted
+// with another key than Options.EncryptionKey.
+var ErrEncryptionKeyMismatch = errors.New(
+	"Encryption key doesn't match the one the directory was encrypted with")
+
+// ErrEncryptionKeyRequired is returned by NewKV when Options.Dir is encrypted, but
+// Options.EncryptionKey isn't set.
+var ErrEncryptionKeyRequired = errors.New("Directory is encrypted. Set Options.EncryptionKey")
+
+// dataKey encrypts the value log files and tables created while it was the latest one. Its ID is
+// written in the files it encrypts. ID 0 means a file isn't encrypted.
+type dataKey struct {
+	id        uint64
+	createdAt time.Time
+	block     cipher.Block
+}
+
+// keyRegistry keeps the data keys in the KEYREGISTRY file, encrypted with AES-GCM under
+// Options.EncryptionKey. The file has a header of keyRegistryMagic and the version, followed by
+// one record per data key: its length, its CRC32C, and the key ID, the creation time, the nonce
+// and the sealed key. Keys are only ever appended, so the files they encrypt stay readable.
+type keyRegistry struct {
+	sync.Mutex
+	path     string
+	master   cipher.AEAD // Nil if Options.EncryptionKey isn't set.
+	keyLen   int
+	rotation time.Duration
+	readOnly bool
+	keys     map[uint64]*dataKey
+	latest   *dataKey
+}
+
+// openKeyRegistry reads the data keys of opt.Dir. A record torn by a crash while it was appended
+// is truncated, as the key it had was never used.
+func openKeyRegistry(opt *Options) (*keyRegistry, error) {
+	kr := &keyRegistry{
+		path:     filepath.Join(opt.Dir, keyRegistryFilename),
+		keyLen:   len(opt.EncryptionKey),
+		rotation: opt.EncryptionKeyRotationDuration,
+		readOnly: opt.ReadOnly,
+		keys:     make(map[uint64]*dataKey),
+	}
+	if len(opt.EncryptionKey) > 0 {
+		block, err := aes.NewCipher(opt.EncryptionKey)
+		if err != nil {
+			return nil, ErrInvalidEncryptionKey
+		}
+		if kr.master, err = cipher.NewGCM(block); err != nil {
+			return nil, y.Wrapf(err, "Unable to set up encryption")
+		}
+	}
+	buf, err := ioutil.ReadFile(kr.path)
+	if os.IsNotExist(err) {
+		return kr, nil
+	}
+	if err != nil {
+		return nil, y.Wrapf(err, "Unable to read %s", kr.path)
+	}
+	if len(buf) < keyRegistryHeaderSize || string(buf[:len(keyRegistryMagic)]) != keyRegistryMagic {
+		return nil, y.Errorf("%s is not a key registry", kr.path)
+	}
+	if v := binary.BigEndian.Uint32(buf[len(keyRegistryMagic):]); v != keyRegistryVersion {
+		return nil, y.Errorf("%s has unsupported version %d", kr.path, v)
+	}
+	offset := keyRegistryHeaderSize
+	for offset < len(buf) {
+		rec := buf[offset:]
+		if len(rec) < 8 || len(rec) < 8+int(binary.BigEndian.Uint32(rec)) {
+			break // Torn.
+		}
+		payload := rec[8 : 8+binary.BigEndian.Uint32(rec)]
+		if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(rec[4:8]) {
+			return nil, y.Errorf("%s is corrupt at offset %d", kr.path, offset)
+		}
+		if kr.master == nil {
+			return nil, ErrEncryptionKeyRequired
+		}
+		key, err := kr.decodeKey(payload)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[key.id] = key
+		if kr.latest == nil || key.id > kr.latest.id {
+			kr.latest = key
+		}
+		offset += 8 + len(payload)
+	}
+	if offset < len(buf) && !opt.ReadOnly {
+		if err := os.Truncate(kr.path, int64(offset)); err != nil {
+			return nil, y.Wrapf(err, "Unable to truncate %s", kr.path)
+		}
+	}
+	return kr, nil
+}
+
+// decodeKey opens the data key in the payload of a record. The key ID and the creation time are
+// authenticated along with it.
+func (kr *keyRegistry) decodeKey(payload []byte) (*dataKey, error) {
+	nonceSize := kr.master.NonceSize()
+	if len(payload) < 16+nonceSize {
+		return nil, y.Errorf("%s has a record of invalid size %d", kr.path, len(payload))
+	}
+	key, err := kr.master.Open(nil, payload[16:16+nonceSize], payload[16+nonceSize:],
+		payload[:16])
+	if err != nil {
+		return nil, ErrEncryptionKeyMismatch
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, y.Wrapf(err, "Invalid data key in %s", kr.path)
+	}
+	return &dataKey{
+		id:        binary.BigEndian.Uint64(payload[0:8]),
+		createdAt: time.Unix(0, int64(binary.BigEndian.Uint64(payload[8:16]))),
+		block:     block,
+	}, nil
+}
+
+// latestKey returns the data key to encrypt a new file with, or nil if Options.EncryptionKey isn't
+// set. Once the latest one is older than Options.EncryptionKeyRotationDuration, a new one is
+// generated and added to the registry first.
+func (kr *keyRegistry) latestKey() (*dataKey, error) {
+	if kr == nil || kr.master == nil {
+		return nil, nil
+	}
+	kr.Lock()
+	defer kr.Unlock()
+	if kr.readOnly || (kr.latest != nil && time.Since(kr.latest.createdAt) < kr.rotation) {
+		return kr.latest, nil
+	}
+
+	raw := make([]byte, kr.keyLen)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, y.Wrapf(err, "Unable to generate data key")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, y.Wrapf(err, "Unable to generate data key")
+	}
+	key := &dataKey{id: 1, createdAt: time.Now(), block: block}
+	if kr.latest != nil {
+		key.id = kr.latest.id + 1
+	}
+	payload := make([]byte, 16+kr.master.NonceSize())
+	binary.BigEndian.PutUint64(payload[0:8], key.id)
+	binary.BigEndian.PutUint64(payload[8:16], uint64(key.createdAt.UnixNano()))
+	if _, err := rand.Read(payload[16:]); err != nil {
+		return nil, y.Wrapf(err, "Unable to generate nonce")
+	}
+	payload = kr.master.Seal(payload, payload[16:], raw, payload[:16])
+	if err := kr.append(payload); err != nil {
+		return nil, err
+	}
+	kr.keys[key.id] = key
+	kr.latest = key
+	return key, nil
+}
+
+// append writes a record with payload to the registry, creating it if need be, and syncs it.
+func (kr *keyRegistry) append(payload []byte) error {
+	f, err := os.OpenFile(kr.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return y.Wrapf(err, "Unable to open %s", kr.path)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return y.Wrapf(err, "Unable to stat %s", kr.path)
+	}
+	var buf []byte
+	if fi.Size() == 0 {
+		buf = append(buf, keyRegistryMagic...)
+		buf = append(buf, 0, 0, 0, keyRegistryVersion)
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, castagnoli))
+	buf = append(append(buf, header[:]...), payload...)
+	if _, err := f.Write(buf); err != nil {
+		return y.Wrapf(err, "Unable to write to %s", kr.path)
+	}
+	return y.Wrapf(f.Sync(), "Unable to sync %s", kr.path)
+}
+
+// cipher returns the data key with the given ID, or nil for ID 0.
+func (kr *keyRegistry) cipher(keyID uint64) (cipher.Block, error) {
+	if keyID == 0 {
+		return nil, nil
+	}
+	kr.Lock()
+	defer kr.Unlock()
+	key, ok := kr.keys[keyID]
+	if !ok {
+		return nil, y.Errorf("Data key %d is not in %s", keyID, kr.path)
+	}
+	return key.block, nil
+}
+
+// copyTo copies the registry to dir, if it exists.
+func (kr *keyRegistry) copyTo(dir string) error {
+	kr.Lock()
+	defer kr.Unlock()
+	fi, err := os.Stat(kr.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return y.Wrapf(err, "Unable to stat %s", kr.path)
+	}
+	return copyFile(kr.path, filepath.Join(dir, keyRegistryFilename), fi.Size())
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.EncryptionKey = bytes.Repeat([]byte("k"), 32)
+	opt.ValueCompression = nil // So values would show in the files if they weren't encrypted.
+	opt.ValueLogFileSize = 1 << 16
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	val := func(i int) []byte {
+		if i%2 == 0 { // Goes to the value log.
+			return []byte(strings.Repeat(fmt.Sprintf("secret%05d", i), 10))
+		}
+		return []byte(fmt.Sprintf("secret%d", i))
+	}
+	set := func(from, to int) {
+		var entries []*Entry
+		for i := from; i < to; i++ {
+			entries = append(entries, &Entry{Key: key(i), Value: val(i)})
+		}
+		require.NoError(t, kv.BatchSet(entries))
+	}
+	check := func(kv *KV, n int) {
+		for i := 0; i < n; i++ {
+			v, _, err := kv.Get(key(i))
+			require.NoError(t, err)
+			require.Equal(t, val(i), v, string(key(i)))
+		}
+	}
+	set(0, 1000)
+	require.NoError(t, kv.Close())
+	// A new data key for every file from now on. The files encrypted with the old ones can still
+	// be read.
+	opt.EncryptionKeyRotationDuration = time.Nanosecond
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	set(1000, 2000)
+	check(kv, 2000)
+	require.True(t, len(kv.registry.keys) > 2)
+	cpDir := filepath.Join(dir, "checkpoint")
+	require.NoError(t, kv.Checkpoint(cpDir))
+	var backup bytes.Buffer
+	_, err = kv.Backup(&backup)
+	require.NoError(t, err)
+	require.NoError(t, kv.Close())
+
+	// No key or value shows in the raw bytes of the files, be it in the blocks or the index of a
+	// table, or in the value log. Nor does the head key badger writes itself.
+	var tables, vlogs int
+	for _, d := range []string{dir, cpDir} {
+		fileInfos, err := ioutil.ReadDir(d)
+		require.NoError(t, err)
+		for _, fi := range fileInfos {
+			switch filepath.Ext(fi.Name()) {
+			case ".sst":
+				tables++
+			case ".vlog":
+				vlogs++
+			default:
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(d, fi.Name()))
+			require.NoError(t, err)
+			for _, s := range []string{"secret", "key0", "key1", string(head)} {
+				require.False(t, bytes.Contains(data, []byte(s)), "%s in %s", s, fi.Name())
+			}
+		}
+	}
+	require.True(t, tables > 1)
+	require.True(t, vlogs > 2)
+
+	opt.EncryptionKey = bytes.Repeat([]byte("x"), 32)
+	_, err = NewKV(opt)
+	require.Equal(t, ErrEncryptionKeyMismatch, err)
+	opt.EncryptionKey = nil
+	_, err = NewKV(opt)
+	require.Equal(t, ErrEncryptionKeyRequired, err)
+	opt.EncryptionKey = []byte("short")
+	_, err = NewKV(opt)
+	require.Equal(t, ErrInvalidEncryptionKey, err)
+
+	opt.EncryptionKey = bytes.Repeat([]byte("k"), 32)
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	check(kv, 2000)
+
+	// The checkpoint has the data keys as well.
+	cpOpt := getTestOptions(cpDir)
+	cpOpt.EncryptionKey = opt.EncryptionKey
+	cp, err := NewKV(cpOpt)
+	require.NoError(t, err)
+	defer cp.Close()
+	check(cp, 2000)
+
+	// Backups aren't encrypted, so they can be loaded into a KV with another key, or none.
+	dir2, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir2)
+	kv2, err := NewKV(getTestOptions(dir2))
+	require.NoError(t, err)
+	defer kv2.Close()
+	require.NoError(t, kv2.Load(&backup))
+	check(kv2, 2000)
+}
@@ -17,9 +17,13 @@
 package badger
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/trace"
@@ -33,6 +37,16 @@ var (
 	head = []byte("/head/") // For storing value offset for replay.
 )
 
+// ErrInvalidDir is returned when Options.Dir does not point to an existing directory.
+var ErrInvalidDir = errors.New("Invalid Dir, directory does not exist")
+
+// ErrKeyNotFound is returned by GetItem when the key has no value, because it was never set, or
+// it was deleted or has expired.
+var ErrKeyNotFound = errors.New("Key not found")
+
+// ErrReadOnly is returned by writes to a KV opened with Options.ReadOnly.
+var ErrReadOnly = errors.New("No writes are allowed when the KV is opened read-only")
+
 // Options are params for creating DB object.
 type Options struct {
 	Dir string // Directory to store the data in.
@@ -60,13 +74,38 @@ type Options struct {
 	// Run value log garbage collection if we can reclaim at least this much space. This is a ratio.
 	ValueGCThreshold float64
 
+	// A value log file is done with once it is this big. It can go over by up to one write.
+	ValueLogFileSize int64
+	// How should value log files be accessed: table.FileIO or table.MemoryMap. Values an Iterator
+	// reads from a memory-mapped file, which is no longer written to, point into the mapping
+	// instead of being copied. The file is kept open until the iterator is done with the item.
+	ValueLogLoadingMode int
+
 	// The following affect value compression in value log.
+	// Compresses the entries written to the value log, or nil to not compress them. Entries
+	// written before it was changed are read with the compressor they were written with.
+	ValueCompression         Compressor
 	ValueCompressionMinSize  int     // Minimal size in bytes of KV pair to be compressed.
 	ValueCompressionMinRatio float64 // Minimal compression ratio of KV pair to be compressed.
 
 	// Sync all writes to disk. Setting this to true would slow down data loading significantly.
 	SyncWrites bool
 
+	// Encrypts the value log files and tables with AES if set, which needs a key of 16, 24 or 32
+	// bytes. The files are encrypted with data keys, which are kept in Options.Dir encrypted with
+	// this key. A new data key is generated once the latest one is EncryptionKeyRotationDuration
+	// old, and used for the files created from then on.
+	EncryptionKey                 []byte
+	EncryptionKeyRotationDuration time.Duration
+
+	// Combines merge operands with existing values. Needed to use KV.Merge.
+	MergeFunc MergeFunc
+
+	// Open the directory read-only, so several processes can read it at once, though not while
+	// another one writes to it. All the files are opened read-only, nothing in the directory is
+	// changed, and no background goroutines are started. Writes fail with ErrReadOnly.
+	ReadOnly bool
+
 	// Flags for testing purposes.
 	DoNotCompact bool // Stops LSM tree from compactions.
 	Verbose      bool // Turns on verbose mode.
@@ -74,23 +113,27 @@ type Options struct {
 
 // DefaultOptions sets a list of safe recommended options. Feel free to modify these to suit your needs.
 var DefaultOptions = Options{
-	Dir:                      "/tmp",
-	DoNotCompact:             false,
-	LevelOneSize:             256 << 20,
-	LevelSizeMultiplier:      10,
-	MapTablesTo:              table.MemoryMap,
-	MaxLevels:                7,
-	MaxTableSize:             64 << 20,
-	MemtableSlack:            10 << 20,
-	NumLevelZeroTables:       5,
-	NumLevelZeroTablesStall:  10,
-	NumMemtables:             5,
-	SyncWrites:               false,
-	ValueCompressionMinRatio: 2.0,
-	ValueCompressionMinSize:  1024,
-	ValueGCThreshold:         0.5, // Set to zero to not run GC.
-	ValueThreshold:           20,
-	Verbose:                  false,
+	Dir:                           "/tmp",
+	DoNotCompact:                  false,
+	EncryptionKeyRotationDuration: 10 * 24 * time.Hour,
+	LevelOneSize:                  256 << 20,
+	LevelSizeMultiplier:           10,
+	MapTablesTo:                   table.MemoryMap,
+	MaxLevels:                     7,
+	MaxTableSize:                  64 << 20,
+	MemtableSlack:                 10 << 20,
+	NumLevelZeroTables:            5,
+	NumLevelZeroTablesStall:       10,
+	NumMemtables:                  5,
+	SyncWrites:                    false,
+	ValueCompression:              LZ4Compressor,
+	ValueCompressionMinRatio:      2.0,
+	ValueCompressionMinSize:       1024,
+	ValueGCThreshold:              0.5, // Set to zero to not run GC.
+	ValueLogFileSize:              1 << 30,
+	ValueLogLoadingMode:           table.MemoryMap,
+	ValueThreshold:                20,
+	Verbose:                       false,
 }
 
 // KV provides the various functions required to interact with Badger.
@@ -106,15 +149,56 @@ type KV struct {
 	lc        *levelsController
 	vlog      valueLog
 	vptr      valuePointer
+	dirLock   *dirLock
+	registry  *keyRegistry
 	arenaPool *skl.ArenaPool
 	writeCh   chan *request
 	flushChan chan flushTask // For flushing memtables.
+
+	// Bytes per value log file taken by the entries in mt which nothing points to, such as small
+	// values kept in the LSM tree, and transaction markers. They are added to the discard stats
+	// once mt is flushed, as the entries after the head are replayed, and counted again then.
+	// Only used by the writer goroutine, or before it starts.
+	mtDiscards map[int32]int64
+
+	errLock sync.Mutex
+	bgErr   error // First error hit by a background goroutine. Guarded by errLock.
+
+	// Every write request gets a new version, assigned by the writer goroutine, which is the only
+	// user of nextVersion once the KV is open. appliedVersion is the version of the last request
+	// written to the memtable. discardVersion is the compaction watermark. Both are accessed
+	// atomically.
+	nextVersion    uint64
+	appliedVersion uint64
+	discardVersion uint64
+
+	rangeDels rangeDels
 }
 
-// NewKV returns a new KV object.
-func NewKV(opt *Options) *KV {
-	y.AssertTrue(len(opt.Dir) > 0)
-	out := &KV{
+// NewKV returns a new KV object. It fails with ErrDirLocked if opt.Dir is in use by another KV.
+func NewKV(opt *Options) (out *KV, err error) {
+	fi, err := os.Stat(opt.Dir)
+	if err != nil || !fi.IsDir() {
+		return nil, ErrInvalidDir
+	}
+	lock, err := acquireDirLock(opt.Dir, opt.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			lock.release()
+		}
+	}()
+	formats, err := checkFormat(opt.Dir, opt.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := openKeyRegistry(opt)
+	if err != nil {
+		return nil, err
+	}
+	out = &KV{
 		imm:       make([]*skl.Skiplist, 0, opt.NumMemtables),
 		flushChan: make(chan flushTask, opt.NumMemtables),
 		writeCh:   make(chan *request, 1000),
@@ -122,69 +206,198 @@ func NewKV(opt *Options) *KV {
 		arenaPool: skl.NewArenaPool(opt.MaxTableSize+opt.MemtableSlack, opt.NumMemtables+5),
 		closer:    y.NewCloser(),
 		elog:      trace.NewEventLog("Badger", "KV"),
+		dirLock:   lock,
+		registry:  registry,
+
+		discardVersion: math.MaxUint64,
 	}
 	out.mt = skl.NewSkiplist(out.arenaPool)
+	out.mtDiscards = make(map[int32]int64)
 	y.VerboseMode = opt.Verbose
 
 	// newLevelsController potentially loads files in directory.
-	out.lc = newLevelsController(out)
-	out.lc.startCompact()
-
-	lc := out.closer.Register("memtable")
-	go out.flushMemtable(lc) // Need levels controller to be up.
-
-	out.vlog.Open(out, opt)
-
-	lc = out.closer.Register("value-gc")
-	go out.vlog.runGCInLoop(lc)
+	if out.lc, err = newLevelsController(out); err != nil {
+		return nil, err
+	}
+	// Compactions need to know about range tombstones before they run into the keys they delete.
+	if err = out.loadRangeDels(); err != nil {
+		out.lc.close()
+		return nil, y.Wrapf(err, "Loading range tombstones")
+	}
+	if err = out.vlog.Open(out, opt, formats, registry); err != nil {
+		out.lc.close()
+		return nil, err
+	}
+	// After the value log is open, as compactions read merge operands from it, and tell it what
+	// they discarded.
+	if !opt.ReadOnly {
+		out.lc.startCompact()
+	}
+	defer func(out *KV) { // out itself is nil by the time an error is returned.
+		if err != nil {
+			out.vlog.Close()
+			out.lc.close()
+		}
+	}(out)
 
-	val, _ := out.Get(head) // casCounter ignored.
+	// The newest version of head has the value log offset to replay from, and the highest version
+	// which made it into the LSM tree.
+	headVs, err := out.get(y.KeyWithTs(head, math.MaxUint64))
+	if err != nil {
+		return nil, y.Wrapf(err, "Retrieving head")
+	}
 	var vptr valuePointer
-	if len(val) > 0 {
-		vptr.Decode(val)
+	if len(headVs.Value) > 0 {
+		vptr.Decode(headVs.Value)
 	}
+	maxVersion := headVs.Version
 
 	first := true
+	var replayErr error
+	// The entries of a transaction are only applied once we see the entry which ends it. An
+	// unfinished transaction at the end of the value log didn't commit.
+	var txnEntries []Entry
+	var txnVersion uint64
 	fn := func(e Entry) bool { // Function for replaying.
 		if first {
 			y.Printf("First key=%s\n", e.Key)
 		}
 		first = false
+		if e.version > maxVersion {
+			maxVersion = e.version
+		}
+		// The memtable keeps the values of replayed entries, so nothing points to the entries.
+		if e.Meta&BitIngest == 0 {
+			out.mtDiscards[e.fid] += e.size
+		}
+		// Once the memtable is flushed, the head points past the replayed entries, so they are
+		// neither replayed nor counted again.
+		out.vptr = valuePointer{Fid: uint32(e.fid), Len: uint32(e.size), Offset: uint64(e.offset)}
+
+		switch {
+		case e.Meta&BitTxn != 0:
+			if e.version != txnVersion {
+				txnEntries = txnEntries[:0]
+				txnVersion = e.version
+			}
+			te := e
+			te.Key = y.Safecopy(nil, e.Key)
+			te.Value = y.Safecopy(nil, e.Value)
+			txnEntries = append(txnEntries, te)
+			return true
+		case e.Meta&BitFinTxn != 0:
+			if e.version == txnVersion {
+				for _, te := range txnEntries {
+					out.mt.Put(y.KeyWithTs(te.Key, te.version), y.ValueStruct{
+						Value:      te.Value,
+						Meta:       te.Meta &^ BitTxn,
+						UserMeta:   te.UserMeta,
+						CASCounter: te.casCounter,
+						ExpiresAt:  te.ExpiresAt,
+					})
+				}
+			}
+			txnEntries = txnEntries[:0]
+			return true
+		case e.Meta&BitIngest != 0:
+			return true // Only reachable through the ingested table which points to it.
+		}
 
 		if e.CASCounterCheck != 0 {
-			oldValue := out.get(e.Key)
+			// Check against what the writer saw, which is everything before this version.
+			oldValue, err := out.get(y.KeyWithTs(e.Key, e.version-1))
+			if err != nil {
+				replayErr = err
+				return false
+			}
 			if oldValue.CASCounter != e.CASCounterCheck {
 				return true
 			}
 		}
-		nk := make([]byte, len(e.Key))
-		copy(nk, e.Key)
 		nv := make([]byte, len(e.Value))
 		copy(nv, e.Value)
 
 		v := y.ValueStruct{
 			Value:      nv,
 			Meta:       e.Meta,
+			UserMeta:   e.UserMeta,
 			CASCounter: e.casCounter,
+			ExpiresAt:  e.ExpiresAt,
+		}
+		key := y.KeyWithTs(e.Key, e.version)
+		out.mt.Put(key, v)
+		if e.Meta&BitRangeDelete != 0 {
+			t, err := parseRangeDelKey(key)
+			if err != nil {
+				replayErr = err
+				return false
+			}
+			out.rangeDels.add(t)
 		}
-		out.mt.Put(nk, v)
 		return true
 	}
-	out.vlog.Replay(vptr, fn)
+	if err = out.vlog.Replay(vptr, fn); err != nil {
+		return nil, err
+	}
+	if replayErr != nil {
+		err = y.Wrapf(replayErr, "While replaying value log")
+		return nil, err
+	}
+	out.nextVersion = maxVersion + 1
+	out.appliedVersion = maxVersion
+	if opt.ReadOnly {
+		return out, nil
+	}
+
+	lc := out.closer.Register("memtable")
+	go out.flushMemtable(lc) // Need levels controller to be up.
+
+	lc = out.closer.Register("value-gc")
+	go out.vlog.runGCInLoop(lc)
 
 	lc = out.closer.Register("writes")
 	go out.doWrites(lc)
 
-	return out
+	return out, nil
+}
+
+// setErr records err as the background error of the KV, unless one has already been recorded.
+// Once set, all further writes fail with this error.
+func (s *KV) setErr(err error) {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	if s.bgErr == nil {
+		s.bgErr = err
+		s.elog.Errorf("Background error: %v", err)
+	}
+}
+
+// Err returns the first error encountered by a background goroutine, such as a failed memtable
+// flush, compaction or value log garbage collection. It returns nil if the KV is healthy.
+func (s *KV) Err() error {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.bgErr
 }
 
 // Close closes a KV. It's crucial to call it to ensure all the pending updates
 // make their way to disk.
-func (s *KV) Close() {
+func (s *KV) Close() error {
 	if s.opt.Verbose {
 		y.Printf("Closing database\n")
 	}
 	s.elog.Printf("Closing database")
+	if s.opt.ReadOnly {
+		// Nothing was started and nothing needs flushing, as there were no writes.
+		vlogErr := s.vlog.Close()
+		lcErr := s.lc.close()
+		s.elog.Finish()
+		s.dirLock.release()
+		if vlogErr != nil {
+			return y.Wrapf(vlogErr, "Close")
+		}
+		return y.Wrapf(lcErr, "Close")
+	}
 	// Stop value GC first.
 	lc := s.closer.Get("value-gc")
 	lc.SignalAndWait()
@@ -194,14 +407,14 @@ func (s *KV) Close() {
 	lc.SignalAndWait()
 
 	// Now close the value log.
-	s.vlog.Close()
+	vlogErr := s.vlog.Close()
 
 	// Make sure that block writer is done pushing stuff into memtable!
 	// Otherwise, you will have a race condition: we are trying to flush memtables
 	// and remove them completely, while the block / memtable writer is still
 	// trying to push stuff into the memtable. This will also resolve the value
 	// offset problem: as we push into memtable, we update value offsets there.
-	if s.mt.Size() > 0 {
+	if !s.mt.Empty() {
 		if s.opt.Verbose {
 			y.Printf("Flushing memtable\n")
 		}
@@ -211,7 +424,7 @@ func (s *KV) Close() {
 				defer s.Unlock()
 				y.AssertTrue(s.mt != nil)
 				select {
-				case s.flushChan <- flushTask{s.mt, s.vptr}:
+				case s.flushChan <- flushTask{s.mt, s.vptr, s.Version(), s.mtDiscards}:
 					s.imm = append(s.imm, s.mt) // Flusher will attempt to remove this from s.imm.
 					s.mt = nil                  // Will segfault if we try writing!
 					return true
@@ -228,7 +441,7 @@ func (s *KV) Close() {
 			time.Sleep(10 * time.Millisecond)
 		}
 	}
-	s.flushChan <- flushTask{nil, valuePointer{}} // Tell flusher to quit.
+	s.flushChan <- flushTask{nil, valuePointer{}, 0, nil} // Tell flusher to quit.
 
 	lc = s.closer.Get("memtable")
 	lc.Wait()
@@ -236,11 +449,20 @@ func (s *KV) Close() {
 		y.Printf("Memtable flushed\n")
 	}
 
-	s.lc.close()
+	lcErr := s.lc.close()
 	s.elog.Printf("Waiting for closer")
 	s.closer.SignalAll()
 	s.closer.WaitForAll()
 	s.elog.Finish()
+	s.dirLock.release() // Everything has been written.
+
+	if vlogErr != nil {
+		return y.Wrapf(vlogErr, "Close")
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return y.Wrapf(lcErr, "Close")
 }
 
 // getMemtables returns the current memtables and get references.
@@ -262,35 +484,74 @@ func (s *KV) getMemTables() ([]*skl.Skiplist, func()) {
 	}
 }
 
-func (s *KV) decodeValue(val []byte, meta byte, slice *y.Slice) []byte {
+func (s *KV) decodeValue(val []byte, meta byte, slice *y.Slice) ([]byte, error) {
+	val, _, err := s.readValue(val, meta, slice, false)
+	return val, err
+}
+
+// readValue is like decodeValue. If shared is set, the value may point into the mapping of a
+// value log file, which is returned then. See valueLog.readShared.
+func (s *KV) readValue(val []byte, meta byte, slice *y.Slice, shared bool) (
+	[]byte, *logFile, error) {
 	if (meta & BitDelete) != 0 {
 		// Tombstone encountered.
-		return nil
+		return nil, nil, nil
 	}
 	if (meta & BitValuePointer) == 0 {
-		return val
+		return val, nil, nil
 	}
 
 	var vp valuePointer
 	vp.Decode(val)
-	entry, err := s.vlog.Read(vp, slice)
-	y.Checkf(err, "Unable to read from value log: %+v", vp)
+	var entry Entry
+	var lf *logFile
+	var err error
+	if shared {
+		entry, lf, err = s.vlog.readShared(vp, slice)
+	} else {
+		entry, err = s.vlog.Read(vp, slice)
+	}
+	if err != nil {
+		return nil, nil, y.Wrapf(err, "Unable to read from value log: %+v", vp)
+	}
 
 	if (entry.Meta & BitDelete) == 0 { // Not tombstone.
-		return entry.Value
+		return entry.Value, lf, nil
 	}
-	return nil
+	if lf != nil {
+		lf.decrRef()
+	}
+	return nil, nil, nil
 }
 
-// getValueHelper returns the value in memtable or disk for given key.
-// Note that value will include meta byte.
-func (s *KV) get(key []byte) y.ValueStruct {
+// Version returns the version of the last write applied to the KV. Reading at this version,
+// using GetAt or IteratorOptions.ReadTs, gives a consistent view of all the writes so far.
+func (s *KV) Version() uint64 {
+	return atomic.LoadUint64(&s.appliedVersion)
+}
+
+// SetDiscardTs sets the compaction watermark. Compactions keep every version of a key newer than
+// ts, and the newest version at or below it, so reads at ts or later stay correct. Older
+// versions are discarded, along with their values in the value log. By default, the watermark
+// is at the latest version, so only the newest version of each key is kept. Set it to the oldest
+// timestamp you still need to read at.
+func (s *KV) SetDiscardTs(ts uint64) {
+	atomic.StoreUint64(&s.discardVersion, ts)
+}
+
+func (s *KV) discardTs() uint64 {
+	return atomic.LoadUint64(&s.discardVersion)
+}
+
+// get returns the value in memtable or disk for the newest version of key, which is not newer
+// than the version in key. The returned ValueStruct has its Version set.
+func (s *KV) get(key []byte) (y.ValueStruct, error) {
 	tables, decr := s.getMemTables() // Lock should be released.
 	defer decr()
 	for i := 0; i < len(tables); i++ {
 		vs := tables[i].Get(key)
 		if vs.Meta != 0 || vs.Value != nil {
-			return vs
+			return vs, nil
 		}
 	}
 	return s.lc.get(key)
@@ -298,10 +559,103 @@ func (s *KV) get(key []byte) y.ValueStruct {
 
 // Get looks for key and returns value along with the current CAS counter.
 // If key is not found, value returned is nil.
-func (s *KV) Get(key []byte) ([]byte, uint16) {
-	vs := s.get(key)
-	slice := new(y.Slice)
-	return s.decodeValue(vs.Value, vs.Meta, slice), vs.CASCounter
+func (s *KV) Get(key []byte) ([]byte, uint64, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetAt is like Get, but reads the newest version of key which is not newer than readTs. Use
+// the same readTs across calls to read many keys as of one point in time. See Version and
+// SetDiscardTs.
+func (s *KV) GetAt(key []byte, readTs uint64) ([]byte, uint64, error) {
+	return s.getAt(context.Background(), key, readTs)
+}
+
+// GetContext is like Get, but returns ctx.Err() if ctx is done before the value is read.
+func (s *KV) GetContext(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	return s.getAt(ctx, key, s.Version())
+}
+
+// GetOptions control a lookup done with GetItemWithOptions.
+type GetOptions struct {
+	// Controls whether the value should be fetched from the value log. If not, KVItem.Value
+	// returns nil, but KVItem.ValueSize still works, and the other fields are set as usual.
+	FetchValue bool
+
+	// Only versions not newer than ReadTs are visible. Zero means KV.Version().
+	ReadTs uint64
+}
+
+// DefaultGetOptions fetch the value, as of the latest version.
+var DefaultGetOptions = GetOptions{FetchValue: true}
+
+// GetItem is like Get, but returns a KVItem, which also has the user metadata, CAS counter,
+// version and size of the value. Unlike Get, it tells a missing key apart from an empty value,
+// by returning ErrKeyNotFound.
+func (s *KV) GetItem(key []byte) (*KVItem, error) {
+	return s.GetItemWithOptions(key, DefaultGetOptions)
+}
+
+// GetItemWithOptions is like GetItem, but lets the caller skip reading the value from the value
+// log, which is useful if only the existence or size of the value is needed.
+func (s *KV) GetItemWithOptions(key []byte, opt GetOptions) (*KVItem, error) {
+	readTs := opt.ReadTs
+	if readTs == 0 {
+		readTs = s.Version()
+	}
+	item, err := s.getItem(context.Background(), key, readTs, opt.FetchValue)
+	if err != nil {
+		return nil, err
+	}
+	if item.version == 0 || item.meta&BitDelete != 0 {
+		return nil, ErrKeyNotFound
+	}
+	return item, nil
+}
+
+func (s *KV) getAt(ctx context.Context, key []byte, readTs uint64) ([]byte, uint64, error) {
+	item, err := s.getItem(ctx, key, readTs, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	return item.val, item.casCounter, nil
+}
+
+// getItem looks up key as of readTs. If key has no value, the item has a zero version or a
+// delete bit. If fetch is false, the value is not read from the value log.
+func (s *KV) getItem(ctx context.Context, key []byte, readTs uint64, fetch bool) (*KVItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	vs, err := s.get(y.KeyWithTs(key, readTs))
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil { // Don't go to the value log if we no longer need to.
+		return nil, err
+	}
+	item := &KVItem{kv: s, key: key, slice: new(y.Slice), readTs: readTs}
+	if isExpired(vs.ExpiresAt) || s.rangeDels.covers(key, vs.Version, readTs) {
+		return item, nil
+	}
+	item.meta = vs.Meta
+	item.userMeta = vs.UserMeta
+	item.casCounter = vs.CASCounter
+	item.version = vs.Version
+	item.expiresAt = vs.ExpiresAt
+	if !fetch {
+		item.vptr = y.Safecopy(nil, vs.Value)
+		return item, nil
+	}
+	item.fetched = true
+	if vs.Meta&BitMergeOperand != 0 {
+		item.val, err = s.foldMerges(key, vs, readTs)
+	} else {
+		item.val, err = s.decodeValue(vs.Value, vs.Meta, item.slice)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
 }
 
 func (s *KV) updateOffset(ptrs []valuePointer) {
@@ -328,47 +682,120 @@ func (s *KV) writeToLSM(b *request) {
 
 	for i, entry := range b.Entries {
 		entry.Error = nil
+		if entry.Meta&BitIngest != 0 {
+			continue // The ingested table points to it.
+		}
+		if entry.Meta&BitFinTxn != 0 {
+			s.addDiscard(b.Ptrs[i])
+			continue
+		}
 		if entry.CASCounterCheck != 0 {
-			oldValue := s.get(entry.Key) // No need to decode existing value. Just need old CAS counter.
+			// No need to decode existing value. Just need old CAS counter.
+			oldValue, err := s.get(y.KeyWithTs(entry.Key, math.MaxUint64))
+			if err != nil {
+				entry.Error = err
+				s.addDiscard(b.Ptrs[i])
+				continue
+			}
 			if oldValue.CASCounter != entry.CASCounterCheck {
 				entry.Error = CasMismatch
+				s.addDiscard(b.Ptrs[i])
 				continue
 			}
 		}
 
+		key := y.KeyWithTs(entry.Key, entry.version)
+		meta := entry.Meta &^ BitTxn
 		if len(entry.Value) < s.opt.ValueThreshold { // Will include deletion / tombstone case.
-			s.mt.Put(entry.Key,
+			s.addDiscard(b.Ptrs[i])
+			s.mt.Put(key,
 				y.ValueStruct{
 					Value:      entry.Value,
-					Meta:       entry.Meta,
-					CASCounter: entry.casCounter})
+					Meta:       meta,
+					UserMeta:   entry.UserMeta,
+					CASCounter: entry.casCounter,
+					ExpiresAt:  entry.ExpiresAt})
 		} else {
-			s.mt.Put(entry.Key,
+			s.mt.Put(key,
 				y.ValueStruct{
 					Value:      b.Ptrs[i].Encode(offsetBuf[:]),
-					Meta:       entry.Meta | BitValuePointer,
-					CASCounter: entry.casCounter})
+					Meta:       meta | BitValuePointer,
+					UserMeta:   entry.UserMeta,
+					CASCounter: entry.casCounter,
+					ExpiresAt:  entry.ExpiresAt})
+		}
+		if meta&BitRangeDelete != 0 {
+			t, err := parseRangeDelKey(key)
+			if err != nil {
+				entry.Error = err
+				continue
+			}
+			s.rangeDels.add(t)
 		}
 	}
 }
 
+// addDiscard counts the value log entry at p as garbage, as nothing is going to point to it. See
+// KV.mtDiscards.
+func (s *KV) addDiscard(p valuePointer) {
+	if p.Len > 0 {
+		s.mtDiscards[int32(p.Fid)] += int64(p.Len)
+	}
+}
+
 func (s *KV) writeRequests(reqs []*request) {
 	if len(reqs) == 0 {
 		return
 	}
 	s.elog.Printf("writeRequests called")
+	done := func(err error) {
+		for _, r := range reqs {
+			r.finish(err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		done(err)
+		return
+	}
+
+	// Wait for room in the memtable before writing to the value log, so requests whose context
+	// gets done during a stall can still be dropped.
+	reqs = s.dropCanceled(reqs)
+	for len(reqs) > 0 && !s.hasRoomForWrite() {
+		s.elog.Printf("Making room for writes")
+		time.Sleep(10 * time.Millisecond)
+		reqs = s.dropCanceled(reqs)
+	}
+	if reqs = s.dropConflicts(reqs); len(reqs) == 0 {
+		return
+	}
 
 	s.elog.Printf("Writing to value log")
 
 	// CAS counter for all operations has to go onto value log. Otherwise, if it is just in memtable for
 	// a long time, and following CAS operations use that as a check, when replaying, we will think that
 	// these CAS operations should fail, when they are actually valid.
+	//
+	// All entries of a request share its version, so readers see either all of them or none. The
+	// version doubles as the CAS counter. It only ever goes up, even across restarts, so a CAS
+	// counter is never reused for a key.
 	for _, req := range reqs {
+		if req.keepVersion {
+			continue
+		}
+		req.version = s.nextVersion
+		s.nextVersion++
 		for _, e := range req.Entries {
-			e.casCounter = newCASCounter()
+			e.casCounter = req.version
+			e.version = req.version
 		}
 	}
-	s.vlog.Write(reqs)
+	if err := s.vlog.Write(reqs); err != nil {
+		// We don't know how much of the value log made it to disk, so stop taking writes.
+		s.setErr(err)
+		done(err)
+		return
+	}
 
 	s.elog.Printf("Writing to memtable")
 	for i, b := range reqs {
@@ -382,24 +809,115 @@ func (s *KV) writeRequests(reqs []*request) {
 		s.writeToLSM(b)
 		s.elog.Printf("Wrote %d entries from block %d", len(b.Entries), i)
 		s.updateOffset(b.Ptrs)
-		b.Wg.Done()
+		if !b.keepVersion {
+			atomic.StoreUint64(&s.appliedVersion, b.version)
+		}
+		b.finish(nil)
 	}
 }
 
+// dropCanceled fails the requests whose context is done, and returns the rest. These requests
+// have not been written to the value log yet, so they can be dropped safely.
+func (s *KV) dropCanceled(reqs []*request) []*request {
+	out := reqs[:0]
+	for _, r := range reqs {
+		if err := r.ctx.Err(); err != nil {
+			s.elog.Printf("Dropping canceled request with %d entries", len(r.Entries))
+			r.finish(err)
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// dropConflicts fails the transaction commits which read a key that has been written since they
+// started, and returns the rest. Keys written by the requests before a commit count as written,
+// as they are about to get newer versions.
+func (s *KV) dropConflicts(reqs []*request) []*request {
+	var hasTxn bool
+	for _, r := range reqs {
+		if r.reads != nil {
+			hasTxn = true
+			break
+		}
+	}
+	if !hasTxn {
+		return reqs
+	}
+
+	pending := make(map[string]struct{})
+	var pendingRanges []y.KeyRange
+	out := reqs[:0]
+	for _, r := range reqs {
+		if r.reads != nil {
+			if err := s.checkConflict(r, pending, pendingRanges); err != nil {
+				s.elog.Printf("Dropping transaction: %v", err)
+				r.finish(err)
+				continue
+			}
+		}
+		if !r.keepVersion {
+			for _, e := range r.Entries {
+				if e.Meta&BitRangeDelete != 0 {
+					t, err := parseRangeDelKey(y.KeyWithTs(e.Key, 0))
+					if err == nil {
+						pendingRanges = append(pendingRanges, t.keyRange())
+					}
+				}
+				pending[string(e.Key)] = struct{}{}
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func (s *KV) checkConflict(
+	r *request, pending map[string]struct{}, pendingRanges []y.KeyRange) error {
+	for _, key := range r.reads {
+		if _, ok := pending[string(key)]; ok {
+			return ErrConflict
+		}
+		for _, pr := range pendingRanges {
+			if pr.Contains(y.KeyWithTs(key, 0)) {
+				return ErrConflict
+			}
+		}
+		vs, err := s.get(y.KeyWithTs(key, math.MaxUint64))
+		if err != nil {
+			return err
+		}
+		if vs.Version > r.readTs || s.rangeDels.newerThan(key, r.readTs) {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
 func (s *KV) doWrites(lc *y.LevelCloser) {
 	defer lc.Done()
 
 	blocks := make([]*request, 0, 10)
+	add := func(b *request) {
+		if b.exclusive == nil {
+			blocks = append(blocks, b)
+			return
+		}
+		s.writeRequests(blocks)
+		blocks = blocks[:0]
+		b.finish(b.exclusive())
+	}
 	for {
 		select {
 		case b := <-s.writeCh:
-			blocks = append(blocks, b)
+			add(b)
 
 		case <-lc.HasBeenClosed():
 			close(s.writeCh)
 
 			for b := range s.writeCh { // Flush the channel.
-				blocks = append(blocks, b)
+				add(b)
 			}
 			s.writeRequests(blocks)
 			return
@@ -415,63 +933,157 @@ func (s *KV) doWrites(lc *y.LevelCloser) {
 	}
 }
 
-// BatchSet applies a list of badger.Entry. Errors are set on each Entry invidividually.
+// sendAndWait sends req to the writer, and waits for it to be done.
+func (s *KV) sendAndWait(req *request) error {
+	req.Wg.Add(1)
+	s.writeCh <- req
+	req.Wg.Wait()
+	return req.Err
+}
+
+// runExclusive runs f on the writer goroutine, with no other write going on, and returns its error.
+func (s *KV) runExclusive(f func() error) error {
+	return s.sendAndWait(&request{ctx: context.Background(), exclusive: f})
+}
+
+// BatchSet applies a list of badger.Entry. If the batch as a whole could not be written, an error
+// is returned. Otherwise, errors such as CAS mismatches are set on each Entry invidividually.
+//   if err := kv.BatchSet(entries); err != nil {
+//      return err
+//   }
 //   for _, e := range entries {
 //      Check(e.Error)
 //   }
-func (s *KV) BatchSet(entries []*Entry) {
-	b := requestPool.Get().(*request)
-	defer requestPool.Put(b)
+func (s *KV) BatchSet(entries []*Entry) error {
+	return s.BatchSetContext(context.Background(), entries)
+}
 
+// BatchSetContext is like BatchSet, but gives up waiting once ctx is done, and returns ctx.Err().
+// Entries that have not been written to the value log by then are dropped. Entries that have been
+// written would still be applied, so the caller should treat such an error as an unknown outcome.
+func (s *KV) BatchSetContext(ctx context.Context, entries []*Entry) error {
+	if s.opt.ReadOnly {
+		return ErrReadOnly
+	}
+	b := requestPool.Get().(*request)
 	b.Entries = entries
 	b.Wg = sync.WaitGroup{}
+	b.Err = nil
+	b.ctx = ctx
+	b.callback = nil
+	b.keepVersion = false
+	b.exclusive = nil
 	b.Wg.Add(1)
+
+	select {
+	case s.writeCh <- b:
+	case <-ctx.Done():
+		requestPool.Put(b)
+		return ctx.Err()
+	}
+
+	if ctx.Done() == nil { // Can never be canceled, no need for a goroutine.
+		b.Wg.Wait()
+		err := b.Err
+		requestPool.Put(b)
+		return err
+	}
+	ch := make(chan struct{})
+	go func() {
+		b.Wg.Wait()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+		err := b.Err
+		requestPool.Put(b)
+		return err
+	case <-ctx.Done():
+		// The writer still owns b, so don't return it to the pool.
+		return ctx.Err()
+	}
+}
+
+// BatchSetAsync is the asynchronous version of BatchSet. It queues the entries for writing and
+// returns immediately. The callback is run once the entries have been written, with the same
+// error BatchSet would have returned. Errors such as CAS mismatches are set on each Entry, and
+// are only valid once the callback has run.
+//
+// The callback runs on the goroutine which writes to the KV, so it must be quick, and must not
+// call any of the blocking KV write methods.
+func (s *KV) BatchSetAsync(entries []*Entry, f func(error)) {
+	if f == nil {
+		f = func(error) {}
+	}
+	if s.opt.ReadOnly {
+		f(ErrReadOnly)
+		return
+	}
+	b := &request{
+		Entries:  entries,
+		ctx:      context.Background(),
+		callback: f,
+	}
 	s.writeCh <- b
-	b.Wg.Wait()
 }
 
 // Set sets the provided value for a given key. If key is not present, it is created.
 // If it is present, the existing value is overwritten with the one provided.
-func (s *KV) Set(key []byte, val []byte) {
+func (s *KV) Set(key []byte, val []byte) error {
 	e := &Entry{
 		Key:   key,
 		Value: val,
 	}
-	s.BatchSet([]*Entry{e})
+	return s.BatchSet([]*Entry{e})
+}
+
+// SetWithTTL is like Set, but the key expires after ttl. Once expired, reads treat the key as
+// absent, and compactions and value log GC reclaim its space.
+func (s *KV) SetWithTTL(key []byte, val []byte, ttl time.Duration) error {
+	e := &Entry{
+		Key:       key,
+		Value:     val,
+		ExpiresAt: uint64(time.Now().Add(ttl).Unix()),
+	}
+	return s.BatchSet([]*Entry{e})
 }
 
 // CompareAndSet sets the given value, ensuring that the no other Set operation has happened,
 // since last read. If the key has a different casCounter, this would not update the key
 // and return an error.
-func (s *KV) CompareAndSet(key []byte, val []byte, casCounter uint16) error {
+func (s *KV) CompareAndSet(key []byte, val []byte, casCounter uint64) error {
 	e := &Entry{
 		Key:             key,
 		Value:           val,
 		CASCounterCheck: casCounter,
 	}
-	s.BatchSet([]*Entry{e})
+	if err := s.BatchSet([]*Entry{e}); err != nil {
+		return err
+	}
 	return e.Error
 }
 
 // Delete deletes a key.
-func (s *KV) Delete(key []byte) {
+func (s *KV) Delete(key []byte) error {
 	e := &Entry{
 		Key:  key,
 		Meta: BitDelete,
 	}
 
-	s.BatchSet([]*Entry{e})
+	return s.BatchSet([]*Entry{e})
 }
 
 // CompareAndDelete deletes a key ensuring that the it has not been changed since last read.
 // If existing key has different casCounter, this would not delete the key and return an error.
-func (s *KV) CompareAndDelete(key []byte, casCounter uint16) error {
+func (s *KV) CompareAndDelete(key []byte, casCounter uint64) error {
 	e := &Entry{
 		Key:             key,
 		Meta:            BitDelete,
 		CASCounterCheck: casCounter,
 	}
-	s.BatchSet([]*Entry{e})
+	if err := s.BatchSet([]*Entry{e}); err != nil {
+		return err
+	}
 	return e.Error
 }
 
@@ -484,7 +1096,7 @@ func (s *KV) hasRoomForWrite() bool {
 
 	y.AssertTrue(s.mt != nil) // A nil mt indicates that KV is being closed.
 	select {
-	case s.flushChan <- flushTask{s.mt, s.vptr}:
+	case s.flushChan <- flushTask{s.mt, s.vptr, s.Version(), s.mtDiscards}:
 		if s.opt.Verbose {
 			y.Printf("Flushing memtable, mt.size=%d size of flushChan: %d\n",
 				s.mt.Size(), len(s.flushChan))
@@ -492,6 +1104,7 @@ func (s *KV) hasRoomForWrite() bool {
 		// We manage to push this task. Let's modify imm.
 		s.imm = append(s.imm, s.mt)
 		s.mt = skl.NewSkiplist(s.arenaPool)
+		s.mtDiscards = make(map[int32]int64)
 		// New memtable is empty. We certainly have room.
 		return true
 	default:
@@ -500,64 +1113,113 @@ func (s *KV) hasRoomForWrite() bool {
 	}
 }
 
+// newTableBuilder returns a table builder, which encrypts the table with the latest data key if
+// Options.EncryptionKey is set.
+func (s *KV) newTableBuilder() (*table.TableBuilder, error) {
+	key, err := s.registry.latestKey()
+	if err != nil {
+		return nil, err
+	}
+	b := table.NewTableBuilder()
+	if key != nil {
+		b.SetEncryption(key.id, key.block)
+	}
+	return b, nil
+}
+
+// openTable opens a table, which may be encrypted.
+func (s *KV) openTable(fd *os.File) (*table.Table, error) {
+	return table.OpenEncryptedTable(fd, s.opt.MapTablesTo, s.registry.cipher)
+}
+
 // WriteLevel0Table flushes memtable. It drops deleteValues.
-func writeLevel0Table(s *skl.Skiplist, f *os.File) error {
+func writeLevel0Table(s *skl.Skiplist, b *table.TableBuilder, f *os.File) error {
 	iter := s.NewIterator()
 	defer iter.Close()
-	b := table.NewTableBuilder()
-	defer b.Close()
 	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
 		if err := b.Add(iter.Key(), iter.Value()); err != nil {
 			return err
 		}
 	}
 	var buf [2]byte // Level 0. Leave it initialized as 0.
-	_, err := f.Write(b.Finish(buf[:]))
+	data, err := b.Finish(buf[:])
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
 	return err
 }
 
 type flushTask struct {
-	mt   *skl.Skiplist
-	vptr valuePointer
+	mt       *skl.Skiplist
+	vptr     valuePointer
+	version  uint64          // Highest version written to mt.
+	discards map[int32]int64 // See KV.mtDiscards.
 }
 
 func (s *KV) flushMemtable(lc *y.LevelCloser) {
 	defer lc.Done()
 
+	// Once a flush fails, its memtable stays in s.imm and can still be read. We stop flushing
+	// the memtables after it, because tables must be added to level 0 in order.
+	var flushErr error
 	for {
 		select {
 		case ft := <-s.flushChan:
 			if ft.mt == nil {
 				return
 			}
-
-			if ft.vptr.Fid > 0 || ft.vptr.Offset > 0 {
-				if s.opt.Verbose {
-					fmt.Printf("Storing offset: %+v\n", ft.vptr)
-				}
-				offset := make([]byte, 16)
-				s.Lock() // For vptr.
-				s.vptr.Encode(offset)
-				s.Unlock()
-				ft.mt.Put(head, y.ValueStruct{Value: offset}) // casCounter not needed.
+			if flushErr != nil {
+				continue
 			}
-			fileID, _ := s.lc.reserveFileIDs(1)
-			fd, err := y.OpenSyncedFile(table.NewFilename(fileID, s.opt.Dir), true)
-			y.Check(err)
-			y.Check(writeLevel0Table(ft.mt, fd))
-
-			tbl, err := table.OpenTable(fd, s.opt.MapTablesTo)
-			defer tbl.DecrRef()
-
-			y.Check(err)
-			s.lc.addLevel0Table(tbl) // This will incrRef again.
+			if flushErr = s.flushTable(ft); flushErr != nil {
+				s.setErr(y.Wrapf(flushErr, "While flushing memtable to disk"))
+			}
+		}
+	}
+}
 
-			// Update s.imm. Need a lock.
-			s.Lock()
-			y.AssertTrue(ft.mt == s.imm[0]) //For now, single threaded.
-			s.imm = s.imm[1:]
-			ft.mt.DecrRef() // Return memory.
-			s.Unlock()
+func (s *KV) flushTable(ft flushTask) error {
+	if ft.vptr.Fid > 0 || ft.vptr.Offset > 0 {
+		if s.opt.Verbose {
+			fmt.Printf("Storing offset: %+v\n", ft.vptr)
 		}
+		// Store the offset of the last write in this memtable, not s.vptr, which can already
+		// point into the next memtable. The version lets us restore versions on restart.
+		offset := make([]byte, 16)
+		ft.vptr.Encode(offset)
+		ft.mt.Put(y.KeyWithTs(head, ft.version), y.ValueStruct{Value: offset}) // casCounter not needed.
+	}
+	fileID, _ := s.lc.reserveFileIDs(1)
+	fname := table.NewFilename(fileID, s.opt.Dir)
+	b, err := s.newTableBuilder()
+	if err != nil {
+		return err
 	}
+	defer b.Close()
+	fd, err := y.OpenSyncedFile(fname, true)
+	if err != nil {
+		return y.Wrapf(err, "Unable to open table: %s", fname)
+	}
+	if err := writeLevel0Table(ft.mt, b, fd); err != nil {
+		fd.Close()
+		return err
+	}
+
+	tbl, err := s.openTable(fd)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	s.lc.addLevel0Table(tbl) // This will incrRef again.
+	tbl.DecrRef()
+
+	// Update s.imm. Need a lock.
+	s.Lock()
+	y.AssertTrue(ft.mt == s.imm[0]) //For now, single threaded.
+	s.imm = s.imm[1:]
+	ft.mt.DecrRef() // Return memory.
+	s.Unlock()
+	// The head now points past the entries, so they won't be replayed and counted again.
+	return y.Wrapf(s.vlog.addDiscards(ft.discards), "While saving value log discard stats")
 }
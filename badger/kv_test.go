@@ -18,17 +18,22 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	//	"path"
+	"path/filepath"
 	"sort"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/dgraph-io/badger/y"
 )
 
 func getTestOptions(dir string) *Options {
@@ -47,7 +52,8 @@ func TestWrite(t *testing.T) {
 	dir, err := ioutil.TempDir("/tmp", "badger")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
-	kv := NewKV(getTestOptions(dir))
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
 	defer kv.Close()
 
 	var entries []*Entry
@@ -57,17 +63,102 @@ func TestWrite(t *testing.T) {
 			Value: []byte(fmt.Sprintf("val%d", i)),
 		})
 	}
-	kv.BatchSet(entries)
+	require.NoError(t, kv.BatchSet(entries))
 	for _, e := range entries {
 		require.NoError(t, e.Error, "entry with error: %+v", e)
 	}
 }
 
+func TestBatchSetAsync(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	n := 2000
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		i := i
+		entries := []*Entry{{
+			Key:   []byte(fmt.Sprintf("key%d", i)),
+			Value: []byte(fmt.Sprintf("val%d", i)),
+		}}
+		kv.BatchSetAsync(entries, func(err error) {
+			errs[i] = err
+			wg.Done()
+		})
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		require.NoError(t, errs[i])
+		val, _, err := kv.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		require.EqualValues(t, fmt.Sprintf("val%d", i), string(val))
+	}
+
+	// CAS mismatches are reported on the entry by the time the callback runs.
+	_, cas, err := kv.Get([]byte("key0"))
+	require.NoError(t, err)
+	e := &Entry{Key: []byte("key0"), Value: []byte("new"), CASCounterCheck: cas%65535 + 1} // A different, non-zero counter.
+	wg.Add(1)
+	kv.BatchSetAsync([]*Entry{e}, func(err error) {
+		require.NoError(t, err)
+		wg.Done()
+	})
+	wg.Wait()
+	require.Equal(t, CasMismatch, e.Error)
+}
+
+func TestContext(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	require.NoError(t, kv.BatchSetContext(context.Background(), []*Entry{
+		{Key: []byte("key1"), Value: []byte("val1")},
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = kv.BatchSetContext(ctx, []*Entry{{Key: []byte("key2"), Value: []byte("val2")}})
+	require.Equal(t, context.Canceled, err)
+	val, _, err := kv.Get([]byte("key2"))
+	require.NoError(t, err)
+	require.Nil(t, val, "canceled write should have been dropped")
+
+	_, _, err = kv.GetContext(ctx, []byte("key1"))
+	require.Equal(t, context.Canceled, err)
+	val, _, err = kv.GetContext(context.Background(), []byte("key1"))
+	require.NoError(t, err)
+	require.EqualValues(t, "val1", string(val))
+
+	it := kv.NewIteratorContext(ctx, DefaultIteratorOptions)
+	it.Rewind()
+	require.False(t, it.Valid())
+	require.Equal(t, context.Canceled, it.Err())
+	it.Close()
+
+	it = kv.NewIteratorContext(context.Background(), DefaultIteratorOptions)
+	it.Rewind()
+	require.True(t, it.Valid())
+	require.NoError(t, it.Err())
+	it.Close()
+}
+
 func TestConcurrentWrite(t *testing.T) {
 	dir, err := ioutil.TempDir("/tmp", "badger")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
-	kv := NewKV(getTestOptions(dir))
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
 	defer kv.Close()
 
 	// Not a benchmark. Just a simple test for concurrent writes.
@@ -107,7 +198,8 @@ func TestConcurrentWrite(t *testing.T) {
 			continue
 		}
 		require.EqualValues(t, fmt.Sprintf("k%05d_%08d", i, j), string(k))
-		v := item.Value()
+		v, err := item.Value()
+		require.NoError(t, err)
 		require.EqualValues(t, fmt.Sprintf("v%05d_%08d", i, j), string(v))
 		j++
 		if j == m {
@@ -123,7 +215,8 @@ func TestCAS(t *testing.T) {
 	dir, err := ioutil.TempDir("/tmp", "badger")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
-	kv := NewKV(getTestOptions(dir))
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
 	defer kv.Close()
 
 	var entries []*Entry
@@ -133,7 +226,7 @@ func TestCAS(t *testing.T) {
 			Value: []byte(fmt.Sprintf("val%d", i)),
 		})
 	}
-	kv.BatchSet(entries)
+	require.NoError(t, kv.BatchSet(entries))
 	for _, e := range entries {
 		require.NoError(t, e.Error, "entry with error: %+v", e)
 	}
@@ -143,7 +236,8 @@ func TestCAS(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		k := []byte(fmt.Sprintf("key%d", i))
 		v := []byte(fmt.Sprintf("val%d", i))
-		value, casCounter := kv.Get(k)
+		value, casCounter, err := kv.Get(k)
+		require.NoError(t, err)
 		require.EqualValues(t, v, value)
 		require.EqualValues(t, entries[i].casCounter, casCounter)
 	}
@@ -163,7 +257,8 @@ func TestCAS(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		k := []byte(fmt.Sprintf("key%d", i))
 		v := []byte(fmt.Sprintf("val%d", i))
-		value, casCounter := kv.Get(k)
+		value, casCounter, err := kv.Get(k)
+		require.NoError(t, err)
 		require.EqualValues(t, v, value)
 		require.EqualValues(t, entries[i].casCounter, casCounter)
 	}
@@ -182,7 +277,8 @@ func TestCAS(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		k := []byte(fmt.Sprintf("key%d", i))
 		v := []byte(fmt.Sprintf("val%d", i))
-		value, casCounter := kv.Get(k)
+		value, casCounter, err := kv.Get(k)
+		require.NoError(t, err)
 		require.EqualValues(t, v, value)
 		require.EqualValues(t, entries[i].casCounter, casCounter)
 	}
@@ -196,7 +292,8 @@ func TestCAS(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		k := []byte(fmt.Sprintf("key%d", i))
 		v := []byte(fmt.Sprintf("zzz%d", i)) // Value should be changed.
-		value, casCounter := kv.Get(k)
+		value, casCounter, err := kv.Get(k)
+		require.NoError(t, err)
 		require.EqualValues(t, v, value)
 		require.True(t, casCounter != 0)
 	}
@@ -206,43 +303,328 @@ func TestGet(t *testing.T) {
 	dir, err := ioutil.TempDir("/tmp", "badger")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
-	kv := NewKV(getTestOptions(dir))
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
 	defer kv.Close()
 
-	kv.Set([]byte("key1"), []byte("val1"))
-	value, casCounter := kv.Get([]byte("key1"))
+	require.NoError(t, kv.Set([]byte("key1"), []byte("val1")))
+	value, casCounter, err := kv.Get([]byte("key1"))
+	require.NoError(t, err)
 	require.EqualValues(t, "val1", value)
 	require.True(t, casCounter != 0)
 
-	kv.Set([]byte("key1"), []byte("val2"))
-	value, casCounter = kv.Get([]byte("key1"))
+	require.NoError(t, kv.Set([]byte("key1"), []byte("val2")))
+	value, casCounter, err = kv.Get([]byte("key1"))
+	require.NoError(t, err)
 	require.EqualValues(t, "val2", value)
 	require.True(t, casCounter != 0)
 
-	kv.Delete([]byte("key1"))
-	value, casCounter = kv.Get([]byte("key1"))
+	require.NoError(t, kv.Delete([]byte("key1")))
+	value, casCounter, err = kv.Get([]byte("key1"))
+	require.NoError(t, err)
 	require.Nil(t, value)
 	require.True(t, casCounter != 0)
 
-	kv.Set([]byte("key1"), []byte("val3"))
-	value, casCounter = kv.Get([]byte("key1"))
+	require.NoError(t, kv.Set([]byte("key1"), []byte("val3")))
+	value, casCounter, err = kv.Get([]byte("key1"))
+	require.NoError(t, err)
 	require.EqualValues(t, "val3", value)
 	require.True(t, casCounter != 0)
 
 	longVal := make([]byte, 1000)
-	kv.Set([]byte("key1"), longVal)
-	value, casCounter = kv.Get([]byte("key1"))
+	require.NoError(t, kv.Set([]byte("key1"), longVal))
+	value, casCounter, err = kv.Get([]byte("key1"))
+	require.NoError(t, err)
 	require.EqualValues(t, longVal, value)
 	require.True(t, casCounter != 0)
 }
 
 // Put a lot of data to move some data to disk.
 // WARNING: This test might take a while but it should pass!
+func TestVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+
+	key := []byte("key")
+	var versions []uint64
+	for i := 0; i < 3; i++ {
+		require.NoError(t, kv.Set(key, []byte(fmt.Sprintf("val%d", i))))
+		versions = append(versions, kv.Version())
+	}
+	require.True(t, versions[0] < versions[1] && versions[1] < versions[2])
+	require.NoError(t, kv.Delete([]byte("other")))
+
+	// Keep all the versions, and push enough data through to get compactions going.
+	kv.SetDiscardTs(0)
+	for i := 0; i < 30; i++ {
+		var entries []*Entry
+		for j := 0; j < 100; j++ {
+			entries = append(entries, &Entry{
+				Key:   []byte(fmt.Sprintf("fill%05d", i*100+j)),
+				Value: []byte("fillvalue"),
+			})
+		}
+		require.NoError(t, kv.BatchSet(entries))
+	}
+
+	checkReads := func(kv *KV) {
+		for i, v := range versions {
+			val, _, err := kv.GetAt(key, v)
+			require.NoError(t, err)
+			require.EqualValues(t, fmt.Sprintf("val%d", i), string(val))
+		}
+		val, _, err := kv.GetAt(key, versions[0]-1)
+		require.NoError(t, err)
+		require.Nil(t, val)
+
+		for _, reverse := range []bool{false, true} {
+			opt := DefaultIteratorOptions
+			opt.ReadTs = versions[1]
+			opt.Reverse = reverse
+			itr := kv.NewIterator(opt)
+			itr.Seek(key)
+			require.True(t, itr.Valid())
+			item := itr.Item()
+			require.EqualValues(t, "key", string(item.Key()))
+			require.EqualValues(t, versions[1], item.Version())
+			val, err := item.Value()
+			require.NoError(t, err)
+			require.EqualValues(t, "val1", string(val))
+			itr.Close()
+		}
+	}
+	checkReads(kv)
+	kv.Close()
+
+	kv, err = NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	require.True(t, kv.Version() > versions[2])
+	checkReads(kv)
+	kv.Close()
+}
+
+// Value log GC writes the versions it moves to the memtable. A newer version further down must
+// still win.
+func TestGetNewestAfterRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 10 // A file per value.
+	opt.ValueCompression = nil
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+
+	key := []byte("key")
+	val := func(i int) []byte { return bytes.Repeat([]byte{byte('a' + i)}, 1<<10) }
+	var versions []uint64
+	for i := 0; i < 3; i++ {
+		require.NoError(t, kv.Set(key, val(i)))
+		versions = append(versions, kv.Version())
+	}
+	require.NoError(t, kv.Close())
+	kv, err = NewKV(opt) // All the versions are in a table now.
+	require.NoError(t, err)
+	defer kv.Close()
+
+	// The first version is still visible at the watermark, so GC moves it to the memtable, where
+	// it must not hide the newer versions.
+	kv.SetDiscardTs(versions[0])
+	kv.vlog.RLock()
+	lf := kv.vlog.files[0]
+	kv.vlog.RUnlock()
+	require.NoError(t, kv.vlog.rewrite(lf))
+	items, err := kv.MultiGet([][]byte{key})
+	require.NoError(t, err)
+	require.Equal(t, val(2), items[0].val)
+	v, _, err := kv.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, val(2), v)
+	for i, version := range versions {
+		v, _, err = kv.GetAt(key, version)
+		require.NoError(t, err)
+		require.Equal(t, val(i), v)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+
+	past := uint64(time.Now().Unix()) - 1
+	require.NoError(t, kv.Set([]byte("overwritten"), []byte("old")))
+	require.NoError(t, kv.SetWithTTL([]byte("live"), []byte("live value"), time.Hour))
+	require.NoError(t, kv.BatchSet([]*Entry{
+		{Key: []byte("expired"), Value: bytes.Repeat([]byte("x"), 100), ExpiresAt: past},
+		{Key: []byte("overwritten"), Value: []byte("new"), ExpiresAt: past},
+	}))
+
+	check := func(kv *KV) {
+		val, _, err := kv.Get([]byte("live"))
+		require.NoError(t, err)
+		require.EqualValues(t, "live value", string(val))
+		for _, k := range []string{"expired", "overwritten"} {
+			val, cas, err := kv.Get([]byte(k))
+			require.NoError(t, err)
+			require.Nil(t, val, k)
+			require.Zero(t, cas, k)
+		}
+
+		itr := kv.NewIterator(DefaultIteratorOptions)
+		defer itr.Close()
+		var keys []string
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			item := itr.Item()
+			if bytes.HasPrefix(item.Key(), []byte("fill")) || bytes.Equal(item.Key(), head) {
+				continue
+			}
+			keys = append(keys, string(item.Key()))
+			require.True(t, item.ExpiresAt() > past)
+		}
+		require.Equal(t, []string{"live"}, keys)
+	}
+	check(kv)
+
+	// Push the keys through compactions, which drop the expired values.
+	for i := 0; i < 30; i++ {
+		var entries []*Entry
+		for j := 0; j < 100; j++ {
+			entries = append(entries, &Entry{
+				Key:   []byte(fmt.Sprintf("fill%05d", i*100+j)),
+				Value: []byte("fillvalue"),
+			})
+		}
+		require.NoError(t, kv.BatchSet(entries))
+	}
+	check(kv)
+	require.NoError(t, kv.Close())
+
+	kv, err = NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+	check(kv)
+}
+
+func TestUserMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+
+	bigValue := bytes.Repeat([]byte("v"), 100) // Goes to the value log.
+	require.NoError(t, kv.BatchSet([]*Entry{
+		{Key: []byte("small"), Value: []byte("v"), UserMeta: 0x11},
+		{Key: []byte("big"), Value: bigValue, UserMeta: 0x22},
+		{Key: []byte("none"), Value: []byte("v")},
+	}))
+	expected := map[string]byte{"small": 0x11, "big": 0x22, "none": 0}
+
+	check := func(kv *KV) {
+		for k, um := range expected {
+			item, err := kv.GetItem([]byte(k))
+			require.NoError(t, err)
+			require.Equal(t, um, item.UserMeta(), k)
+			require.EqualValues(t, k, string(item.Key()))
+			val, err := item.Value()
+			require.NoError(t, err)
+			require.NotNil(t, val)
+			require.NotZero(t, item.Counter())
+			require.NotZero(t, item.Version())
+		}
+		itr := kv.NewIterator(DefaultIteratorOptions)
+		defer itr.Close()
+		var count int
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			item := itr.Item()
+			if um, ok := expected[string(item.Key())]; ok {
+				require.Equal(t, um, item.UserMeta(), string(item.Key()))
+				count++
+			}
+		}
+		require.Equal(t, len(expected), count)
+	}
+	check(kv)
+	require.NoError(t, kv.Close()) // Flushes the memtable to a table.
+
+	kv, err = NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+	check(kv)
+
+	_, err = kv.GetItem([]byte("missing"))
+	require.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestGetItemNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.ValueCompressionMinSize = 16
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	bigValue := bytes.Repeat([]byte("v"), 100) // Goes to the value log, compressed.
+	require.NoError(t, kv.Set([]byte("empty"), nil))
+	require.NoError(t, kv.Set([]byte("small"), []byte("val")))
+	require.NoError(t, kv.Set([]byte("big"), bigValue))
+	require.NoError(t, kv.Set([]byte("deleted"), []byte("val")))
+	require.NoError(t, kv.Delete([]byte("deleted")))
+
+	for _, fetch := range []bool{true, false} {
+		opt := GetOptions{FetchValue: fetch}
+		for k, sz := range map[string]int{"empty": 0, "small": 3, "big": len(bigValue)} {
+			item, err := kv.GetItemWithOptions([]byte(k), opt)
+			require.NoError(t, err, k)
+			require.NotZero(t, item.Counter())
+			size, err := item.ValueSize()
+			require.NoError(t, err)
+			require.Equal(t, sz, size, k)
+			val, err := item.Value()
+			require.NoError(t, err)
+			if fetch {
+				require.Equal(t, sz, len(val))
+			} else {
+				require.Nil(t, val)
+			}
+		}
+		for _, k := range []string{"deleted", "missing"} {
+			_, err := kv.GetItemWithOptions([]byte(k), opt)
+			require.Equal(t, ErrKeyNotFound, err, k)
+		}
+	}
+
+	// Older versions are still there.
+	_, err = kv.GetItemWithOptions([]byte("deleted"), GetOptions{ReadTs: kv.Version() - 1})
+	require.NoError(t, err)
+
+	// Values which are not compressed only need their header read.
+	plain := make([]byte, 50)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+	require.NoError(t, kv.Set([]byte("plain"), plain))
+	item, err := kv.GetItemWithOptions([]byte("plain"), GetOptions{})
+	require.NoError(t, err)
+	size, err := item.ValueSize()
+	require.NoError(t, err)
+	require.Equal(t, len(plain), size)
+}
+
 func TestGetMore(t *testing.T) {
 	dir, err := ioutil.TempDir("/tmp", "badger")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
-	kv := NewKV(getTestOptions(dir))
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
 	defer kv.Close()
 
 	//	n := 500000
@@ -259,7 +641,7 @@ func TestGetMore(t *testing.T) {
 				Value: []byte(fmt.Sprintf("%09d", j)),
 			})
 		}
-		kv.BatchSet(entries)
+		require.NoError(t, kv.BatchSet(entries))
 		for _, e := range entries {
 			require.NoError(t, e.Error, "entry with error: %+v", e)
 		}
@@ -270,7 +652,8 @@ func TestGetMore(t *testing.T) {
 			fmt.Printf("Testing i=%d\n", i)
 		}
 		k := fmt.Sprintf("%09d", i)
-		value, _ := kv.Get([]byte(k))
+		value, _, err := kv.Get([]byte(k))
+		require.NoError(t, err)
 		require.EqualValues(t, k, string(value))
 	}
 
@@ -287,7 +670,7 @@ func TestGetMore(t *testing.T) {
 				Value: []byte(fmt.Sprintf("zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz%09d", j)),
 			})
 		}
-		kv.BatchSet(entries)
+		require.NoError(t, kv.BatchSet(entries))
 		for _, e := range entries {
 			require.NoError(t, e.Error, "entry with error: %+v", e)
 		}
@@ -299,7 +682,8 @@ func TestGetMore(t *testing.T) {
 		}
 		k := []byte(fmt.Sprintf("%09d", i))
 		expectedValue := fmt.Sprintf("zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz%09d", i)
-		value, _ := kv.Get([]byte(k))
+		value, _, err := kv.Get([]byte(k))
+		require.NoError(t, err)
 		require.EqualValues(t, expectedValue, string(value))
 	}
 
@@ -315,7 +699,7 @@ func TestGetMore(t *testing.T) {
 				Meta: BitDelete,
 			})
 		}
-		kv.BatchSet(entries)
+		require.NoError(t, kv.BatchSet(entries))
 		for _, e := range entries {
 			require.NoError(t, e.Error, "entry with error: %+v", e)
 		}
@@ -327,7 +711,8 @@ func TestGetMore(t *testing.T) {
 			fmt.Printf("Testing i=%d\n", i)
 		}
 		k := fmt.Sprintf("%09d", i)
-		value, _ := kv.Get([]byte(k))
+		value, _, err := kv.Get([]byte(k))
+		require.NoError(t, err)
 		require.Nil(t, value)
 	}
 	fmt.Println("Done and closing")
@@ -337,7 +722,8 @@ func TestIterate2Basic(t *testing.T) {
 	dir, err := ioutil.TempDir("/tmp", "badger")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
-	kv := NewKV(getTestOptions(dir))
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
 	defer kv.Close()
 
 	bkey := func(i int) []byte {
@@ -353,7 +739,7 @@ func TestIterate2Basic(t *testing.T) {
 		if (i % 1000) == 0 {
 			t.Logf("Put i=%d\n", i)
 		}
-		kv.Set(bkey(i), bval(i))
+		require.NoError(t, kv.Set(bkey(i), bval(i)))
 	}
 
 	opt := IteratorOptions{}
@@ -379,7 +765,8 @@ func TestIterate2Basic(t *testing.T) {
 				continue
 			}
 			require.EqualValues(t, bkey(count), string(key))
-			val := item.Value()
+			val, err := item.Value()
+			require.NoError(t, err)
 			require.EqualValues(t, bval(count), string(val))
 			count++
 		}
@@ -395,13 +782,201 @@ func TestIterate2Basic(t *testing.T) {
 		for it.Seek(start); it.Valid(); it.Next() {
 			item := it.Item()
 			require.EqualValues(t, bkey(idx), string(item.Key()))
-			require.EqualValues(t, bval(idx), string(item.Value()))
+			val, err := item.Value()
+			require.NoError(t, err)
+			require.EqualValues(t, bval(idx), string(val))
 			idx++
 		}
 		it.Close()
 	}
 }
 
+func TestIterateBounds(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	var entries []*Entry
+	for _, p := range []string{"a", "b", "c"} {
+		for i := 0; i < 1000; i++ {
+			entries = append(entries, &Entry{
+				Key:   []byte(fmt.Sprintf("%s%04d", p, i)),
+				Value: []byte(fmt.Sprintf("val%d", i)),
+			})
+			if len(entries) == 100 {
+				require.NoError(t, kv.BatchSet(entries))
+				entries = entries[:0]
+			}
+		}
+	}
+	require.NoError(t, kv.Set([]byte{0xff, 0xff}, []byte("last")))
+
+	keys := func(opt IteratorOptions, seek []byte) []string {
+		it := kv.NewIterator(opt)
+		defer it.Close()
+		if seek == nil {
+			it.Rewind()
+		} else {
+			it.Seek(seek)
+		}
+		var out []string
+		for ; it.Valid(); it.Next() {
+			if bytes.Equal(it.Item().Key(), head) {
+				continue
+			}
+			out = append(out, string(it.Item().Key()))
+		}
+		return out
+	}
+
+	for _, reverse := range []bool{false, true} {
+		// ends returns the first and last keys iterated over, given the smallest and biggest.
+		ends := func(smallest, biggest string) []string {
+			if reverse {
+				return []string{biggest, smallest}
+			}
+			return []string{smallest, biggest}
+		}
+		opt := IteratorOptions{Reverse: reverse, Prefix: []byte("b")}
+		got := keys(opt, nil)
+		require.Equal(t, 1000, len(got))
+		require.Equal(t, ends("b0000", "b0999"), []string{got[0], got[999]})
+
+		opt = IteratorOptions{Reverse: reverse, LowerBound: []byte("a0990"), UpperBound: []byte("b0010")}
+		got = keys(opt, nil)
+		require.Equal(t, 20, len(got))
+		require.Equal(t, ends("a0990", "b0009"), []string{got[0], got[19]})
+
+		// Bounds and prefix together, and seeks outside of the range.
+		opt = IteratorOptions{Reverse: reverse, Prefix: []byte("b"), LowerBound: []byte("a"),
+			UpperBound: []byte("b0100")}
+		require.Equal(t, 100, len(keys(opt, nil)))
+		outside := ends("a", "z")
+		require.Equal(t, 100, len(keys(opt, []byte(outside[0]))))
+		require.Equal(t, 0, len(keys(opt, []byte(outside[1]))))
+
+		opt = IteratorOptions{Reverse: reverse, Prefix: []byte{0xff}, FetchValues: true}
+		it := kv.NewIterator(opt)
+		it.Rewind()
+		require.True(t, it.Valid())
+		require.Equal(t, []byte{0xff, 0xff}, it.Item().Key())
+		val, err := it.Item().Value()
+		require.NoError(t, err)
+		require.Equal(t, "last", string(val))
+		it.Next()
+		require.False(t, it.Valid())
+		it.Close()
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.ReadOnly = true
+	_, err = NewKV(opt)
+	require.Error(t, err) // Nothing to read yet.
+
+	// Some keys make it to the tables, the rest are still in the memtable of a live KV.
+	opt.ReadOnly = false
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%05d", i)) }
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, kv.Set(key(i), key(i)))
+	}
+	require.NoError(t, kv.Close())
+	opt.DoNotCompact = true
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	for i := 2000; i < 2100; i++ {
+		require.NoError(t, kv.Set(key(i), key(i)))
+	}
+
+	type fileState struct {
+		size    int64
+		modTime time.Time
+	}
+	dirState := func() map[string]fileState {
+		fis, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		state := make(map[string]fileState)
+		for _, fi := range fis {
+			state[fi.Name()] = fileState{fi.Size(), fi.ModTime()}
+		}
+		return state
+	}
+	before := dirState()
+
+	opt.ReadOnly = true
+	_, err = NewKV(opt)
+	require.Equal(t, ErrDirLocked, err)
+	kv.dirLock.release() // As if the process had died, so the directory can be opened again.
+	ro, err := NewKV(opt)
+	require.NoError(t, err)
+	for i := 0; i < 2100; i++ {
+		val, _, err := ro.Get(key(i))
+		require.NoError(t, err)
+		require.Equal(t, key(i), val)
+	}
+	require.Equal(t, ErrReadOnly, ro.Set([]byte("key"), []byte("val")))
+	require.Equal(t, ErrReadOnly, ro.Delete(key(0)))
+	ro.BatchSetAsync([]*Entry{{Key: []byte("key")}}, func(err error) {
+		require.Equal(t, ErrReadOnly, err)
+	})
+	txn := ro.NewTransaction(true)
+	require.NoError(t, txn.Set([]byte("key"), []byte("val")))
+	require.Equal(t, ErrReadOnly, txn.Commit())
+	require.NoError(t, ro.Close())
+	require.Equal(t, before, dirState())
+}
+
+func TestDirLock(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	_, err = NewKV(opt)
+	require.Equal(t, ErrDirLocked, err)
+	ro := *opt
+	ro.ReadOnly = true
+	_, err = NewKV(&ro)
+	require.Equal(t, ErrDirLocked, err)
+	require.NoError(t, kv.Close())
+
+	// Any number of read-only KVs, but no writer.
+	kv1, err := NewKV(&ro)
+	require.NoError(t, err)
+	kv2, err := NewKV(&ro)
+	require.NoError(t, err)
+	_, err = NewKV(opt)
+	require.Equal(t, ErrDirLocked, err)
+	require.NoError(t, kv1.Close())
+	require.NoError(t, kv2.Close())
+
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	require.NoError(t, kv.Close())
+
+	// A read-only KV creates the lock file if it is missing, and still keeps writers out.
+	require.NoError(t, os.Remove(filepath.Join(dir, lockFilename)))
+	kv1, err = NewKV(&ro)
+	require.NoError(t, err)
+	_, err = NewKV(opt)
+	require.Equal(t, ErrDirLocked, err)
+	require.NoError(t, kv1.Close())
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	require.NoError(t, kv.Close())
+}
+
 func TestLoad(t *testing.T) {
 	dir, err := ioutil.TempDir("/tmp", "badger")
 	fmt.Printf("Writing to dir %s\n", dir)
@@ -409,31 +984,36 @@ func TestLoad(t *testing.T) {
 	defer os.RemoveAll(dir)
 	n := 10000
 	{
-		kv := NewKV(getTestOptions(dir))
+		kv, err := NewKV(getTestOptions(dir))
+		require.NoError(t, err)
 		for i := 0; i < n; i++ {
 			if (i % 10000) == 0 {
 				fmt.Printf("Putting i=%d\n", i)
 			}
 			k := []byte(fmt.Sprintf("%09d", i))
-			kv.Set(k, k)
+			require.NoError(t, kv.Set(k, k))
 		}
 		kv.Close()
 	}
 
-	kv := NewKV(getTestOptions(dir))
+	kv, err := NewKV(getTestOptions(dir))
+
+	require.NoError(t, err)
 	for i := 0; i < n; i++ {
 		if (i % 10000) == 0 {
 			fmt.Printf("Testing i=%d\n", i)
 		}
 		k := fmt.Sprintf("%09d", i)
-		value, _ := kv.Get([]byte(k))
+		value, _, err := kv.Get([]byte(k))
+		require.NoError(t, err)
 		require.EqualValues(t, k, string(value))
 	}
 	kv.Close()
 	summary := kv.lc.getSummary()
 
 	// Check that files are garbage collected.
-	idMap := getIDMap(dir)
+	idMap, err := getIDMap(dir)
+	require.NoError(t, err)
 	for fileID := range idMap {
 		// Check that name is in summary.filenames.
 		require.True(t, summary.fileIDs[fileID], "%d", fileID)
@@ -448,6 +1028,21 @@ func TestLoad(t *testing.T) {
 	fmt.Printf("FileIDs: %v\n", fileIDs)
 }
 
+// closeCrashed stops the goroutines of kv and closes its files, once a test which left it open, as
+// if the process had died, is done with it. Unlike Close, it doesn't flush the memtable, as the
+// directory has been opened again since.
+func closeCrashed(kv *KV) {
+	kv.closer.Get("value-gc").SignalAndWait()
+	kv.closer.Get("writes").SignalAndWait()
+	kv.flushChan <- flushTask{nil, valuePointer{}, 0, nil} // Tell flusher to quit.
+	kv.closer.Get("memtable").Wait()
+	kv.lc.close()
+	kv.vlog.Close()
+	kv.closer.SignalAll()
+	kv.closer.WaitForAll()
+	kv.elog.Finish()
+}
+
 func TestCrash(t *testing.T) {
 	dir, err := ioutil.TempDir("/tmp", "badger")
 	require.NoError(t, err)
@@ -460,7 +1055,10 @@ func TestCrash(t *testing.T) {
 	opt.Verbose = true
 	opt.SyncWrites = true // Important for this test to pass.
 
-	kv := NewKV(&opt)
+	kv, err := NewKV(&opt)
+	defer closeCrashed(kv)
+
+	require.NoError(t, err)
 	var keys [][]byte
 	for i := 0; i < 150000; i++ {
 		k := []byte(fmt.Sprintf("%09d", i))
@@ -476,7 +1074,7 @@ func TestCrash(t *testing.T) {
 		entries = append(entries, e)
 
 		if len(entries) == 100 {
-			kv.BatchSet(entries)
+			require.NoError(t, kv.BatchSet(entries))
 			for _, e := range entries {
 				require.NoError(t, e.Error, "entry with error: %+v", e)
 			}
@@ -485,34 +1083,47 @@ func TestCrash(t *testing.T) {
 	}
 
 	for _, k := range keys {
-		value, _ := kv.Get(k)
+		value, _, err := kv.Get(k)
+		require.NoError(t, err)
 		require.Equal(t, k, value)
 	}
 	// Do not close kv store (!!) for this test to make sense.
+	kv.dirLock.release() // As if the process had died, so the directory can be opened again.
 
-	kv2 := NewKV(&opt)
+	kv2, err := NewKV(&opt)
+
+	require.NoError(t, err)
+	defer closeCrashed(kv2)
 	for _, k := range keys {
-		value, casCounter := kv2.Get(k)
+		value, casCounter, err := kv2.Get(k)
+		require.NoError(t, err)
 		require.Equal(t, k, value, "Key: %s", k)
 		require.True(t, casCounter != 0)
 	}
 
 	{
-		val, _ := kv.Get(head)
+		val, _, err := kv.Get(head)
+		require.NoError(t, err)
 		voffset := binary.BigEndian.Uint64(val)
 		fmt.Printf("level 1 val: %v\n", voffset)
 	}
 
 	kv.lc.tryCompact(1)
 	kv.lc.tryCompact(1)
-	val, _ := kv.Get(head)
+	val, _, err := kv.Get(head)
+	require.NoError(t, err)
 	require.True(t, len(val) > 0)
 	voffset := binary.BigEndian.Uint64(val)
 	fmt.Printf("level 1 val: %v\n", voffset)
 
-	kv3 := NewKV(&opt)
+	kv2.dirLock.release()
+	kv3, err := NewKV(&opt)
+
+	require.NoError(t, err)
+	defer kv3.Close()
 	for _, k := range keys {
-		value, casCounter := kv3.Get(k)
+		value, casCounter, err := kv3.Get(k)
+		require.NoError(t, err)
 		require.True(t, casCounter != 0)
 		require.Equal(t, k, value, "Key: %s", k)
 	}
@@ -531,7 +1142,10 @@ func TestCrashCAS(t *testing.T) {
 	opt.Verbose = true
 	opt.SyncWrites = true // Important for this test to pass.
 
-	kv := NewKV(&opt)
+	kv, err := NewKV(&opt)
+	defer closeCrashed(kv)
+
+	require.NoError(t, err)
 	var keys [][]byte
 	for i := 0; i < 150000; i++ {
 		k := []byte(fmt.Sprintf("%09d", i))
@@ -546,7 +1160,7 @@ func TestCrashCAS(t *testing.T) {
 		}
 		entries = append(entries, e)
 	}
-	kv.BatchSet(entries)
+	require.NoError(t, kv.BatchSet(entries))
 	for _, e := range entries {
 		require.NoError(t, e.Error, "entry with error: %+v", e)
 	}
@@ -557,7 +1171,8 @@ func TestCrashCAS(t *testing.T) {
 
 	for i := 0; i < 150000; i++ {
 		k := []byte(fmt.Sprintf("%09d", i))
-		vs := kv.get(k)
+		vs, err := kv.get(y.KeyWithTs(k, math.MaxUint64))
+		require.NoError(t, err)
 		require.EqualValues(t, oldEntries[i].casCounter, vs.CASCounter)
 
 		e := &Entry{
@@ -575,10 +1190,11 @@ func TestCrashCAS(t *testing.T) {
 		}
 		entries = append(entries, e)
 	}
-	kv.BatchSet(entries)
+	require.NoError(t, kv.BatchSet(entries))
 
 	for i, k := range keys {
-		value, casCounter := kv.Get(k)
+		value, casCounter, err := kv.Get(k)
+		require.NoError(t, err)
 		if (i % 2) == 0 {
 			require.EqualValues(t, fmt.Sprintf("changed%d", i), string(value), "%d", casCounter)
 		} else {
@@ -588,10 +1204,15 @@ func TestCrashCAS(t *testing.T) {
 	entries = entries[:0]
 
 	//	// Do not close kv store (!!) for this test to make sense.
+	kv.dirLock.release() // As if the process had died, so the directory can be opened again.
 
-	kv2 := NewKV(&opt)
+	kv2, err := NewKV(&opt)
+
+	require.NoError(t, err)
+	defer closeCrashed(kv2)
 	for i, k := range keys {
-		value, _ := kv2.Get(k)
+		value, _, err := kv2.Get(k)
+		require.NoError(t, err)
 		if (i % 2) == 0 {
 			require.EqualValues(t, fmt.Sprintf("changed%d", i), string(value))
 		} else {
@@ -600,21 +1221,28 @@ func TestCrashCAS(t *testing.T) {
 	}
 
 	{
-		val, _ := kv.Get(head)
+		val, _, err := kv.Get(head)
+		require.NoError(t, err)
 		voffset := binary.BigEndian.Uint64(val)
 		fmt.Printf("level 1 val: %v\n", voffset)
 	}
 
 	kv.lc.tryCompact(1)
 	kv.lc.tryCompact(1)
-	val, _ := kv.Get(head)
+	val, _, err := kv.Get(head)
+	require.NoError(t, err)
 	require.True(t, len(val) > 0)
 	voffset := binary.BigEndian.Uint64(val)
 	fmt.Printf("level 1 val: %v\n", voffset)
 
-	kv3 := NewKV(&opt)
+	kv2.dirLock.release()
+	kv3, err := NewKV(&opt)
+
+	require.NoError(t, err)
+	defer kv3.Close()
 	for i, k := range keys {
-		value, _ := kv3.Get(k)
+		value, _, err := kv3.Get(k)
+		require.NoError(t, err)
 		if (i % 2) == 0 {
 			require.EqualValues(t, fmt.Sprintf("changed%d", i), string(value))
 		} else {
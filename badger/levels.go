@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -95,7 +96,7 @@ func (s *levelHandler) initTables(tables []*table.Table) {
 		})
 	} else {
 		sort.Slice(s.tables, func(i, j int) bool {
-			return bytes.Compare(s.tables[i].Smallest(), s.tables[j].Smallest()) < 0
+			return y.CompareKeys(s.tables[i].Smallest(), s.tables[j].Smallest()) < 0
 		})
 	}
 }
@@ -189,7 +190,7 @@ func newLevelHandler(kv *KV, level int) *levelHandler {
 	}
 }
 
-func newLevelsController(kv *KV) *levelsController {
+func newLevelsController(kv *KV) (*levelsController, error) {
 	y.AssertTrue(kv.opt.NumLevelZeroTablesStall > kv.opt.NumLevelZeroTables)
 	s := &levelsController{
 		kv:             kv,
@@ -211,26 +212,76 @@ func newLevelsController(kv *KV) *levelsController {
 
 	// Replay compact log. Check against files in directory.
 	clogName := filepath.Join(kv.opt.Dir, "clog")
+	var obsolete map[uint64]struct{}
 	_, err := os.Stat(clogName)
 	if err == nil {
 		y.Printf("Replaying compact log: %s\n", clogName)
-		compactLogReplay(clogName, kv.opt.Dir, getIDMap(kv.opt.Dir))
-		y.Check(os.Remove(clogName)) // Everything is ok. Clear compact log.
+		if obsolete, err = compactLogReplay(clogName, kv.opt.Dir); err != nil {
+			return nil, err
+		}
+		// A read-only KV leaves the obsolete files, and the compact log, to their owner.
+		if !kv.opt.ReadOnly {
+			for id := range obsolete {
+				if err := deleteIfPresent(id, kv.opt.Dir); err != nil {
+					return nil, err
+				}
+			}
+			// Everything is ok. Clear compact log.
+			if err := os.Remove(clogName); err != nil {
+				return nil, y.Wrapf(err, "Unable to remove compact log: %s", clogName)
+			}
+		}
 	}
 
 	// Some files may be deleted. Let's reload.
+	idMap, err := getIDMap(kv.opt.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for id := range obsolete {
+		delete(idMap, id)
+	}
 	tables := make([][]*table.Table, kv.opt.MaxLevels)
-	for fileID := range getIDMap(kv.opt.Dir) {
-		fd, err := y.OpenSyncedFile(table.NewFilename(fileID, kv.opt.Dir), true)
-		y.Check(err)
-		t, err := table.OpenTable(fd, kv.opt.MapTablesTo)
-		y.Check(err)
+	closeAll := func() {
+		for _, tbls := range tables {
+			for _, t := range tbls {
+				t.Close()
+			}
+		}
+	}
+	for fileID := range idMap {
+		fname := table.NewFilename(fileID, kv.opt.Dir)
+		var fd *os.File
+		if kv.opt.ReadOnly {
+			fd, err = os.Open(fname)
+		} else {
+			fd, err = y.OpenSyncedFile(fname, true)
+		}
+		if err != nil {
+			closeAll()
+			return nil, y.Wrapf(err, "Opening file: %q", fname)
+		}
+		t, err := kv.openTable(fd)
+		if err != nil {
+			fd.Close()
+			closeAll()
+			return nil, y.Wrapf(err, "Opening table: %q", fname)
+		}
 
 		// Check metadata for level information.
 		tableMeta := t.Metadata()
-		y.AssertTrue(len(tableMeta) == 2)
+		if len(tableMeta) != 2 {
+			t.Close()
+			closeAll()
+			return nil, y.Errorf("Table %q has invalid metadata of size %d", fname, len(tableMeta))
+		}
 		level := int(binary.BigEndian.Uint16(tableMeta))
-		y.AssertTrue(level < kv.opt.MaxLevels)
+		if level >= kv.opt.MaxLevels {
+			t.Close()
+			closeAll()
+			return nil, y.Errorf("Table %q is at level %d, but MaxLevels is %d",
+				fname, level, kv.opt.MaxLevels)
+		}
 		tables[level] = append(tables[level], t)
 
 		if fileID > s.maxFileID {
@@ -244,9 +295,15 @@ func newLevelsController(kv *KV) *levelsController {
 	//	s.debugPrintMore()
 	s.validate() // Make sure key ranges do not overlap etc.
 
+	if kv.opt.ReadOnly {
+		return s, nil
+	}
 	// Create new compact log.
-	s.clog.init(clogName)
-	return s
+	if err := s.clog.init(clogName); err != nil {
+		closeAll()
+		return nil, err
+	}
+	return s, nil
 }
 
 func (s *levelsController) startCompact() {
@@ -316,16 +373,44 @@ func (s *levelsController) tryCompact(workerID int) {
 	if l < 0 {
 		return
 	}
-	y.Check(s.doCompact(l)) // May relax check later.
+	if err := s.doCompact(l); err != nil {
+		s.kv.setErr(y.Wrapf(err, "While compacting level %d", l))
+	}
 	s.Lock()
 	defer s.Unlock()
 	s.beingCompacted[l] = false
 	s.beingCompacted[l+1] = false
 }
 
-// compactBuildTables merge topTables and botTables to form a list of new tables.
-func (s *levelsController) compactBuildTables(
-	l int, topTables, botTables []*table.Table, c *compaction) ([]*table.Table, func()) {
+// compactDrops is what a compaction dropped, to be accounted for once the new tables are in place.
+type compactDrops struct {
+	rangeDels []rangeTombstone // To be forgotten.
+	// The bytes of value log entries the dropped keys pointed to, per value log file.
+	discards map[int32]int64
+}
+
+// discard counts the value log entry vs points to, if any, as garbage.
+func (d *compactDrops) discard(vs y.ValueStruct) {
+	if vs.Meta&BitValuePointer == 0 {
+		return
+	}
+	var vp valuePointer
+	vp.Decode(vs.Value)
+	d.discards[int32(vp.Fid)] += int64(vp.Len)
+}
+
+// discardChain counts the value log entries of merge operands as garbage, once they are folded.
+func (d *compactDrops) discardChain(chain *mergeChain) {
+	for _, vs := range chain.vss {
+		d.discard(vs)
+	}
+}
+
+// compactBuildTables merge topTables and botTables to form a list of new tables. It also returns
+// what it dropped: the range tombstones, which should be forgotten once the new tables are in
+// place, and the value log entries no longer pointed to.
+func (s *levelsController) compactBuildTables(l int, topTables, botTables []*table.Table,
+	c *compaction) ([]*table.Table, compactDrops, func(), error) {
 	// Next level has level>=1 and we can use ConcatIterator as key ranges do not overlap.
 	var iters []y.Iterator
 	if l == 0 {
@@ -350,19 +435,146 @@ func (s *levelsController) compactBuildTables(
 	it.Rewind()
 
 	newTables := make([]*table.Table, len(c.toInsert))
+	errs := make([]error, len(c.toInsert))
 	var wg sync.WaitGroup
 	var i int
 	newIDMin, newIDMax := c.toInsert[0], c.toInsert[len(c.toInsert)-1]
 	newID := newIDMin
+
+	// Versions of a key come newest first. Once we have kept the newest version at or below the
+	// discard watermark, no read we need to serve can see the older versions, so we drop them.
+	discardTs := s.kv.discardTs()
+	var lastKey, skipKey []byte
+
+	// Keys deleted by a range tombstone visible at the discard watermark are dropped as well. The
+	// tombstone itself is dropped once it reaches the last level, unless a table outside of this
+	// compaction could still have keys it deletes.
+	lastLevel := l+1 == s.kv.opt.MaxLevels-1
+	compacting := make(map[uint64]struct{})
+	for _, t := range topTables {
+		compacting[t.ID()] = struct{}{}
+	}
+	for _, t := range botTables {
+		compacting[t.ID()] = struct{}{}
+	}
+	dropped := compactDrops{discards: make(map[int32]int64)}
+
+	// Merge operands at or below the discard watermark are folded into the value they apply to,
+	// once we run into it. If we don't, older versions of the key could still be further down,
+	// unless this is the last level.
+	var chain *mergeChain
+	var err error
 	for ; it.Valid(); i++ {
 		y.AssertTruef(i < len(newTables), "Rewriting too many tables: %d %d", i, len(newTables))
 		timeStart := time.Now()
-		builder := table.NewTableBuilder()
+		var builder *table.TableBuilder
+		if builder, err = s.kv.newTableBuilder(); err != nil {
+			wg.Wait()
+			closeTables(newTables)
+			return nil, compactDrops{}, nil, err
+		}
 		for ; it.Valid(); it.Next() {
-			if builder.ReachedCapacity(s.kv.opt.MaxTableSize) {
+			if len(skipKey) > 0 {
+				if y.SameKey(it.Key(), skipKey) {
+					if it.Value().Meta&BitRangeDelete != 0 {
+						if t, err := parseRangeDelKey(it.Key()); err == nil {
+							dropped.rangeDels = append(dropped.rangeDels, t)
+						}
+					}
+					dropped.discard(it.Value())
+					continue
+				}
+				skipKey = skipKey[:0]
+			}
+			if !y.SameKey(it.Key(), lastKey) {
+				if chain != nil {
+					if lastLevel {
+						dropped.discardChain(chain)
+					}
+					if err = chain.write(builder, s.kv, nil, 0, lastLevel); err != nil {
+						break
+					}
+					chain = nil
+				}
+				// Only finish a table at a key boundary, so versions of a key stay in one table.
+				if builder.ReachedCapacity(s.kv.opt.MaxTableSize) {
+					break
+				}
+				lastKey = y.Safecopy(lastKey, it.Key())
+			}
+			vs := it.Value()
+			version := y.ParseTs(it.Key())
+			if chain != nil {
+				// An older version of the key whose operands we are collecting.
+				deleted := vs.Meta&BitDelete != 0 || isExpired(vs.ExpiresAt) ||
+					s.kv.rangeDels.covers(y.ParseKey(it.Key()), version, discardTs)
+				if vs.Meta&BitMergeOperand != 0 && !deleted {
+					chain.add(it.Key(), vs)
+					continue
+				}
+				var base []byte
+				var baseExpiresAt uint64
+				if !deleted {
+					base, err = s.kv.decodeValue(vs.Value, vs.Meta, new(y.Slice))
+					baseExpiresAt = vs.ExpiresAt
+				}
+				if err == nil {
+					dropped.discard(vs)
+					dropped.discardChain(chain)
+					err = chain.write(builder, s.kv, base, baseExpiresAt, true)
+				}
+				if err != nil {
+					break
+				}
+				chain = nil
+				skipKey = y.Safecopy(skipKey, it.Key())
+				continue
+			}
+			if version <= discardTs {
+				skipKey = y.Safecopy(skipKey, it.Key())
+			}
+			if vs.Meta&BitRangeDelete != 0 {
+				if lastLevel && version <= discardTs {
+					t, err := parseRangeDelKey(it.Key())
+					if err == nil && !s.overlapsOtherTables(t.keyRange(), compacting) {
+						dropped.rangeDels = append(dropped.rangeDels, t)
+						continue
+					}
+				}
+			} else if key := y.ParseKey(it.Key()); !bytes.Equal(key, head) &&
+				s.kv.rangeDels.covers(key, version, discardTs) {
+				dropped.discard(vs)
+				continue
+			}
+			if isExpired(vs.ExpiresAt) {
+				dropped.discard(vs)
+				// Nobody can read it anymore. Keep an expired tombstone, so older versions stay
+				// hidden, and drop the value, along with the pointer to it in the value log.
+				vs = y.ValueStruct{Meta: BitDelete, CASCounter: vs.CASCounter, ExpiresAt: vs.ExpiresAt}
+			} else if vs.Meta&BitMergeOperand != 0 && version <= discardTs &&
+				s.kv.opt.MergeFunc != nil {
+				// We need the older versions to fold it.
+				skipKey = skipKey[:0]
+				chain = &mergeChain{}
+				chain.add(it.Key(), vs)
+				continue
+			}
+			if err = builder.Add(it.Key(), vs); err != nil {
 				break
 			}
-			y.Check(builder.Add(it.Key(), it.Value()))
+		}
+		if err == nil && chain != nil && !it.Valid() {
+			if lastLevel {
+				dropped.discardChain(chain)
+			}
+			err = chain.write(builder, s.kv, nil, 0, lastLevel)
+			chain = nil
+		}
+		if err != nil {
+			builder.Close()
+			wg.Wait()
+			closeTables(newTables)
+			return nil, compactDrops{}, nil, err
 		}
 		if builder.Empty() {
 			builder.Close()
@@ -375,26 +587,74 @@ func (s *levelsController) compactBuildTables(
 		go func(idx int, fileID uint64, builder *table.TableBuilder) {
 			defer builder.Close()
 			defer wg.Done()
-			fd, err := y.OpenSyncedFile(table.NewFilename(fileID, s.kv.opt.Dir), true)
-			y.Check(err)
+			fname := table.NewFilename(fileID, s.kv.opt.Dir)
+			fd, err := y.OpenSyncedFile(fname, true)
+			if err != nil {
+				errs[idx] = y.Wrapf(err, "While opening new table: %s", fname)
+				return
+			}
 			// Encode the level number as table metadata.
 			var levelNum [2]byte
 			binary.BigEndian.PutUint16(levelNum[:], uint16(l+1))
 
-			fd.Write(builder.Finish(levelNum[:]))
-			newTables[idx], err = table.OpenTable(fd, s.kv.opt.MapTablesTo)
+			data, err := builder.Finish(levelNum[:])
+			if err != nil {
+				fd.Close()
+				errs[idx] = err
+				return
+			}
+			if _, err := fd.Write(data); err != nil {
+				fd.Close()
+				errs[idx] = y.Wrapf(err, "Unable to write to file: %s", fname)
+				return
+			}
 			// decrRef is added below.
-			y.Check(err)
+			if newTables[idx], err = s.kv.openTable(fd); err != nil {
+				fd.Close()
+				errs[idx] = y.Wrapf(err, "Unable to open table: %s", fname)
+			}
 		}(i, newID, builder)
 		newID++
 	}
 	wg.Wait()
 
 	out := newTables[:i]
-	return out, func() {
+	for _, err := range errs {
+		if err != nil {
+			// Dropping our references deletes the tables we managed to create. Files that were
+			// never opened are removed when the unfinished compaction is undone on replay.
+			closeTables(out)
+			return nil, compactDrops{}, nil, err
+		}
+	}
+	return out, dropped, func() {
 		for _, t := range out {
 			t.DecrRef() // replaceTables will increment reference.
 		}
+	}, nil
+}
+
+// overlapsOtherTables returns true if any table, other than the ones in skip, could have keys in r.
+func (s *levelsController) overlapsOtherTables(r y.KeyRange, skip map[uint64]struct{}) bool {
+	for _, level := range s.levels {
+		level.RLock()
+		for _, t := range level.tables {
+			if _, ok := skip[t.ID()]; !ok && r.Overlaps(t.Smallest(), t.Biggest()) {
+				level.RUnlock()
+				return true
+			}
+		}
+		level.RUnlock()
+	}
+	return false
+}
+
+// closeTables drops the references held on tables that were built by a failed compaction.
+func closeTables(tables []*table.Table) {
+	for _, t := range tables {
+		if t != nil {
+			t.DecrRef()
+		}
 	}
 }
 
@@ -469,9 +729,10 @@ func (s *levelsController) doCompact(l int) error {
 	}
 
 	var wg sync.WaitGroup
-	for _, cd := range cds {
+	errs := make([]error, len(cds))
+	for i, cd := range cds {
 		wg.Add(1)
-		go func(cd compactDef) {
+		go func(i int, cd compactDef) {
 			defer wg.Done()
 			timeStart := time.Now()
 			var readSize int64
@@ -485,9 +746,12 @@ func (s *levelsController) doCompact(l int) error {
 			if thisLevel.level >= 1 && len(cd.bot) == 0 {
 				y.AssertTrue(len(cd.top) == 1)
 				tbl := cd.top[0]
+				if err := updateLevel(tbl, l+1); err != nil {
+					errs[i] = err
+					return
+				}
 				nextLevel.replaceTables(cd.top)
 				thisLevel.deleteTables(cd.top)
-				updateLevel(tbl, l+1)
 				if s.kv.opt.Verbose {
 					fmt.Printf("LOG Compact-Move %d->%d smallest:%s biggest:%s took %v\n",
 						l, l+1, string(tbl.Smallest()), string(tbl.Biggest()), time.Since(timeStart))
@@ -499,27 +763,49 @@ func (s *levelsController) doCompact(l int) error {
 			//			if s.kv.opt.Verbose {
 			//				y.Printf("Compact start: %v\n", c)
 			//			}
-			s.clog.add(c)
-			newTables, decr := s.compactBuildTables(l, cd.top, cd.bot, c)
+			if err := s.clog.add(c); err != nil {
+				errs[i] = y.Wrapf(err, "While writing to compact log")
+				return
+			}
+			newTables, dropped, decr, err := s.compactBuildTables(l, cd.top, cd.bot, c)
+			if err != nil {
+				errs[i] = err
+				return
+			}
 			defer decr()
 
 			nextLevel.replaceTables(newTables)
 			thisLevel.deleteTables(cd.top) // Function will acquire level lock.
+			for _, t := range dropped.rangeDels {
+				s.kv.rangeDels.remove(t)
+			}
 			// Note: For level 0, while doCompact is running, it is possible that new tables are added.
 			// However, the tables are added only to the end, so it is ok to just delete the first table.
 
 			// Write to compact log.
 			c.done = 1
-			s.clog.add(c)
+			if err := s.clog.add(c); err != nil {
+				errs[i] = y.Wrapf(err, "While writing to compact log")
+				return
+			}
+			if err := s.kv.vlog.addDiscards(dropped.discards); err != nil {
+				errs[i] = y.Wrapf(err, "While saving value log discard stats")
+				return
+			}
 
 			if s.kv.opt.Verbose {
 				fmt.Printf("LOG Compact %d->%d, del %d tables, add %d tables, took %v\n",
 					l, l+1, len(cd.top)+len(cd.bot), len(newTables), time.Since(timeStart))
 			}
-		}(cd)
+		}(i, cd)
 	}
 	wg.Wait()
 	//	s.validate()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -551,6 +837,56 @@ func (s *levelsController) addLevel0Table(t *table.Table) {
 	}
 }
 
+// claimAllLevels waits for running compactions to finish, and keeps new ones from starting until
+// releaseAllLevels is called.
+func (s *levelsController) claimAllLevels() {
+	for {
+		s.Lock()
+		var busy bool
+		for _, b := range s.beingCompacted {
+			busy = busy || b
+		}
+		if !busy {
+			for i := range s.beingCompacted {
+				s.beingCompacted[i] = true
+			}
+			s.Unlock()
+			return
+		}
+		s.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *levelsController) releaseAllLevels() {
+	s.Lock()
+	defer s.Unlock()
+	for i := range s.beingCompacted {
+		s.beingCompacted[i] = false
+	}
+}
+
+// ingestLevel returns the deepest level a table with keys in r can be added to: the one right
+// above the first level with a table overlapping r, or the last level. Tables in level 0 can
+// overlap, so that is where the table goes if level 0 overlaps r. The levels must be claimed.
+func (s *levelsController) ingestLevel(r y.KeyRange) int {
+	for i, level := range s.levels {
+		level.RLock()
+		var overlaps bool
+		for _, t := range level.tables {
+			overlaps = overlaps || r.Overlaps(t.Smallest(), t.Biggest())
+		}
+		level.RUnlock()
+		if overlaps {
+			if i == 0 {
+				return 0
+			}
+			return i - 1
+		}
+	}
+	return len(s.levels) - 1
+}
+
 // tryAddLevel0Table returns true if ok and no stalling.
 func (s *levelHandler) tryAddLevel0Table(t *table.Table, verbose bool) bool {
 	y.AssertTrue(s.level == 0)
@@ -577,13 +913,15 @@ func (s *levelHandler) numTables() int {
 	return len(s.tables)
 }
 
-func (s *levelsController) close() {
+func (s *levelsController) close() error {
 	if s.kv.opt.Verbose {
 		y.Printf("Sending close signal to compact workers\n")
 	}
-	n := s.kv.opt.MaxLevels / 2
-	for i := 0; i < n; i++ {
-		s.compactWorkersDone <- struct{}{}
+	if s.compactWorkersDone != nil { // Otherwise, compactions never started.
+		n := s.kv.opt.MaxLevels / 2
+		for i := 0; i < n; i++ {
+			s.compactWorkersDone <- struct{}{}
+		}
 	}
 	// Wait for all compactions to be done. We want to be in a stable state.
 	// Also, closing tables while merge iterators have references will also lead to crash.
@@ -591,31 +929,61 @@ func (s *levelsController) close() {
 	if s.kv.opt.Verbose {
 		y.Printf("Compaction is all done\n")
 	}
+	var err error
 	for _, l := range s.levels {
-		l.close()
+		if lerr := l.close(); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	if cerr := s.clog.close(); cerr != nil && err == nil {
+		err = cerr
 	}
-	s.clog.close()
+	return err
 }
 
-func (s *levelHandler) close() {
+func (s *levelHandler) close() error {
 	s.RLock()
 	defer s.RUnlock()
+	var err error
 	for _, t := range s.tables {
-		t.Close()
+		if closeErr := t.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
 	}
+	return err
 }
 
 // get returns the found value if any. If not found, we return nil.
-func (s *levelsController) get(key []byte) y.ValueStruct {
+func (s *levelsController) get(key []byte) (y.ValueStruct, error) {
 	// No need to lock anything as we just iterate over the currently immutable levelHandlers.
 	for _, h := range s.levels {
-		vs := h.get(key)
+		vs, err := h.get(key)
+		if err != nil {
+			return y.ValueStruct{}, y.Wrapf(err, "get key: %q", key)
+		}
 		if vs.Value == nil && vs.Meta == 0 {
 			continue
 		}
-		return vs
+		return vs, nil
 	}
-	return y.ValueStruct{}
+	return y.ValueStruct{}, nil
+}
+
+// multiGet is like get, for all the keys which are not done yet. See levelHandler.multiGet.
+func (s *levelsController) multiGet(keys [][]byte, vss []y.ValueStruct, done []bool) error {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return y.CompareKeys(keys[order[i]], keys[order[j]]) < 0
+	})
+	for _, h := range s.levels {
+		if err := h.multiGet(keys, order, vss, done); err != nil {
+			return y.Wrapf(err, "multiGet on level %d", h.level)
+		}
+	}
+	return nil
 }
 
 // getTableForKey acquires a read-lock to access s.tables. It returns a list of tableHandlers.
@@ -639,7 +1007,7 @@ func (s *levelHandler) getTableForKey(key []byte) ([]*table.Table, func()) {
 	}
 	// For level >= 1, we can do a binary search as key range does not overlap.
 	idx := sort.Search(len(s.tables), func(i int) bool {
-		return bytes.Compare(s.tables[i].Biggest(), key) >= 0
+		return y.CompareKeys(s.tables[i].Biggest(), key) >= 0
 	})
 	if idx >= len(s.tables) {
 		// Given key is strictly > than every element we have.
@@ -650,25 +1018,112 @@ func (s *levelHandler) getTableForKey(key []byte) ([]*table.Table, func()) {
 	return []*table.Table{tbl}, func() { tbl.DecrRef() }
 }
 
-// get returns value for a given key. If not found, return nil.
-func (s *levelHandler) get(key []byte) y.ValueStruct {
+// get returns value for the newest version of key, which is not newer than the version in key.
+// If not found, return nil.
+func (s *levelHandler) get(key []byte) (y.ValueStruct, error) {
 	tables, decr := s.getTableForKey(key)
 	defer decr()
+	keyNoTs := y.ParseKey(key)
 	for _, th := range tables {
-		if th.DoesNotHave(key) {
+		if th.DoesNotHave(keyNoTs) {
 			continue
 		}
 		it := th.NewIterator(false)
 		defer it.Close()
 		it.Seek(key)
 		if !it.Valid() {
+			if err := it.Error(); err != io.EOF {
+				return y.ValueStruct{}, err
+			}
 			continue
 		}
-		if bytes.Equal(key, it.Key()) {
-			return it.Value()
+		if y.SameKey(key, it.Key()) {
+			vs := it.Value()
+			vs.Version = y.ParseTs(it.Key())
+			return vs, nil
 		}
 	}
-	return y.ValueStruct{}
+	return y.ValueStruct{}, nil
+}
+
+// getTablesForKeys is like getTableForKey, for the keys at the given indices which are not done
+// yet. order must sort the keys. It returns the tables to look at, along with the indices of the
+// keys to look for in each table, in the same order.
+func (s *levelHandler) getTablesForKeys(
+	keys [][]byte, order []int, done []bool) ([]*table.Table, [][]int, func()) {
+	s.RLock()
+	defer s.RUnlock()
+	var pending []int
+	for _, i := range order {
+		if !done[i] {
+			pending = append(pending, i)
+		}
+	}
+	var out []*table.Table
+	var idxs [][]int
+	if s.level == 0 {
+		// Newest tables first, as in getTableForKey.
+		for i := len(s.tables) - 1; i >= 0 && len(pending) > 0; i-- {
+			out = append(out, s.tables[i])
+			idxs = append(idxs, pending)
+		}
+	} else {
+		for _, i := range pending {
+			idx := sort.Search(len(s.tables), func(j int) bool {
+				return y.CompareKeys(s.tables[j].Biggest(), keys[i]) >= 0
+			})
+			if idx >= len(s.tables) {
+				break // This key, and all the ones after it, are bigger than every table.
+			}
+			if n := len(out); n > 0 && out[n-1] == s.tables[idx] {
+				idxs[n-1] = append(idxs[n-1], i)
+				continue
+			}
+			out = append(out, s.tables[idx])
+			idxs = append(idxs, []int{i})
+		}
+	}
+	for _, t := range out {
+		t.IncrRef()
+	}
+	return out, idxs, func() {
+		for _, t := range out {
+			t.DecrRef()
+		}
+	}
+}
+
+// multiGet is like get, for all the keys which are not done yet. It fills in vss for the keys it
+// finds, and marks them done. Each table is only iterated over once, seeking to its keys in order.
+func (s *levelHandler) multiGet(
+	keys [][]byte, order []int, vss []y.ValueStruct, done []bool) error {
+	tables, idxs, decr := s.getTablesForKeys(keys, order, done)
+	defer decr()
+	for ti, th := range tables {
+		var it *table.TableIterator
+		for _, i := range idxs[ti] {
+			if done[i] || th.DoesNotHave(y.ParseKey(keys[i])) {
+				continue
+			}
+			if it == nil {
+				it = th.NewIterator(false)
+				defer it.Close()
+			}
+			it.Seek(keys[i])
+			if !it.Valid() {
+				if err := it.Error(); err != io.EOF {
+					return err
+				}
+				continue
+			}
+			if y.SameKey(keys[i], it.Key()) {
+				vss[i] = it.Value()
+				vss[i].Version = y.ParseTs(it.Key())
+				done[i] = true
+			}
+		}
+	}
+	return nil
 }
 
 func appendIteratorsReversed(out []y.Iterator, th []*table.Table, reversed bool) []y.Iterator {
@@ -679,25 +1134,36 @@ func appendIteratorsReversed(out []y.Iterator, th []*table.Table, reversed bool)
 	return out
 }
 
-// appendIterators appends iterators to an array of iterators, for merging.
+// appendIterators appends iterators to an array of iterators, for merging. Only tables which can
+// have keys in r are included.
 // Note: This obtains references for the table handlers. Remember to close these iterators.
-func (s *levelHandler) appendIterators(iters []y.Iterator, reversed bool) []y.Iterator {
+func (s *levelHandler) appendIterators(
+	iters []y.Iterator, reversed bool, r y.KeyRange) []y.Iterator {
 	s.RLock()
 	defer s.RUnlock()
 	if s.level == 0 {
+		tables := s.tables
+		if !r.IsUnbounded() {
+			tables = make([]*table.Table, 0, len(s.tables))
+			for _, t := range s.tables {
+				if r.Overlaps(t.Smallest(), t.Biggest()) {
+					tables = append(tables, t)
+				}
+			}
+		}
 		// Remember to add in reverse order!
 		// The newer table at the end of s.tables should be added first as it takes precedence.
-		return appendIteratorsReversed(iters, s.tables, reversed)
+		return appendIteratorsReversed(iters, tables, reversed)
 	}
-	return append(iters, table.NewConcatIterator(s.tables, reversed))
+	return append(iters, table.NewConcatRangeIterator(s.tables, reversed, r))
 }
 
 // appendIterators appends iterators to an array of iterators, for merging.
 // Note: This obtains references for the table handlers. Remember to close these iterators.
 func (s *levelsController) appendIterators(
-	iters []y.Iterator, reversed bool) []y.Iterator {
+	iters []y.Iterator, reversed bool, r y.KeyRange) []y.Iterator {
 	for _, level := range s.levels {
-		iters = level.appendIterators(iters, reversed)
+		iters = level.appendIterators(iters, reversed, r)
 	}
 	return iters
 }
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"errors"
+
+	"github.com/dgraph-io/badger/table"
+	"github.com/dgraph-io/badger/y"
+)
+
+// MergeFunc combines the existing value of a key with an operand passed to KV.Merge, and returns
+// the new value. existing is nil if the key has no value. Operands get folded both on reads and
+// during compactions, so a MergeFunc must be deterministic, and must not modify its arguments.
+type MergeFunc func(existing, operand []byte) []byte
+
+// ErrNoMergeFunc is returned by Merge, and by reads which run into merge operands, when
+// Options.MergeFunc is not set.
+var ErrNoMergeFunc = errors.New("Options.MergeFunc needs to be set to use merge operands")
+
+// Merge writes operand for key, to be combined with the existing value of key using
+// Options.MergeFunc. The existing value is not read, so Merge is as cheap as Set, and never
+// fails due to contention. Reads fold the operands written since the last value, and so do
+// compactions, which then store the result as the new value.
+func (s *KV) Merge(key, operand []byte) error {
+	if s.opt.MergeFunc == nil {
+		return ErrNoMergeFunc
+	}
+	return s.BatchSet([]*Entry{{Key: key, Value: operand, Meta: BitMergeOperand}})
+}
+
+// foldMerges returns the value of key as of readTs, given vs, the newest version of key visible
+// at readTs, which is a merge operand. It goes through older versions, until it finds the value
+// the operands apply to.
+func (s *KV) foldMerges(key []byte, vs y.ValueStruct, readTs uint64) ([]byte, error) {
+	if s.opt.MergeFunc == nil {
+		return nil, ErrNoMergeFunc
+	}
+	var operands [][]byte
+	var base []byte
+	for vs.Version > 0 && vs.Meta&BitDelete == 0 && !isExpired(vs.ExpiresAt) &&
+		!s.rangeDels.covers(key, vs.Version, readTs) {
+		val, err := s.decodeValue(vs.Value, vs.Meta, new(y.Slice))
+		if err != nil {
+			return nil, err
+		}
+		if vs.Meta&BitMergeOperand == 0 {
+			base = y.Safecopy(nil, val)
+			break
+		}
+		operands = append(operands, y.Safecopy(nil, val))
+		if vs, err = s.get(y.KeyWithTs(key, vs.Version-1)); err != nil {
+			return nil, err
+		}
+	}
+	return s.applyMerges(base, operands), nil
+}
+
+// applyMerges applies operands, which are newest first, to base.
+func (s *KV) applyMerges(base []byte, operands [][]byte) []byte {
+	for i := len(operands) - 1; i >= 0; i-- {
+		base = s.opt.MergeFunc(base, operands[i])
+	}
+	return base
+}
+
+// mergeChain holds the merge operands of a key, newest first, which a compaction collects until
+// it finds the value they apply to.
+type mergeChain struct {
+	keys [][]byte
+	vss  []y.ValueStruct
+}
+
+func (c *mergeChain) add(key []byte, vs y.ValueStruct) {
+	vs.Value = y.Safecopy(nil, vs.Value)
+	c.keys = append(c.keys, y.Safecopy(nil, key))
+	c.vss = append(c.vss, vs)
+}
+
+// write adds the operands to b. If fold is true, they are first folded into base, and added as
+// a single value, with the version of the newest operand. The value expires as soon as base, which
+// expires at baseExpiresAt, or any of the operands would have.
+func (c *mergeChain) write(b *table.TableBuilder, kv *KV, base []byte, baseExpiresAt uint64,
+	fold bool) error {
+	if !fold {
+		for i, key := range c.keys {
+			if err := b.Add(key, c.vss[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	operands := make([][]byte, len(c.vss))
+	expiresAt := baseExpiresAt
+	for i, vs := range c.vss {
+		val, err := kv.decodeValue(vs.Value, vs.Meta, new(y.Slice))
+		if err != nil {
+			return err
+		}
+		operands[i] = val
+		expiresAt = earliestExpiry(expiresAt, vs.ExpiresAt)
+	}
+	return b.Add(c.keys[0], y.ValueStruct{
+		Value:      kv.applyMerges(base, operands),
+		UserMeta:   c.vss[0].UserMeta,
+		CASCounter: c.vss[0].CASCounter,
+		ExpiresAt:  expiresAt,
+	})
+}
+
+// earliestExpiry returns whichever of a and b comes first, where zero means never.
+func earliestExpiry(a, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
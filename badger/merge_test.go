@@ -0,0 +1,204 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+func addUint64(existing, operand []byte) []byte {
+	var n uint64
+	if len(existing) == 8 {
+		n = binary.BigEndian.Uint64(existing)
+	}
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, n+binary.BigEndian.Uint64(operand))
+	return out
+}
+
+func appendValue(existing, operand []byte) []byte {
+	out := make([]byte, 0, len(existing)+len(operand))
+	return append(append(out, existing...), operand...)
+}
+
+func uint64Bytes(n uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return buf[:]
+}
+
+func TestMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	require.Equal(t, ErrNoMergeFunc, kv.Merge([]byte("counter"), uint64Bytes(1)))
+	require.NoError(t, kv.Close())
+
+	opt.MergeFunc = addUint64
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	key := []byte("counter")
+	errCh := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				if err := kv.Merge(key, uint64Bytes(1)); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- nil
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, <-errCh)
+	}
+	val, _, err := kv.Get(key)
+	require.NoError(t, err)
+	require.EqualValues(t, 100, binary.BigEndian.Uint64(val))
+
+	// Operands apply to a value that was set, and start from scratch after a delete.
+	before := kv.Version()
+	require.NoError(t, kv.Set(key, uint64Bytes(1000)))
+	require.NoError(t, kv.Merge(key, uint64Bytes(5)))
+	val, _, err = kv.Get(key)
+	require.NoError(t, err)
+	require.EqualValues(t, 1005, binary.BigEndian.Uint64(val))
+	require.NoError(t, kv.Delete(key))
+	require.NoError(t, kv.Merge(key, uint64Bytes(7)))
+
+	it := kv.NewIterator(IteratorOptions{Prefix: key, FetchValues: true})
+	it.Rewind()
+	require.True(t, it.Valid())
+	val, err = it.Item().Value()
+	require.NoError(t, err)
+	require.EqualValues(t, 7, binary.BigEndian.Uint64(val))
+	it.Close()
+
+	val, _, err = kv.GetAt(key, before)
+	require.NoError(t, err)
+	require.EqualValues(t, 100, binary.BigEndian.Uint64(val))
+}
+
+func TestMergeCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.MaxLevels = 2
+	opt.DoNotCompact = true
+	opt.MergeFunc = appendValue
+
+	// Spread the operands over a few tables on level 0. Operands which are big enough go to the
+	// value log.
+	var want []string
+	for i := 0; i < 3; i++ {
+		kv, err := NewKV(opt)
+		require.NoError(t, err)
+		for j := 0; j < 5; j++ {
+			op := strings.Repeat(fmt.Sprintf("%d-%d,", i, j), 3*j)
+			require.NoError(t, kv.Merge([]byte("list"), []byte(op)))
+			want = append(want, op)
+		}
+		require.NoError(t, kv.Close())
+	}
+
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	val, _, err := kv.Get([]byte("list"))
+	require.NoError(t, err)
+	require.Equal(t, strings.Join(want, ""), string(val))
+
+	// Level 1 is the last level, so all the operands get folded into one value.
+	require.NoError(t, kv.lc.doCompact(0))
+	var versions int
+	for _, tbl := range kv.lc.levels[1].tables {
+		it := tbl.NewIterator(false)
+		for it.Rewind(); it.Valid(); it.Next() {
+			if string(y.ParseKey(it.Key())) == "list" {
+				require.Zero(t, it.Value().Meta&BitMergeOperand)
+				versions++
+			}
+		}
+		it.Close()
+	}
+	require.Equal(t, 1, versions)
+	val, _, err = kv.Get([]byte("list"))
+	require.NoError(t, err)
+	require.Equal(t, strings.Join(want, ""), string(val))
+}
+
+func TestMergeCompactionExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.MaxLevels = 2
+	opt.DoNotCompact = true
+	opt.MergeFunc = appendValue
+
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	key := []byte("list")
+	require.NoError(t, kv.SetWithTTL(key, []byte("a,"), 2*time.Hour))
+	require.NoError(t, kv.Merge(key, []byte("b,")))
+	expiresAt := uint64(time.Now().Add(time.Hour).Unix())
+	require.NoError(t, kv.BatchSet([]*Entry{
+		{Key: key, Value: []byte("c,"), Meta: BitMergeOperand, ExpiresAt: expiresAt},
+	}))
+	require.NoError(t, kv.Merge(key, []byte("d,")))
+	require.NoError(t, kv.Close())
+
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	require.NoError(t, kv.lc.doCompact(0))
+
+	// The folded value expires along with the operand that expires first.
+	var versions int
+	for _, tbl := range kv.lc.levels[1].tables {
+		it := tbl.NewIterator(false)
+		for it.Rewind(); it.Valid(); it.Next() {
+			if string(y.ParseKey(it.Key())) == "list" {
+				require.Zero(t, it.Value().Meta&BitMergeOperand)
+				require.Equal(t, expiresAt, it.Value().ExpiresAt)
+				versions++
+			}
+		}
+		it.Close()
+	}
+	require.Equal(t, 1, versions)
+	val, _, err := kv.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, "a,b,c,d,", string(val))
+}
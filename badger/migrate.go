@@ -0,0 +1,396 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bkaradzic/go-lz4"
+
+	"github.com/dgraph-io/badger/table"
+	"github.com/dgraph-io/badger/y"
+)
+
+const (
+	formatFilename = "FORMAT"
+
+	// formatVersion is the version of the on-disk format written by this code. Version 1 had keys
+	// without versions and 16-bit CAS counters, and didn't write a FORMAT file. Version 2 didn't
+	// checksum value log entries, version 3 didn't write which compressor compressed one, as it
+	// was always LZ4, and version 4 value log files had no header, as they weren't encrypted.
+	// Their directories are upgraded when opened: the value log files they have are still read as
+	// they were written, and the new ones are written in the current format.
+	formatVersion = 5
+
+	// legacyHeaderSize is the size of a value log entry header in version 1: klen(4), vlen(4),
+	// meta(1), casCounter(2) and casCounterCheck(2).
+	legacyHeaderSize = 13
+)
+
+// ErrOldFormat is returned by NewKV when Options.Dir was written by an older version of Badger.
+var ErrOldFormat = errors.New(
+	"Directory was written by an older version of Badger. Use Migrate to copy it to a new one")
+
+// logFormats has the ID of the first value log file written in each format version from 3 on. The
+// files before them were written in version 2.
+type logFormats []int32
+
+func newLogFormats() logFormats {
+	return make(logFormats, formatVersion-2)
+}
+
+// of returns the format version the value log file fid was written in.
+func (f logFormats) of(fid int32) int {
+	version := 2
+	for i, first := range f {
+		if fid >= first {
+			version = 3 + i
+		}
+	}
+	return version
+}
+
+// checkFormat makes sure dir is in the current format, and returns the format versions of its
+// value log files. It marks a new directory as such, unless it is opened read-only, in which case
+// there is nothing to read. A directory in an older version from 2 on is upgraded, unless it is
+// opened read-only.
+//
+// The FORMAT file has the version, followed by logFormats.
+func checkFormat(dir string, readOnly bool) (logFormats, error) {
+	fname := filepath.Join(dir, formatFilename)
+	buf, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		old, err := hasDataFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		if old {
+			return nil, ErrOldFormat
+		}
+		if readOnly {
+			return nil, y.Errorf("Unable to open %s read-only, as it has no data", dir)
+		}
+		formats := newLogFormats()
+		return formats, writeFormat(fname, formats)
+	}
+	if err != nil {
+		return nil, y.Wrapf(err, "Unable to read %s", fname)
+	}
+	if len(buf) < 4 {
+		return nil, y.Errorf("%s has invalid size %d", fname, len(buf))
+	}
+	v := binary.BigEndian.Uint32(buf)
+	if v < 2 || v > formatVersion {
+		return nil, y.Errorf("%s has format version %d, but only versions 2 to %d are supported",
+			dir, v, formatVersion)
+	}
+	if len(buf) != 4*int(v-1) {
+		return nil, y.Errorf("%s has invalid size %d", fname, len(buf))
+	}
+	var formats logFormats
+	for i := 4; i < len(buf); i += 4 {
+		formats = append(formats, int32(binary.BigEndian.Uint32(buf[i:i+4])))
+	}
+	if v == formatVersion {
+		return formats, nil
+	}
+
+	// Only the value log files written from now on are in the current format.
+	fid, err := nextVlogFid(dir)
+	if err != nil {
+		return nil, err
+	}
+	for len(formats) < formatVersion-2 {
+		formats = append(formats, fid)
+	}
+	if readOnly {
+		return formats, nil
+	}
+	return formats, writeFormat(fname, formats)
+}
+
+// writeFormat marks the directory of fname as being in the current format, with the given value
+// log formats. fname is replaced atomically, as it may exist already.
+func writeFormat(fname string, formats logFormats) error {
+	y.AssertTrue(len(formats) == formatVersion-2)
+	tmpName := fname + ".tmp"
+	fd, err := y.OpenSyncedFile(tmpName, true)
+	if err != nil {
+		return y.Wrapf(err, "Unable to create %s", tmpName)
+	}
+	buf := make([]byte, 4*(formatVersion-1))
+	binary.BigEndian.PutUint32(buf[0:4], formatVersion)
+	for i, fid := range formats {
+		binary.BigEndian.PutUint32(buf[4+4*i:], uint32(fid))
+	}
+	if _, err := fd.Write(buf); err != nil {
+		fd.Close()
+		return y.Wrapf(err, "Unable to write %s", tmpName)
+	}
+	if err := fd.Close(); err != nil {
+		return y.Wrapf(err, "Unable to close %s", tmpName)
+	}
+	return y.Wrapf(os.Rename(tmpName, fname), "Unable to rename %s to %s", tmpName, fname)
+}
+
+// nextVlogFid returns the ID right after the one of the last value log file in dir.
+func nextVlogFid(dir string) (int32, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var next int32
+	for _, info := range fileInfos {
+		if !strings.HasSuffix(info.Name(), ".vlog") {
+			continue
+		}
+		fid, err := strconv.Atoi(strings.TrimSuffix(info.Name(), ".vlog"))
+		if err != nil {
+			return 0, y.Wrapf(err, "Error while parsing value log id for file: %q", info.Name())
+		}
+		if int32(fid) >= next {
+			next = int32(fid) + 1
+		}
+	}
+	return next, nil
+}
+
+// hasDataFiles returns true if dir has any tables or value log files.
+func hasDataFiles(dir string) (bool, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, info := range fileInfos {
+		if strings.HasSuffix(info.Name(), ".sst") || strings.HasSuffix(info.Name(), ".vlog") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Migrate copies the data in oldDir, written by a version of Badger without versioned keys and
+// with 16-bit CAS counters, into a new KV at opt.Dir, which should be empty. The KV at oldDir must
+// have been closed cleanly, and is left untouched. The newest value of every key is copied, and
+// gets a new CAS counter, so CAS counters read before the migration no longer match.
+func Migrate(oldDir string, opt *Options) error {
+	if _, err := os.Stat(filepath.Join(oldDir, formatFilename)); err == nil {
+		return y.Errorf("%s is already in the current format", oldDir)
+	}
+	tables, err := openLegacyTables(oldDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, t := range tables {
+			t.Close()
+		}
+	}()
+
+	kv, err := NewKV(opt)
+	if err != nil {
+		return err
+	}
+	vlogs := make(map[uint32]*os.File)
+	defer func() {
+		for _, fd := range vlogs {
+			fd.Close()
+		}
+	}()
+
+	var entries []*Entry
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		err := kv.BatchSet(entries)
+		entries = entries[:0]
+		return err
+	}
+	// Tables are in order from the oldest data to the newest, so newer values overwrite older ones.
+	for _, t := range tables {
+		it := t.NewIterator(false)
+		for it.Rewind(); it.Valid(); it.Next() {
+			if bytes.Equal(it.Key(), head) {
+				continue
+			}
+			e := &Entry{Key: y.Safecopy(nil, it.Key())}
+			vs := it.Value()
+			switch {
+			case vs.Meta&BitDelete != 0:
+				e.Meta = BitDelete
+			case vs.Meta&BitValuePointer != 0:
+				var vp valuePointer
+				vp.Decode(vs.Value)
+				meta, val, err := readLegacyValue(oldDir, vlogs, vp)
+				if err != nil {
+					it.Close()
+					kv.Close()
+					return err
+				}
+				if meta&BitDelete != 0 {
+					e.Meta = BitDelete
+				} else {
+					e.Value = val
+				}
+			default:
+				e.Value = y.Safecopy(nil, vs.Value)
+			}
+			entries = append(entries, e)
+			if len(entries) == 1000 {
+				if err := flush(); err != nil {
+					it.Close()
+					kv.Close()
+					return err
+				}
+			}
+		}
+		err := it.Error()
+		it.Close()
+		if err != io.EOF {
+			kv.Close()
+			return y.Wrapf(err, "While reading %s", t.Filename())
+		}
+	}
+	if err := flush(); err != nil {
+		kv.Close()
+		return err
+	}
+	return kv.Close()
+}
+
+// openLegacyTables opens the tables in dir which hold live data, ordered from the oldest data to
+// the newest: from the last level up, and by file ID within level 0.
+func openLegacyTables(dir string) ([]*table.Table, error) {
+	idMap, err := getIDMap(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Tables which a finished compaction replaced, or an unfinished one created, can linger.
+	clogName := filepath.Join(dir, "clog")
+	if _, err := os.Stat(clogName); err == nil {
+		pending := make(map[uint64]*compaction)
+		err := compactLogIterate(clogName, func(c *compaction) {
+			if c.done == 0 {
+				pending[c.compactID] = c
+				return
+			}
+			if p, ok := pending[c.compactID]; ok {
+				for _, id := range p.toDelete {
+					delete(idMap, id)
+				}
+				delete(pending, c.compactID)
+			}
+		})
+		if err != nil {
+			return nil, y.Wrapf(err, "While iterating over compact log: %s", clogName)
+		}
+		for _, c := range pending {
+			for _, id := range c.toInsert {
+				delete(idMap, id)
+			}
+		}
+	}
+
+	type legacyTable struct {
+		t     *table.Table
+		level int
+	}
+	var tables []legacyTable
+	closeAll := func() {
+		for _, lt := range tables {
+			lt.t.Close()
+		}
+	}
+	for id := range idMap {
+		fname := table.NewFilename(id, dir)
+		fd, err := os.Open(fname)
+		if err != nil {
+			closeAll()
+			return nil, y.Wrapf(err, "Opening file: %q", fname)
+		}
+		t, err := table.OpenLegacyTable(fd)
+		if err != nil {
+			fd.Close()
+			closeAll()
+			return nil, y.Wrapf(err, "Opening table: %q", fname)
+		}
+		if len(t.Metadata()) != 2 {
+			t.Close()
+			closeAll()
+			return nil, y.Errorf("Table %q has invalid metadata of size %d", fname, len(t.Metadata()))
+		}
+		level := int(binary.BigEndian.Uint16(t.Metadata()))
+		tables = append(tables, legacyTable{t: t, level: level})
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].level != tables[j].level {
+			return tables[i].level > tables[j].level
+		}
+		return tables[i].t.ID() < tables[j].t.ID()
+	})
+	out := make([]*table.Table, 0, len(tables))
+	for _, lt := range tables {
+		out = append(out, lt.t)
+	}
+	return out, nil
+}
+
+// readLegacyValue reads the entry at vp from the version 1 value log in dir. Open value log files
+// are kept in fds.
+func readLegacyValue(dir string, fds map[uint32]*os.File, vp valuePointer) (byte, []byte, error) {
+	fd, ok := fds[vp.Fid]
+	if !ok {
+		var err error
+		if fd, err = os.Open(vlogFilePath(dir, int32(vp.Fid))); err != nil {
+			return 0, nil, y.Wrapf(err, "Unable to open value log")
+		}
+		fds[vp.Fid] = fd
+	}
+	buf := make([]byte, vp.Len)
+	if _, err := fd.ReadAt(buf, int64(vp.Offset)); err != nil {
+		return 0, nil, y.Wrapf(err, "Unable to read from value log: %+v", vp)
+	}
+	if len(buf) < legacyHeaderSize {
+		return 0, nil, y.Errorf("Invalid value pointer: %+v", vp)
+	}
+	klen := binary.BigEndian.Uint32(buf[0:4])
+	vlen := binary.BigEndian.Uint32(buf[4:8])
+	meta := buf[8]
+	buf = buf[legacyHeaderSize:]
+	if meta&BitCompressed != 0 {
+		decoded, err := lz4.Decode(nil, buf)
+		if err != nil {
+			return 0, nil, y.Wrapf(err, "Unable to decompress value at %+v", vp)
+		}
+		buf = decoded
+		vlen = uint32(len(buf)) - klen
+	}
+	if uint32(len(buf)) < klen+vlen {
+		return 0, nil, y.Errorf("Invalid value pointer: %+v", vp)
+	}
+	return meta, buf[klen : klen+vlen], nil
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testdata/format1 was written by the previous format, with 2000 keys set to
+// legacyValue(i), keys 0 to 299 then set to "new<i>", and keys 300 to 399 deleted.
+func legacyValue(i int) string {
+	switch {
+	case i < 300:
+		return fmt.Sprintf("new%d", i)
+	case i < 400:
+		return ""
+	}
+	switch i % 3 {
+	case 0:
+		return fmt.Sprintf("v%d", i) // Stored in the LSM tree.
+	case 1:
+		return strings.Repeat(fmt.Sprintf("big%d,", i), 20) // Stored in the value log.
+	}
+	return strings.Repeat(fmt.Sprintf("compressible%d,", i), 150) // Compressed in the value log.
+}
+
+func TestMigrate(t *testing.T) {
+	oldDir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(oldDir)
+	fileInfos, err := ioutil.ReadDir("testdata/format1")
+	require.NoError(t, err)
+	for _, info := range fileInfos {
+		data, err := ioutil.ReadFile("testdata/format1/" + info.Name())
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(oldDir+"/"+info.Name(), data, 0644))
+	}
+
+	_, err = NewKV(getTestOptions(oldDir))
+	require.Equal(t, ErrOldFormat, err)
+
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, Migrate(oldDir, getTestOptions(dir)))
+
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+	for i := 0; i < 2000; i++ {
+		val, _, err := kv.Get([]byte(fmt.Sprintf("key%04d", i)))
+		require.NoError(t, err)
+		require.Equal(t, legacyValue(i), string(val), "key%04d", i)
+	}
+
+	// The old directory is left as it was.
+	_, err = NewKV(getTestOptions(oldDir))
+	require.Equal(t, ErrOldFormat, err)
+}
+
+func TestCASCounterMonotonic(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+
+	key := []byte("key")
+	var last uint64
+	for i := 0; i < 100; i++ {
+		require.NoError(t, kv.Set(key, []byte(fmt.Sprintf("val%d", i))))
+		_, cas, err := kv.Get(key)
+		require.NoError(t, err)
+		require.True(t, cas > last, "CAS counter went from %d to %d", last, cas)
+		last = cas
+	}
+	require.NoError(t, kv.Close())
+
+	// Counters keep going up after a restart, so a stale counter can't match a later write.
+	kv, err = NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+	require.NoError(t, kv.Set(key, []byte("again")))
+	_, cas, err := kv.Get(key)
+	require.NoError(t, err)
+	require.True(t, cas > last, "CAS counter went from %d to %d", last, cas)
+	require.Equal(t, CasMismatch, kv.CompareAndSet(key, []byte("stale"), last))
+	require.NoError(t, kv.CompareAndSet(key, []byte("fresh"), cas))
+}
+
+func TestUpgradeFormat2(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A version 2 value log has no checksums.
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	var buf bytes.Buffer
+	for i := 0; i < 10; i++ {
+		h := header{klen: uint32(len(key(i))), vlen: 1, version: uint64(i + 1)}
+		var hbuf [headerBufSize]byte
+		h.Encode(hbuf[:])
+		buf.Write(hbuf[:])
+		buf.Write(key(i))
+		buf.WriteByte(byte(i))
+	}
+	require.NoError(t, ioutil.WriteFile(vlogFilePath(dir, 0), buf.Bytes(), 0666))
+	fname := filepath.Join(dir, formatFilename)
+	require.NoError(t, ioutil.WriteFile(fname, []byte{0, 0, 0, 2}, 0666))
+
+	opt := getTestOptions(dir)
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	require.NoError(t, kv.Set(key(10), []byte{10}))
+	require.NoError(t, kv.Close())
+	format, err := ioutil.ReadFile(fname)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, formatVersion, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1}, format)
+
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	for i := 0; i <= 10; i++ {
+		val, _, err := kv.Get(key(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i)}, val)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// MultiGet looks up all the keys as of the same version, and returns their items in the same
+// order as keys. Keys which are not found, or have been deleted or have expired, get a nil item.
+// It is much cheaper than calling GetItem for each key: the memtables and each table are only
+// looked at once, and the values are read from the value log concurrently, one goroutine per
+// value log file, in the order they are stored in.
+func (s *KV) MultiGet(keys [][]byte) ([]*KVItem, error) {
+	readTs := s.Version()
+	ikeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		ikeys[i] = y.KeyWithTs(key, readTs)
+	}
+	vss := make([]y.ValueStruct, len(keys))
+	done := make([]bool, len(keys))
+
+	tables, decr := s.getMemTables()
+	for i, ikey := range ikeys {
+		for _, tbl := range tables {
+			if vs := tbl.Get(ikey); vs.Meta != 0 || vs.Value != nil {
+				vss[i], done[i] = vs, true
+				break
+			}
+		}
+	}
+	decr()
+	if err := s.lc.multiGet(ikeys, vss, done); err != nil {
+		return nil, err
+	}
+
+	items := make([]*KVItem, len(keys))
+	var ptrs []multiGetPtr
+	var merges []int
+	for i, vs := range vss {
+		if vs.Version == 0 || vs.Meta&BitDelete != 0 || isExpired(vs.ExpiresAt) ||
+			s.rangeDels.covers(keys[i], vs.Version, readTs) {
+			continue
+		}
+		item := &KVItem{
+			kv:         s,
+			key:        keys[i],
+			meta:       vs.Meta,
+			userMeta:   vs.UserMeta,
+			casCounter: vs.CASCounter,
+			version:    vs.Version,
+			expiresAt:  vs.ExpiresAt,
+			readTs:     readTs,
+			slice:      new(y.Slice),
+			fetched:    true,
+		}
+		items[i] = item
+		switch {
+		case vs.Meta&BitMergeOperand != 0:
+			item.vptr = y.Safecopy(nil, vs.Value)
+			merges = append(merges, i)
+		case vs.Meta&BitValuePointer != 0:
+			var vp valuePointer
+			vp.Decode(vs.Value)
+			ptrs = append(ptrs, multiGetPtr{idx: i, vp: vp})
+		default:
+			item.val = y.Safecopy(nil, vs.Value)
+		}
+	}
+
+	// Read the values of each value log file in a goroutine of its own, in offset order.
+	sort.Slice(ptrs, func(i, j int) bool {
+		if ptrs[i].vp.Fid != ptrs[j].vp.Fid {
+			return ptrs[i].vp.Fid < ptrs[j].vp.Fid
+		}
+		return ptrs[i].vp.Offset < ptrs[j].vp.Offset
+	})
+	var wg sync.WaitGroup
+	errCh := make(chan error, 1)
+	for len(ptrs) > 0 {
+		n := 1
+		for n < len(ptrs) && ptrs[n].vp.Fid == ptrs[0].vp.Fid {
+			n++
+		}
+		wg.Add(1)
+		go func(ptrs []multiGetPtr) {
+			defer wg.Done()
+			for _, p := range ptrs {
+				item := items[p.idx]
+				e, err := s.vlog.Read(p.vp, item.slice)
+				if err != nil {
+					select {
+					case errCh <- y.Wrapf(err, "Unable to read from value log: %+v", p.vp):
+					default:
+					}
+					return
+				}
+				item.val = e.Value
+			}
+		}(ptrs[:n])
+		ptrs = ptrs[n:]
+	}
+
+	var err error
+	for _, i := range merges {
+		item := items[i]
+		if item.val, err = s.foldMerges(item.key, item.valueStruct(), readTs); err != nil {
+			break
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case err := <-errCh:
+		return nil, err
+	default:
+	}
+	return items, nil
+}
+
+// multiGetPtr is a value MultiGet needs to read from the value log.
+type multiGetPtr struct {
+	idx int // Index of the key.
+	vp  valuePointer
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiGet(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	val := func(i int) []byte {
+		if i%3 == 0 { // Goes to the value log.
+			return []byte(strings.Repeat(fmt.Sprintf("%05d", i), 10))
+		}
+		return []byte(fmt.Sprintf("%05d", i))
+	}
+	// Spread the keys over the tables and the memtable.
+	write := func(from, to int) {
+		var entries []*Entry
+		for i := from; i < to; i++ {
+			entries = append(entries, &Entry{Key: key(i), Value: val(i)})
+		}
+		require.NoError(t, kv.BatchSet(entries))
+	}
+	write(0, 3000)
+	require.NoError(t, kv.Close())
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	write(3000, 4000)
+	for i := 0; i < 4000; i += 7 {
+		require.NoError(t, kv.Delete(key(i)))
+	}
+
+	var keys [][]byte
+	for i := 4100; i >= 0; i -= 5 { // Some keys are missing, and the order is scrambled.
+		keys = append(keys, key(i), key((i*37)%4100))
+	}
+	items, err := kv.MultiGet(keys)
+	require.NoError(t, err)
+	require.Equal(t, len(keys), len(items))
+	for i, k := range keys {
+		want, err := kv.GetItem(k)
+		if err == ErrKeyNotFound {
+			require.Nil(t, items[i], string(k))
+			continue
+		}
+		require.NoError(t, err)
+		require.NotNil(t, items[i], string(k))
+		require.Equal(t, k, items[i].Key())
+		require.Equal(t, want.Counter(), items[i].Counter())
+		require.Equal(t, want.Version(), items[i].Version())
+		v, err := items[i].Value()
+		require.NoError(t, err)
+		wantVal, err := want.Value()
+		require.NoError(t, err)
+		require.Equal(t, wantVal, v, string(k))
+	}
+}
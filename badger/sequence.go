@@ -0,0 +1,121 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+// ErrZeroBandwidth is returned by GetSequence when bandwidth is zero.
+var ErrZeroBandwidth = errors.New("Sequence bandwidth must be greater than zero")
+
+// Sequence hands out unique, increasing integers, starting from zero, backed by a key. It leases
+// bandwidth integers at a time, by storing the end of the lease under the key, so only one in
+// bandwidth calls to Next writes to the KV. Integers leased but not handed out are skipped after
+// a restart or a crash, unless Release is called. Only use one Sequence for a key at a time. A
+// Sequence is safe for concurrent use.
+type Sequence struct {
+	sync.Mutex
+	kv        *KV
+	key       []byte
+	next      uint64
+	leased    uint64 // Integers from next up to, but not including, leased can be handed out.
+	bandwidth uint64
+}
+
+// GetSequence returns a Sequence for key, which carries on from the integers handed out by
+// earlier Sequences for key.
+func (s *KV) GetSequence(key []byte, bandwidth uint64) (*Sequence, error) {
+	if bandwidth == 0 {
+		return nil, ErrZeroBandwidth
+	}
+	seq := &Sequence{
+		kv:        s,
+		key:       y.Safecopy(nil, key),
+		bandwidth: bandwidth,
+	}
+	if err := seq.updateLease(); err != nil {
+		return nil, err
+	}
+	return seq, nil
+}
+
+// Next returns the next integer in the sequence.
+func (seq *Sequence) Next() (uint64, error) {
+	seq.Lock()
+	defer seq.Unlock()
+	if seq.next >= seq.leased {
+		if err := seq.updateLease(); err != nil {
+			return 0, err
+		}
+	}
+	val := seq.next
+	seq.next++
+	return val, nil
+}
+
+// Release gives back the leased integers which have not been handed out yet, so the next
+// Sequence for the key starts right after the last integer returned by Next. The Sequence
+// should not be used after that.
+func (seq *Sequence) Release() error {
+	seq.Lock()
+	defer seq.Unlock()
+	if err := seq.store(seq.next); err != nil {
+		return err
+	}
+	seq.leased = seq.next
+	return nil
+}
+
+// updateLease leases the next bandwidth integers, starting from where the stored lease ended.
+func (seq *Sequence) updateLease() error {
+	val, _, err := seq.kv.Get(seq.key)
+	if err != nil {
+		return err
+	}
+	var start uint64
+	switch len(val) {
+	case 0:
+	case 8:
+		start = binary.BigEndian.Uint64(val)
+	default:
+		return y.Errorf("Key %q does not hold a sequence: %x", seq.key, val)
+	}
+	lease := start + seq.bandwidth
+	if err := seq.store(lease); err != nil {
+		return err
+	}
+	seq.next = start
+	seq.leased = lease
+	return nil
+}
+
+// store writes the end of the lease. It always goes to the value log, so a lease is never lost
+// if we crash before the memtable gets flushed.
+func (seq *Sequence) store(lease uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], lease)
+	e := &Entry{Key: seq.key, Value: buf[:], logAlways: true}
+	if err := seq.kv.BatchSet([]*Entry{e}); err != nil {
+		return err
+	}
+	return e.Error
+}
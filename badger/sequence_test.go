@@ -0,0 +1,101 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequence(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.SyncWrites = false // Leases must make it to the value log even then.
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+
+	key := []byte("seq")
+	_, err = kv.GetSequence(key, 0)
+	require.Equal(t, ErrZeroBandwidth, err)
+	seq, err := kv.GetSequence(key, 10)
+	require.NoError(t, err)
+	for i := 0; i < 25; i++ {
+		n, err := seq.Next()
+		require.NoError(t, err)
+		require.EqualValues(t, i, n)
+	}
+
+	// Don't close the KV, as if we crashed. The rest of the lease is lost, but nothing repeats.
+	kv.dirLock.release() // As if the process had died, so the directory can be opened again.
+	defer closeCrashed(kv)
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	seq, err = kv.GetSequence(key, 10)
+	require.NoError(t, err)
+	n, err := seq.Next()
+	require.NoError(t, err)
+	require.EqualValues(t, 30, n)
+
+	// Released integers are handed out again.
+	require.NoError(t, seq.Release())
+	seq, err = kv.GetSequence(key, 10)
+	require.NoError(t, err)
+	n, err = seq.Next()
+	require.NoError(t, err)
+	require.EqualValues(t, 31, n)
+	require.NoError(t, kv.Close())
+}
+
+func TestSequenceConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	seq, err := kv.GetSequence([]byte("seq"), 7)
+	require.NoError(t, err)
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				n, err := seq.Next()
+				require.NoError(t, err)
+				mu.Lock()
+				require.False(t, seen[n], "%d handed out twice", n)
+				seen[n] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1000, len(seen))
+	for i := uint64(0); i < 1000; i++ {
+		require.True(t, seen[i])
+	}
+}
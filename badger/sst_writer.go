@@ -0,0 +1,176 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+
+	"github.com/dgraph-io/badger/table"
+	"github.com/dgraph-io/badger/y"
+)
+
+// ErrUnsortedKeys is returned by SSTWriter.Add when a key is not bigger than the one before it.
+var ErrUnsortedKeys = errors.New("Keys must be added in increasing order")
+
+// ingestKey is the key of the value log entry which reserves the version of an SSTWriter, so the
+// version is not handed out again after a restart.
+var ingestKey = []byte("!badger!ingest")
+
+// SSTWriter builds a table file for KV.IngestFiles, from keys added in increasing order. All its
+// keys get the same version, reserved when the writer is created. Values which are too big to be
+// stored in the table go to the value log right away. Value log GC can drop them until the file
+// has been ingested, so files should be ingested soon after they are written.
+//
+// The table is built in memory, so files should be kept to around Options.MaxTableSize. An
+// SSTWriter is not safe for concurrent use.
+type SSTWriter struct {
+	kv      *KV
+	fd      *os.File
+	builder *table.TableBuilder
+	version uint64
+	lastKey []byte
+	pending []*Entry // Not added to the builder yet, as the big values need value log pointers.
+	size    int
+}
+
+// NewSSTWriter creates the file at path, which must not exist, and returns a writer for it.
+func (s *KV) NewSSTWriter(path string) (*SSTWriter, error) {
+	if s.opt.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	req := &request{
+		Entries: []*Entry{{Key: ingestKey, Meta: BitIngest, logAlways: true}},
+		ctx:     context.Background(),
+	}
+	if err := s.sendAndWait(req); err != nil {
+		return nil, err
+	}
+	builder, err := s.newTableBuilder()
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		builder.Close()
+		return nil, y.Wrapf(err, "Unable to create SST file: %s", path)
+	}
+	return &SSTWriter{
+		kv:      s,
+		fd:      fd,
+		builder: builder,
+		version: req.version,
+	}, nil
+}
+
+// Add adds key with value to the file. Keys must be added in increasing order, or
+// ErrUnsortedKeys is returned.
+func (w *SSTWriter) Add(key, value []byte, userMeta byte) error {
+	if w.lastKey != nil && bytes.Compare(key, w.lastKey) <= 0 {
+		return ErrUnsortedKeys
+	}
+	w.lastKey = y.Safecopy(nil, key)
+	e := &Entry{
+		Key:        w.lastKey,
+		Value:      y.Safecopy(nil, value),
+		UserMeta:   userMeta,
+		casCounter: w.version,
+		version:    w.version,
+	}
+	if len(value) >= w.kv.opt.ValueThreshold {
+		e.Meta = BitIngest
+		e.logAlways = true
+		w.size += len(value)
+	}
+	w.pending = append(w.pending, e)
+	if len(w.pending) >= 1000 || w.size >= 1<<20 {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush writes the big pending values to the value log, and adds the pending entries to the
+// builder.
+func (w *SSTWriter) flush() error {
+	req := &request{
+		ctx:         context.Background(),
+		version:     w.version,
+		keepVersion: true,
+	}
+	for _, e := range w.pending {
+		if e.Meta&BitIngest != 0 {
+			req.Entries = append(req.Entries, e)
+		}
+	}
+	if len(req.Entries) > 0 {
+		if err := w.kv.sendAndWait(req); err != nil {
+			return err
+		}
+	}
+
+	var offsetBuf [16]byte
+	var i int
+	for _, e := range w.pending {
+		vs := y.ValueStruct{
+			Value:      e.Value,
+			UserMeta:   e.UserMeta,
+			CASCounter: w.version,
+		}
+		if e.Meta&BitIngest != 0 {
+			vs.Value = req.Ptrs[i].Encode(offsetBuf[:])
+			vs.Meta = BitValuePointer
+			i++
+		}
+		if err := w.builder.Add(y.KeyWithTs(e.Key, w.version), vs); err != nil {
+			return err
+		}
+	}
+	w.pending = w.pending[:0]
+	w.size = 0
+	return nil
+}
+
+// Finish writes out the file and closes it. The file can then be passed to KV.IngestFiles. It
+// fails if no key has been added. If Add or Finish fail, the file should be removed.
+func (w *SSTWriter) Finish() error {
+	defer w.builder.Close()
+	if w.lastKey == nil {
+		w.fd.Close()
+		return y.Errorf("Unable to finish SST file %s: no keys were added", w.fd.Name())
+	}
+	if err := w.flush(); err != nil {
+		w.fd.Close()
+		return err
+	}
+	var metadata [2]byte // Level 0, until the file is ingested.
+	data, err := w.builder.Finish(metadata[:])
+	if err != nil {
+		w.fd.Close()
+		return err
+	}
+	if _, err := w.fd.Write(data); err != nil {
+		w.fd.Close()
+		return y.Wrapf(err, "Unable to write SST file: %s", w.fd.Name())
+	}
+	if err := w.fd.Sync(); err != nil {
+		w.fd.Close()
+		return y.Wrapf(err, "Unable to sync SST file: %s", w.fd.Name())
+	}
+	return w.fd.Close()
+}
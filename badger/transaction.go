@@ -0,0 +1,169 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger/y"
+)
+
+var (
+	// ErrConflict is returned by Txn.Commit when a key read by the transaction has been written
+	// since the transaction started. The transaction can be retried.
+	ErrConflict = errors.New("Transaction conflict. Please retry")
+
+	// ErrReadOnlyTxn is returned when Set or Delete is called on a read-only transaction.
+	ErrReadOnlyTxn = errors.New("No sets or deletes are allowed in a read-only transaction")
+
+	// ErrDiscardedTxn is returned when a transaction is used after Commit or Discard.
+	ErrDiscardedTxn = errors.New("This transaction has been discarded. Create a new one")
+)
+
+// txnKey is the key of the entry which marks the end of a transaction in the value log. It never
+// makes it into the LSM tree.
+var txnKey = []byte("!badger!txn")
+
+// Txn is a transaction. It reads a snapshot of the KV as of the time it was created, and buffers
+// its writes until Commit. Commit applies all the writes at a single version, or none of them, if
+// any key read by an update transaction has been written in the meantime. A Txn is not safe for
+// concurrent use.
+type Txn struct {
+	kv        *KV
+	readTs    uint64
+	update    bool
+	discarded bool
+
+	reads  [][]byte          // Keys read by an update transaction.
+	writes map[string]*Entry // Pending writes, by key.
+}
+
+// NewTransaction creates a new transaction, which reads as of KV.Version(). Set update to true
+// if the transaction would write. Read-only transactions don't track reads, and never conflict.
+func (s *KV) NewTransaction(update bool) *Txn {
+	txn := &Txn{
+		kv:     s,
+		readTs: s.Version(),
+		update: update,
+	}
+	if update {
+		txn.writes = make(map[string]*Entry)
+	}
+	return txn
+}
+
+// ReadTs returns the version the transaction reads at. It can be used as IteratorOptions.ReadTs
+// to iterate over the same snapshot, but such reads are not checked for conflicts.
+func (txn *Txn) ReadTs() uint64 {
+	return txn.readTs
+}
+
+// Get looks for key and returns its value. A value set in this transaction is returned as is,
+// otherwise the value is read as of ReadTs. If key is not found, value returned is nil.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if txn.discarded {
+		return nil, ErrDiscardedTxn
+	}
+	if txn.update {
+		if e, ok := txn.writes[string(key)]; ok {
+			if e.Meta&BitDelete != 0 {
+				return nil, nil
+			}
+			return e.Value, nil
+		}
+		txn.reads = append(txn.reads, y.Safecopy(nil, key))
+	}
+	val, _, err := txn.kv.GetAt(key, txn.readTs)
+	return val, err
+}
+
+// Set buffers a write of val to key, to be applied on Commit. Neither key nor val should be
+// modified until then.
+func (txn *Txn) Set(key, val []byte) error {
+	return txn.modify(&Entry{Key: key, Value: val})
+}
+
+// Delete buffers a deletion of key, to be applied on Commit.
+func (txn *Txn) Delete(key []byte) error {
+	return txn.modify(&Entry{Key: key, Meta: BitDelete})
+}
+
+func (txn *Txn) modify(e *Entry) error {
+	if txn.discarded {
+		return ErrDiscardedTxn
+	}
+	if !txn.update {
+		return ErrReadOnlyTxn
+	}
+	txn.writes[string(e.Key)] = e
+	return nil
+}
+
+// Commit writes all the buffered writes in a single request, at a single version. It returns
+// ErrConflict if any key read by the transaction has been written since the transaction
+// started, in which case none of the writes are applied. The transaction is discarded either
+// way.
+func (txn *Txn) Commit() error {
+	if txn.discarded {
+		return ErrDiscardedTxn
+	}
+	defer txn.Discard()
+	if len(txn.writes) == 0 {
+		return nil // Nothing to do.
+	}
+	if txn.kv.opt.ReadOnly {
+		return ErrReadOnly
+	}
+
+	entries := make([]*Entry, 0, len(txn.writes)+1)
+	for _, e := range txn.writes {
+		e.Meta |= BitTxn
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+	entries = append(entries, &Entry{Key: txnKey, Meta: BitFinTxn})
+
+	reads := txn.reads
+	if reads == nil {
+		reads = [][]byte{} // Non-nil, so the writer knows this is a transaction.
+	}
+	req := &request{
+		Entries: entries,
+		Wg:      sync.WaitGroup{},
+		ctx:     context.Background(),
+		reads:   reads,
+		readTs:  txn.readTs,
+	}
+	req.Wg.Add(1)
+	txn.kv.writeCh <- req
+	req.Wg.Wait()
+	return req.Err
+}
+
+// Discard drops the buffered writes. It is a no-op if the transaction has already been
+// committed or discarded, so it is safe to defer right after NewTransaction.
+func (txn *Txn) Discard() {
+	txn.discarded = true
+	txn.writes = nil
+	txn.reads = nil
+}
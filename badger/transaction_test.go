@@ -0,0 +1,202 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxnBasic(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	require.NoError(t, kv.Set([]byte("a"), []byte("a0")))
+
+	txn := kv.NewTransaction(true)
+	val, err := txn.Get([]byte("a"))
+	require.NoError(t, err)
+	require.EqualValues(t, "a0", string(val))
+	require.NoError(t, txn.Set([]byte("a"), []byte("a1")))
+	require.NoError(t, txn.Set([]byte("b"), []byte("b1")))
+	require.NoError(t, txn.Delete([]byte("c")))
+
+	// Own writes are visible to the transaction, but not to anyone else until commit.
+	val, err = txn.Get([]byte("a"))
+	require.NoError(t, err)
+	require.EqualValues(t, "a1", string(val))
+	val, _, err = kv.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Nil(t, val)
+
+	before := kv.Version()
+	require.NoError(t, txn.Commit())
+	require.Equal(t, before+1, kv.Version(), "A commit should take a single version.")
+	val, _, err = kv.Get([]byte("a"))
+	require.NoError(t, err)
+	require.EqualValues(t, "a1", string(val))
+	val, _, err = kv.Get([]byte("b"))
+	require.NoError(t, err)
+	require.EqualValues(t, "b1", string(val))
+	val, _, err = kv.Get(txnKey)
+	require.NoError(t, err)
+	require.Nil(t, val)
+
+	require.Equal(t, ErrDiscardedTxn, txn.Set([]byte("a"), []byte("a2")))
+	require.Equal(t, ErrDiscardedTxn, txn.Commit())
+
+	ro := kv.NewTransaction(false)
+	defer ro.Discard()
+	require.Equal(t, ErrReadOnlyTxn, ro.Set([]byte("a"), []byte("a2")))
+}
+
+func TestTxnConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	require.NoError(t, kv.Set([]byte("balance"), []byte("10")))
+
+	txn1 := kv.NewTransaction(true)
+	txn2 := kv.NewTransaction(true)
+	_, err = txn1.Get([]byte("balance"))
+	require.NoError(t, err)
+	_, err = txn2.Get([]byte("balance"))
+	require.NoError(t, err)
+	require.NoError(t, txn1.Set([]byte("balance"), []byte("5")))
+	require.NoError(t, txn2.Set([]byte("balance"), []byte("7")))
+	require.NoError(t, txn2.Set([]byte("other"), []byte("7")))
+
+	require.NoError(t, txn1.Commit())
+	require.Equal(t, ErrConflict, txn2.Commit())
+
+	val, _, err := kv.Get([]byte("balance"))
+	require.NoError(t, err)
+	require.EqualValues(t, "5", string(val))
+	val, _, err = kv.Get([]byte("other"))
+	require.NoError(t, err)
+	require.Nil(t, val)
+
+	// Blind writes, and reads of keys nobody else wrote, don't conflict.
+	txn3 := kv.NewTransaction(true)
+	txn4 := kv.NewTransaction(true)
+	_, err = txn4.Get([]byte("unrelated"))
+	require.NoError(t, err)
+	require.NoError(t, txn3.Set([]byte("balance"), []byte("3")))
+	require.NoError(t, txn4.Set([]byte("balance"), []byte("4")))
+	require.NoError(t, txn3.Commit())
+	require.NoError(t, txn4.Commit())
+}
+
+func TestTxnConcurrentIncrement(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	key := []byte("counter")
+	incr := func() error {
+		for {
+			txn := kv.NewTransaction(true)
+			val, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			var n int
+			if val != nil {
+				fmt.Sscanf(string(val), "%d", &n)
+			}
+			if err := txn.Set(key, []byte(fmt.Sprintf("%d", n+1))); err != nil {
+				return err
+			}
+			if err = txn.Commit(); err != ErrConflict {
+				return err
+			}
+		}
+	}
+
+	errCh := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 20; j++ {
+				if err := incr(); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- nil
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, <-errCh)
+	}
+	val, _, err := kv.Get(key)
+	require.NoError(t, err)
+	require.EqualValues(t, "200", string(val))
+}
+
+func TestTxnReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opt := getTestOptions(dir)
+	opt.SyncWrites = false // Transactions must go to the value log even then.
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+
+	txn := kv.NewTransaction(true)
+	require.NoError(t, txn.Set([]byte("a"), []byte("a1")))
+	require.NoError(t, txn.Set([]byte("b"), []byte("b1")))
+	require.NoError(t, txn.Commit())
+
+	txn = kv.NewTransaction(true)
+	require.NoError(t, txn.Set([]byte("a"), []byte("a2")))
+	require.NoError(t, txn.Set([]byte("b"), []byte("b2")))
+	require.NoError(t, txn.Commit())
+
+	// Cut the value log right before the entry which ends the second transaction, as if we
+	// crashed while writing it. Don't close the KV, so the memtable doesn't get flushed.
+	kv.RLock()
+	last := kv.vptr
+	kv.RUnlock()
+	require.NoError(t, os.Truncate(kv.vlog.fpath(int32(last.Fid)), int64(last.Offset)))
+	kv.dirLock.release() // As if the process had died, so the directory can be opened again.
+	defer closeCrashed(kv)
+
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	for _, k := range []string{"a", "b"} {
+		val, _, err := kv.Get([]byte(k))
+		require.NoError(t, err)
+		require.EqualValues(t, k+"1", string(val))
+	}
+}
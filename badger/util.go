@@ -1,18 +1,23 @@
 package badger
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
+	"math"
 	"sort"
 	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/badger/table"
 	"github.com/dgraph-io/badger/y"
 )
 
+// isExpired returns true if a value with the given expiry has expired. Zero means it never does.
+func isExpired(expiresAt uint64) bool {
+	return expiresAt != 0 && expiresAt <= uint64(time.Now().Unix())
+}
+
 // summary is produced when DB is closed. Currently it is used only for testing.
 type summary struct {
 	fileIDs map[uint64]bool
@@ -54,10 +59,10 @@ func (s *levelHandler) validate() {
 	numTables := len(s.tables)
 	for j := 1; j < numTables; j++ {
 		y.AssertTruef(j < len(s.tables), "Level %d, j=%d numTables=%d", s.level, j, numTables)
-		y.AssertTruef(bytes.Compare(s.tables[j-1].Biggest(), s.tables[j].Smallest()) < 0,
+		y.AssertTruef(y.CompareKeys(s.tables[j-1].Biggest(), s.tables[j].Smallest()) < 0,
 			"Inter: %s vs %s: level=%d j=%d numTables=%d",
 			string(s.tables[j-1].Biggest()), string(s.tables[j].Smallest()), s.level, j, numTables)
-		y.AssertTruef(bytes.Compare(s.tables[j].Smallest(), s.tables[j].Biggest()) <= 0,
+		y.AssertTruef(y.CompareKeys(s.tables[j].Smallest(), s.tables[j].Biggest()) <= 0,
 			"Intra: %s vs %s: level=%d j=%d numTables=%d",
 			string(s.tables[j].Smallest()), string(s.tables[j].Biggest()), s.level, j, numTables)
 	}
@@ -120,9 +125,11 @@ func (s *levelsController) reserveCompactID() uint64 {
 	return atomic.AddUint64(&s.maxCompactID, 1)
 }
 
-func getIDMap(dir string) map[uint64]struct{} {
+func getIDMap(dir string) (map[uint64]struct{}, error) {
 	fileInfos, err := ioutil.ReadDir(dir)
-	y.Check(err)
+	if err != nil {
+		return nil, err
+	}
 	idMap := make(map[uint64]struct{})
 	for _, info := range fileInfos {
 		if info.IsDir() {
@@ -134,7 +141,7 @@ func getIDMap(dir string) map[uint64]struct{} {
 		}
 		idMap[fileID] = struct{}{}
 	}
-	return idMap
+	return idMap, nil
 }
 
 func keyRange(tables []*table.Table) ([]byte, []byte) {
@@ -142,10 +149,10 @@ func keyRange(tables []*table.Table) ([]byte, []byte) {
 	smallest := tables[0].Smallest()
 	biggest := tables[0].Biggest()
 	for i := 1; i < len(tables); i++ {
-		if bytes.Compare(tables[i].Smallest(), smallest) < 0 {
+		if y.CompareKeys(tables[i].Smallest(), smallest) < 0 {
 			smallest = tables[i].Smallest()
 		}
-		if bytes.Compare(tables[i].Biggest(), biggest) > 0 {
+		if y.CompareKeys(tables[i].Biggest(), biggest) > 0 {
 			biggest = tables[i].Biggest()
 		}
 	}
@@ -154,29 +161,16 @@ func keyRange(tables []*table.Table) ([]byte, []byte) {
 
 // overlappingTables returns the tables that intersect with key range.
 // The input tables have to be sorted and non-overlapping.
-// Returns a half-interval.
+// Returns a half-interval. The range is widened to cover all versions of begin and end, as
+// compactions never split the versions of a key across tables.
 func overlappingTables(begin, end []byte, tables []*table.Table) (int, int) {
+	begin = y.KeyWithTs(y.ParseKey(begin), math.MaxUint64)
+	end = y.KeyWithTs(y.ParseKey(end), 0)
 	left := sort.Search(len(tables), func(i int) bool {
-		return bytes.Compare(tables[i].Biggest(), begin) >= 0
+		return y.CompareKeys(tables[i].Biggest(), begin) >= 0
 	})
 	right := sort.Search(len(tables), func(i int) bool {
-		return bytes.Compare(tables[i].Smallest(), end) > 0
+		return y.CompareKeys(tables[i].Smallest(), end) > 0
 	})
 	return left, right
 }
-
-// mod65535 mods by 65535 fast.
-func mod65535(a uint32) uint32 {
-	a = (a >> 16) + (a & 0xFFFF) /* sum base 2**16 digits */
-	if a < 65535 {
-		return a
-	}
-	if a < (2 * 65535) {
-		return a - 65535
-	}
-	return a - (2 * 65535)
-}
-
-func newCASCounter() uint16 {
-	return uint16(1 + mod65535(rand.Uint32()))
-}
@@ -19,35 +19,43 @@ package badger
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
-	"math/rand"
+	"math"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/trace"
 
+	"github.com/dgraph-io/badger/table"
 	"github.com/dgraph-io/badger/y"
-
-	"github.com/bkaradzic/go-lz4"
 )
 
 // Values have their first byte being byteData or byteDelete. This helps us distinguish between
 // a key that has never been seen and a key that has been explicitly deleted.
 const (
-	BitDelete       byte  = 1 // Set if the key has been deleted.
-	BitValuePointer byte  = 2 // Set if the value is NOT stored directly next to key.
-	BitCompressed   byte  = 4 // Set if the key value pair is stored compressed in value log.
-	LogSize         int64 = 1 << 30
-	M               int   = 1 << 20
+	BitDelete       byte = 1   // Set if the key has been deleted.
+	BitValuePointer byte = 2   // Set if the value is NOT stored directly next to key.
+	BitCompressed   byte = 4   // Set if the key value pair is stored compressed in value log.
+	BitTxn          byte = 8   // Set on the entries of a transaction, in value log only.
+	BitFinTxn       byte = 16  // Set on the entry which marks the end of a transaction.
+	BitRangeDelete  byte = 32  // Set on range tombstones. See DeleteRange.
+	BitMergeOperand byte = 64  // Set if the value is an operand to be merged. See KV.Merge.
+	BitIngest       byte = 128 // Set on values written by an SSTWriter, in value log only.
+	M               int  = 1 << 20
 )
 
 var Corrupt error = errors.New("Unable to find log. Potential data corruption.")
@@ -60,125 +68,340 @@ type logFile struct {
 	fid    int32
 	offset int64
 	size   int64
+
+	// The format version the file was written in. See checkFormat.
+	format int
+
+	// Decrypts and encrypts the entries, if the file is encrypted. See readHeader.
+	dataKey cipher.Block
+	iv      uint64
+
+	// Set with Options.ValueLogLoadingMode of table.MemoryMap. The file being written to is mapped
+	// past its end, and mapped again if it outgrows that.
+	mmap []byte
+
+	// Set once the file is no longer written to. Its mapping then stays as it is until the file
+	// is closed, so reads can point into it. See read.
+	sealed bool
+
+	// One reference is held by valueLog.files, and one by every read in flight. See getFile.
+	ref int32
+}
+
+func (lf *logFile) incrRef() {
+	atomic.AddInt32(&lf.ref, 1)
+}
+
+// decrRef closes the file once it has been removed from valueLog.files by value log GC, and the
+// reads in flight are done.
+func (lf *logFile) decrRef() error {
+	if atomic.AddInt32(&lf.ref, -1) > 0 {
+		return nil
+	}
+	lf.Lock()
+	defer lf.Unlock()
+	return lf.close()
 }
 
 // openReadOnly assumes that we have a write lock on logFile.
-func (lf *logFile) openReadOnly() {
+func (lf *logFile) openReadOnly() error {
 	var err error
 	lf.fd, err = os.OpenFile(lf.path, os.O_RDONLY, 0666)
-	y.Check(err)
+	if err != nil {
+		return y.Wrapf(err, "Unable to open %q as RDONLY.", lf.path)
+	}
 
 	fi, err := lf.fd.Stat()
-	y.Check(err)
+	if err != nil {
+		return y.Wrapf(err, "Unable to check stat for %q", lf.path)
+	}
 	lf.size = fi.Size()
+	lf.sealed = true
+	return nil
 }
 
-func (lf *logFile) read(buf []byte, offset int64) error {
+// read reads the n bytes at offset. If shared is set and the file is sealed, bytes which are mapped
+// are returned from the mapping, which stays valid for as long as the caller holds a reference to
+// the file. Otherwise they are copied into s, so the mapping can go away once the file is closed,
+// while the values read from it are still in use. mapped tells which of the two it was.
+func (lf *logFile) read(offset int64, n int, s *y.Slice, shared bool) (
+	buf []byte, mapped bool, err error) {
 	lf.RLock()
 	defer lf.RUnlock()
 
-	_, err := lf.fd.ReadAt(buf, offset)
-	return err
+	if offset+int64(n) <= int64(len(lf.mmap)) {
+		if shared && lf.sealed {
+			return lf.mmap[offset : offset+int64(n)], true, nil
+		}
+		buf = s.Resize(n)
+		copy(buf, lf.mmap[offset:])
+		return buf, false, nil
+	}
+	buf = s.Resize(n)
+	_, err = lf.fd.ReadAt(buf, offset)
+	return buf, false, err
+}
+
+// mmapFile maps the first size bytes of the file, which may be more than it has, in place of the
+// mapping it had, if any.
+func (lf *logFile) mmapFile(size int64) error {
+	if size == 0 {
+		return nil // Can't be mapped, and has nothing to read anyway.
+	}
+	mmap, err := syscall.Mmap(int(lf.fd.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return y.Wrapf(err, "Unable to map value log file: %q", lf.path)
+	}
+	if err := lf.munmap(); err != nil {
+		syscall.Munmap(mmap)
+		return err
+	}
+	lf.mmap = mmap
+	return nil
+}
+
+func (lf *logFile) munmap() error {
+	if lf.mmap == nil {
+		return nil
+	}
+	if err := syscall.Munmap(lf.mmap); err != nil {
+		return y.Wrapf(err, "Unable to unmap value log file: %q", lf.path)
+	}
+	lf.mmap = nil
+	return nil
 }
 
-func (lf *logFile) doneWriting() {
+// close unmaps and closes the file.
+func (lf *logFile) close() error {
+	if err := lf.munmap(); err != nil {
+		return err
+	}
+	return lf.fd.Close()
+}
+
+// doneWriting reopens the file read-only. The mapping stays as it is.
+func (lf *logFile) doneWriting() error {
 	lf.Lock()
 	defer lf.Unlock()
-	y.Check(lf.fd.Close())
+	if err := lf.fd.Close(); err != nil {
+		return y.Wrapf(err, "Unable to close value log: %q", lf.path)
+	}
+	return lf.openReadOnly()
+}
+
+// From format version 5 on, value log files start with a header of the ID of the data key they
+// are encrypted with, 0 if they aren't, and the base IV. Everything but the checksum of an entry
+// is encrypted, at its offset in the file. See y.XORKeyStream.
+const vlogHeaderSize = 8 + 8
+
+// dataStart returns the offset of the first entry in the file.
+func (lf *logFile) dataStart() int64 {
+	if lf.format >= 5 {
+		return vlogHeaderSize
+	}
+	return 0
+}
+
+// readHeader reads the header of a file in format version 5 or later, and looks up its data key.
+func (lf *logFile) readHeader(registry *keyRegistry) error {
+	var buf [vlogHeaderSize]byte
+	if _, err := lf.fd.ReadAt(buf[:], 0); err != nil {
+		return y.Wrapf(err, "Unable to read header of value log file: %q", lf.path)
+	}
+	var err error
+	if keyID := binary.BigEndian.Uint64(buf[0:8]); keyID != 0 {
+		if lf.dataKey, err = registry.cipher(keyID); err != nil {
+			return y.Wrapf(err, "While opening value log file: %q", lf.path)
+		}
+	}
+	lf.iv = binary.BigEndian.Uint64(buf[8:16])
+	return nil
+}
+
+// writeHeader writes the header of a new file, which is encrypted with key unless it is nil.
+func (lf *logFile) writeHeader(key *dataKey) error {
+	var buf [vlogHeaderSize]byte
+	if key != nil {
+		if _, err := rand.Read(buf[8:16]); err != nil {
+			return y.Wrapf(err, "Unable to generate IV")
+		}
+		binary.BigEndian.PutUint64(buf[0:8], key.id)
+		lf.dataKey, lf.iv = key.block, binary.BigEndian.Uint64(buf[8:16])
+	}
+	if _, err := lf.fd.WriteAt(buf[:], 0); err != nil {
+		return y.Wrapf(err, "Unable to write header of value log file: %q", lf.path)
+	}
+	// Entries are appended with Write.
+	var err error
+	lf.offset, err = lf.fd.Seek(vlogHeaderSize, io.SeekStart)
+	return y.Wrapf(err, "Unable to seek in value log file: %q", lf.path)
+}
 
-	lf.openReadOnly()
+// xorKeyStream encrypts or decrypts src, found at offset in the file, into dst. The file must be
+// encrypted.
+func (lf *logFile) xorKeyStream(dst, src []byte, offset int64) {
+	y.XORKeyStream(dst, src, lf.dataKey, lf.iv, offset)
 }
 
 type logEntry func(e Entry) bool
 
+// badRecordError is returned by iterateLog for an entry which is cut short by the end of the log
+// file, or whose checksum doesn't match. After a crash, this is what a torn write looks like at
+// the end of the last file.
+type badRecordError struct {
+	path   string
+	offset int64 // Where the entry starts.
+	next   int64 // Where the entry after it starts, or -1 if there is none.
+	reason string
+}
+
+func (e *badRecordError) Error() string {
+	return fmt.Sprintf("Bad value log entry at offset %d in %q: %s", e.offset, e.path, e.reason)
+}
+
 // iterate iterates over log file. It doesn't not allocate new memory for every kv pair.
 // Therefore, the kv pair is only valid for the duration of fn call.
 func (f *logFile) iterate(offset int64, fn logEntry) error {
-	_, err := f.fd.Seek(offset, 0)
-	y.Check(err)
-
-	read := func(r *bufio.Reader, buf []byte) error {
-		for {
-			n, err := r.Read(buf)
-			if err != nil {
-				return err
-			}
-			if n == len(buf) {
-				return nil
-			}
-			buf = buf[n:]
-		}
+	if start := f.dataStart(); offset < start {
+		offset = start
 	}
+	fi, err := f.fd.Stat()
+	if err != nil {
+		return y.Wrapf(err, "Unable to check stat for %q", f.path)
+	}
+	if _, err = f.fd.Seek(offset, io.SeekStart); err != nil {
+		return y.Wrapf(err, "Unable to seek to offset %d in %q", offset, f.path)
+	}
+	return iterateLog(f.fd, f, offset, fi.Size(), fn)
+}
 
-	reader := bufio.NewReader(f.fd)
-	var hbuf [13]byte
+// iterateLog is like logFile.iterate, but reads the entries of f from r, which is at offset in
+// the file, up to end. Only the path, format version and encryption of f are used.
+func iterateLog(r io.Reader, f *logFile, offset, end int64, fn logEntry) error {
+	path, format := f.path, f.format
+	reader := bufio.NewReader(r)
+	var hbuf, hdec [headerBufSize]byte
+	var crcBuf [crcSize]byte
 	var h header
-	var count int
-	k := make([]byte, 1<<10)
-	v := make([]byte, 1<<20)
+	buf := make([]byte, 1<<20)
 	decompressed := make([]byte, 1<<20)
+	checksum := format >= 3
+	var trailer int64
+	if checksum {
+		trailer = crcSize
+	}
 
 	var e Entry
-	var hlen int
 	recordOffset := offset
-	for {
-		if err = read(reader, hbuf[:]); err == io.EOF {
-			break
+	for recordOffset < end {
+		// Check the lengths against the file before trusting them with an allocation.
+		if end-recordOffset < headerBufSize+trailer {
+			return &badRecordError{path, recordOffset, -1, "header cut short"}
+		}
+		if _, err := io.ReadFull(reader, hbuf[:]); err != nil {
+			return y.Wrapf(err, "Unable to read entry at offset %d in %q", recordOffset, path)
+		}
+		if f.dataKey != nil {
+			f.xorKeyStream(hdec[:], hbuf[:], recordOffset)
+			h.Decode(hdec[:])
+		} else {
+			h.Decode(hbuf[:])
+		}
+		payloadLen := int64(h.vlen)
+		if h.meta&BitCompressed == 0 {
+			payloadLen += int64(h.klen)
+		}
+		recordLen := headerBufSize + payloadLen + trailer
+		if recordLen > end-recordOffset {
+			return &badRecordError{path, recordOffset, -1, "entry cut short"}
 		}
 
-		e.offset = recordOffset
-		_, hlen = h.Decode(hbuf[:])
-		// fmt.Printf("[%d] Header read: %+v\n", count, h)
-		vl := int(h.vlen)
-		if cap(v) < vl {
-			v = make([]byte, 2*vl)
+		if int64(cap(buf)) < payloadLen {
+			buf = make([]byte, 2*payloadLen)
+		}
+		payload := buf[:payloadLen]
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return y.Wrapf(err, "Unable to read entry at offset %d in %q", recordOffset, path)
+		}
+		if checksum {
+			if _, err := io.ReadFull(reader, crcBuf[:]); err != nil {
+				return y.Wrapf(err, "Unable to read entry at offset %d in %q", recordOffset, path)
+			}
+			crc := crc32.Update(crc32.Checksum(hbuf[:], castagnoli), castagnoli, payload)
+			if crc != binary.BigEndian.Uint32(crcBuf[:]) {
+				return &badRecordError{path, recordOffset, recordOffset + recordLen,
+					"checksum mismatch"}
+			}
+		}
+		if f.dataKey != nil {
+			f.xorKeyStream(payload, payload, recordOffset+headerBufSize)
 		}
 
+		e.fid = f.fid
+		e.offset = recordOffset
+		e.size = recordLen
+		e.Meta = h.meta
+		e.UserMeta = h.userMeta
+		e.casCounter = h.casCounter
+		e.CASCounterCheck = h.casCounterCheck
+		e.version = h.version
+		e.ExpiresAt = h.expiresAt
 		if h.meta&BitCompressed > 0 { // entry is compressed
-			if err = read(reader, v[:vl]); err != nil {
-				return err
+			var err error
+			decompressed, err = decompress(decompressed, payload, format)
+			if err != nil {
+				return y.Wrapf(err, "Unable to decompress entry at offset %d in %q",
+					recordOffset, path)
+			}
+			if len(decompressed) < int(h.klen) {
+				return y.Errorf("Corrupt entry at offset %d in %q: decoded length %d, key length %d",
+					recordOffset, path, len(decompressed), h.klen)
 			}
-			decompressed, err = lz4.Decode(decompressed, v[:vl])
-
-			e.Meta = h.meta
-			e.casCounter = h.casCounter
-			e.CASCounterCheck = h.casCounterCheck
 			e.Key = decompressed[:h.klen]
 			e.Value = decompressed[h.klen:]
-
-			recordOffset += int64(hlen + vl)
 		} else {
-			kl := int(h.klen)
-			if cap(k) < kl {
-				k = make([]byte, 2*kl)
-			}
-			e.Key = k[:kl]
-			e.Value = v[:vl]
-
-			if err = read(reader, e.Key); err != nil {
-				return err
-			}
-			e.Meta = h.meta
-			e.casCounter = h.casCounter
-			e.CASCounterCheck = h.casCounterCheck
-			if err = read(reader, e.Value); err != nil {
-				return err
-			}
-
-			recordOffset += int64(hlen + kl + vl)
+			e.Key = payload[:h.klen]
+			e.Value = payload[h.klen:]
 		}
+		recordOffset += recordLen
 
 		if !fn(e) {
 			break
 		}
-		count++
 	}
 	return nil
 }
 
-var entries = make([]*Entry, 0, 1000000)
+// rewriteBatchSize is how many bytes of moved entries value log GC holds before writing them back.
+const rewriteBatchSize = 64 << 20
 
-func (vlog *valueLog) rewrite(f *logFile) {
+// entryValue looks up the value of the key and version of e in the LSM tree. It returns discard
+// as true if e is no longer needed: either it has expired, a newer version of the key or a range
+// tombstone is visible at the discard watermark, or this version has been dropped from the LSM
+// tree.
+func (vlog *valueLog) entryValue(e Entry) (vs y.ValueStruct, discard bool, err error) {
+	if isExpired(e.ExpiresAt) {
+		return vs, true, nil
+	}
+	newest, err := vlog.kv.get(y.KeyWithTs(e.Key, vlog.kv.discardTs()))
+	if err != nil {
+		return vs, false, err
+	}
+	// Older versions are still needed to fold merge operands.
+	if newest.Version > e.version && newest.Meta&BitMergeOperand == 0 {
+		return vs, true, nil
+	}
+	if vlog.kv.rangeDels.covers(e.Key, e.version, vlog.kv.discardTs()) {
+		return vs, true, nil
+	}
+	vs, err = vlog.kv.get(y.KeyWithTs(e.Key, e.version))
+	if err != nil {
+		return vs, false, err
+	}
+	return vs, vs.Version != e.version, nil
+}
+
+func (vlog *valueLog) rewrite(f *logFile) error {
 	maxFid := atomic.LoadInt32(&vlog.maxFid)
 	y.AssertTruef(f.fid < maxFid, "fid to move: %d. Current max fid: %d", f.fid, maxFid)
 
@@ -187,21 +410,27 @@ func (vlog *valueLog) rewrite(f *logFile) {
 	elog.Printf("Rewriting fid: %d", f.fid)
 	y.Printf("rewrite called\n")
 
-	entries = entries[:0]
 	y.AssertTrue(vlog.kv != nil)
-	var count int
-	fe := func(e Entry) {
+	var entries []*Entry
+	var count, batchSize int
+	fe := func(e Entry) error {
 		count++
 		if count%10000 == 0 {
 			elog.Printf("Processing entry %d", count)
 		}
 
-		vs := vlog.kv.get(e.Key)
+		vs, discard, err := vlog.entryValue(e)
+		if err != nil {
+			return err
+		}
+		if discard {
+			return nil
+		}
 		if (vs.Meta & BitDelete) > 0 {
-			return
+			return nil
 		}
 		if (vs.Meta & BitValuePointer) == 0 {
-			return
+			return nil
 		}
 
 		// Value is still present in value log.
@@ -210,87 +439,209 @@ func (vlog *valueLog) rewrite(f *logFile) {
 		vp.Decode(vs.Value)
 
 		if int32(vp.Fid) > f.fid {
-			return
+			return nil
 		}
 		if int64(vp.Offset) > e.offset {
-			return
+			return nil
 		}
 		if int32(vp.Fid) == f.fid && int64(vp.Offset) == e.offset {
-			// This new entry only contains the key, and a pointer to the value.
+			// This new entry only contains the key, and a pointer to the value. It keeps its version
+			// and CAS counter. See writeToKV for the newer versions of the key.
 			var ne Entry
-			y.AssertTruef(e.Meta&^BitCompressed == 0, "Got meta: %v", e.Meta)
-			ne.Meta = e.Meta & (^BitCompressed)
+			// It has been committed, so it no longer needs to be part of a transaction.
+			y.AssertTruef(e.Meta&^(BitCompressed|BitTxn|BitMergeOperand|BitIngest) == 0,
+				"Got meta: %v", e.Meta)
+			ne.Meta = e.Meta &^ (BitCompressed | BitTxn | BitIngest)
+			ne.UserMeta = e.UserMeta
 			ne.Key = make([]byte, len(e.Key))
 			copy(ne.Key, e.Key)
 			ne.Value = make([]byte, len(e.Value))
 			copy(ne.Value, e.Value)
-			ne.CASCounterCheck = vs.CASCounter // CAS counter check. Do not rewrite if key has a newer value.
+			ne.casCounter = e.casCounter
+			ne.version = e.version
+			ne.ExpiresAt = e.ExpiresAt
 			entries = append(entries, &ne)
+			if batchSize += len(ne.Key) + len(ne.Value); batchSize >= rewriteBatchSize {
+				if err := vlog.writeToKV(entries, elog); err != nil {
+					return err
+				}
+				entries, batchSize = nil, 0
+			}
 
 		} else {
-			// This can now happen because we can move some entries forward, but then not write
-			// them to LSM tree due to CAS check failure.
-			// y.Fatalf("This shouldn't happen. Latest Pointer:%+v. Meta:%v.", vp, vs.Meta)
+			// This version has already been moved to a later position. Nothing to do.
 		}
+		return nil
 	}
 
-	f.iterate(0, func(e Entry) bool {
-		fe(e)
-		return true
+	var feErr error
+	err := f.iterate(0, func(e Entry) bool {
+		feErr = fe(e)
+		return feErr == nil
 	})
+	if err != nil {
+		return err
+	}
+	if feErr != nil {
+		return feErr
+	}
 	elog.Printf("Processed %d entries in total", count)
-	// Sort the entries, so lookups can potentially use page cache better.
-	sort.Slice(entries, func(i, j int) bool {
-		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
-	})
-	vlog.writeToKV(elog)
+	if err := vlog.writeToKV(entries, elog); err != nil {
+		return err
+	}
 
 	elog.Printf("Removing fid: %d", f.fid)
 	// Entries written to LSM. Remove the older file now.
 	{
-		vlog.RLock()
+		vlog.Lock()
 		idx := sort.Search(len(vlog.files), func(idx int) bool {
 			return vlog.files[idx].fid >= f.fid
 		})
 		if idx == len(vlog.files) || vlog.files[idx].fid != f.fid {
-			y.Fatalf("Unable to find fid: %d", f.fid)
+			vlog.Unlock()
+			return y.Errorf("Unable to find fid: %d", f.fid)
 		}
 		vlog.files = append(vlog.files[:idx], vlog.files[idx+1:]...)
-		vlog.RUnlock()
+		vlog.Unlock()
 	}
 
 	rem := vlog.fpath(f.fid)
 	elog.Printf("Removing %s", rem)
-	y.Check(os.Remove(rem))
-}
-
-func (vlog *valueLog) writeToKV(elog trace.EventLog) {
-	req := &request{
-		Wg:      sync.WaitGroup{},
-		Entries: make([]*Entry, 0, 1000),
-	}
-	requests := make([]*request, 0, 10)
-	requests = append(requests, req)
-	for _, e := range entries {
-		req.Entries = append(req.Entries, e)
-		if len(req.Entries) >= 1000 {
-			req = &request{
-				Wg:      sync.WaitGroup{},
-				Entries: make([]*Entry, 0, 1000),
+	if err := os.Remove(rem); err != nil {
+		return err
+	}
+	// The reads in flight keep the file open, and the last one closes it.
+	if err := f.decrRef(); err != nil {
+		return err
+	}
+	return vlog.discards.remove(f.fid)
+}
+
+// addDiscards adds the number of bytes per value log file taken by entries a compaction dropped
+// the keys of. Files which have been garbage collected already are left out.
+func (l *valueLog) addDiscards(discards map[int32]int64) error {
+	for fid := range discards {
+		lf, err := l.getFile(fid)
+		if err != nil {
+			delete(discards, fid)
+			continue
+		}
+		if err := lf.decrRef(); err != nil {
+			return err
+		}
+	}
+	return l.discards.add(discards)
+}
+
+// writeToKV writes the moved entries back, along with the newer versions of their keys. A moved
+// entry goes to the memtable, where it would shadow the newer versions in the levels below, as
+// lookups stop at the first version they find. It all runs on the writer goroutine, so no other
+// write comes in between.
+func (vlog *valueLog) writeToKV(entries []*Entry, elog trace.EventLog) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return vlog.kv.runExclusive(func() error {
+		entries, err := vlog.addNewerVersions(entries)
+		if err != nil {
+			return err
+		}
+		return vlog.writeEntries(entries, elog)
+	})
+}
+
+// addNewerVersions returns entries, with the versions of their keys newer than the oldest one
+// moved added, unless they are being moved themselves.
+func (vlog *valueLog) addNewerVersions(entries []*Entry) ([]*Entry, error) {
+	// By key, and oldest first, so a memtable which fills up midway gets the older versions.
+	less := func(i, j int) bool {
+		if c := bytes.Compare(entries[i].Key, entries[j].Key); c != 0 {
+			return c < 0
+		}
+		return entries[i].version < entries[j].version
+	}
+	sort.Slice(entries, less)
+	moved := len(entries)
+	for i := 0; i < moved; {
+		key := entries[i].Key
+		versions := make(map[uint64]struct{})
+		j := i
+		for ; j < moved && bytes.Equal(entries[j].Key, key); j++ {
+			versions[entries[j].version] = struct{}{}
+		}
+		ts := uint64(math.MaxUint64)
+		for {
+			vs, err := vlog.kv.get(y.KeyWithTs(key, ts))
+			if err != nil {
+				return nil, err
+			}
+			if (vs.Meta == 0 && vs.Value == nil) || vs.Version <= entries[i].version {
+				break
+			}
+			if _, ok := versions[vs.Version]; !ok {
+				e, err := vlog.versionEntry(key, vs)
+				if err != nil {
+					return nil, err
+				}
+				entries = append(entries, e)
 			}
-			requests = append(requests, req)
+			ts = vs.Version - 1
 		}
+		i = j
 	}
-	for i, b := range requests {
-		elog.Printf("req %d has %d entries", i, len(b.Entries))
-		b.Wg.Add(1)
-		y.AssertTrue(len(b.Entries) > 0)
-		vlog.kv.writeCh <- b // Write out these blocks with newer value offsets.
+	if len(entries) > moved {
+		sort.Slice(entries, less)
 	}
-	for i, b := range requests {
-		elog.Printf("req %d done", i)
-		b.Wg.Wait()
+	return entries, nil
+}
+
+// versionEntry returns an entry which writes vs, a version of key, again.
+func (vlog *valueLog) versionEntry(key []byte, vs y.ValueStruct) (*Entry, error) {
+	e := &Entry{
+		Key:        y.Safecopy(nil, key),
+		Meta:       vs.Meta &^ BitValuePointer,
+		UserMeta:   vs.UserMeta,
+		ExpiresAt:  vs.ExpiresAt,
+		casCounter: vs.CASCounter,
+		version:    vs.Version,
+	}
+	if vs.Meta&BitValuePointer == 0 {
+		e.Value = y.Safecopy(nil, vs.Value)
+		return e, nil
+	}
+	var vp valuePointer
+	vp.Decode(vs.Value)
+	ve, err := vlog.Read(vp, nil)
+	if err != nil {
+		return nil, y.Wrapf(err, "Unable to read from value log: %+v", vp)
+	}
+	e.Value = y.Safecopy(nil, ve.Value)
+	return e, nil
+}
+
+// writeEntries writes entries on the writer goroutine, a thousand at a time, so every batch is
+// checked for room in the memtable.
+func (vlog *valueLog) writeEntries(entries []*Entry, elog trace.EventLog) error {
+	for i := 0; i < len(entries); i += 1000 {
+		n := len(entries) - i
+		if n > 1000 {
+			n = 1000
+		}
+		req := &request{
+			Wg:          sync.WaitGroup{},
+			Entries:     entries[i : i+n],
+			ctx:         context.Background(),
+			keepVersion: true,
+		}
+		elog.Printf("req %d has %d entries", i/1000, n)
+		req.Wg.Add(1)
+		// Write out these blocks with newer value offsets.
+		vlog.kv.writeRequests([]*request{req})
+		if req.Err != nil {
+			return req.Err
+		}
 	}
+	return nil
 }
 
 // Entry provides Key, Value and if required, CASCounterCheck to kv.BatchSet() API.
@@ -299,13 +650,19 @@ func (vlog *valueLog) writeToKV(elog trace.EventLog) {
 type Entry struct {
 	Key             []byte
 	Meta            byte
+	UserMeta        byte // Set by the application, and returned as is. Not interpreted by Badger.
 	Value           []byte
-	CASCounterCheck uint16 // If nonzero, we will check if existing casCounter matches.
+	CASCounterCheck uint64 // If nonzero, we will check if existing casCounter matches.
+	ExpiresAt       uint64 // Unix time in seconds after which the key is gone. Zero means never.
 	Error           error  // Error if any.
 
 	// Fields maintained internally.
+	fid        int32 // The value log file, offset and size of the entry, if it was read from it.
 	offset     int64
-	casCounter uint16
+	size       int64
+	casCounter uint64
+	version    uint64
+	logAlways  bool // Write to the value log even if the value is small and SyncWrites is off.
 }
 
 type entryEncoder struct {
@@ -314,73 +671,111 @@ type entryEncoder struct {
 	compressed   []byte
 }
 
-// Encodes e to buf either plain or compressed.
+// Encodes e to buf either plain or compressed, followed by a checksum. The entry is encrypted if
+// lf is, as it goes at offset in lf. The checksum is of what is written.
 // Returns number of bytes written.
-func (enc *entryEncoder) Encode(e *Entry, buf *bytes.Buffer) int {
-	var headerEnc [13]byte
+func (enc *entryEncoder) Encode(
+	e *Entry, buf *bytes.Buffer, lf *logFile, offset int64) (int, error) {
+	start := buf.Len()
+	if err := enc.encode(e, buf); err != nil {
+		return 0, err
+	}
+	if lf.dataKey != nil {
+		record := buf.Bytes()[start:]
+		lf.xorKeyStream(record, record, offset)
+	}
+	var crcBuf [crcSize]byte
+	binary.BigEndian.PutUint32(crcBuf[:], crc32.Checksum(buf.Bytes()[start:], castagnoli))
+	buf.Write(crcBuf[:])
+	return buf.Len() - start, nil
+}
+
+func (enc *entryEncoder) encode(e *Entry, buf *bytes.Buffer) error {
+	var headerEnc [headerBufSize]byte
 	var h header
 
-	if enc.opt.ValueCompressionMinSize < len(e.Key)+len(e.Value) {
+	c := enc.opt.ValueCompression
+	if c != nil && enc.opt.ValueCompressionMinSize < len(e.Key)+len(e.Value) {
 		var err error
 
 		enc.decompressed.Reset()
 		enc.decompressed.Write(e.Key)
 		enc.decompressed.Write(e.Value)
 
-		enc.compressed, err = lz4.Encode(enc.compressed, enc.decompressed.Bytes())
+		enc.compressed, err = c.Compress(enc.compressed, enc.decompressed.Bytes())
 
 		if err != nil {
-			// Unable to compress value
-			y.Fatalf("Error while compressing file: %s", err.Error())
+			return y.Wrapf(err, "Unable to compress entry with key: %q", e.Key)
 		}
 		compressionRatio := float64(enc.decompressed.Len()) / float64(len(enc.compressed))
 		if compressionRatio >= enc.opt.ValueCompressionMinRatio {
 			h.klen = uint32(len(e.Key))
-			h.vlen = uint32(len(enc.compressed))
+			h.vlen = uint32(1 + len(enc.compressed)) // Starts with the compressor ID.
 			h.meta = e.Meta | BitCompressed
+			h.userMeta = e.UserMeta
 			h.casCounter = e.casCounter
 			h.casCounterCheck = e.CASCounterCheck
+			h.version = e.version
+			h.expiresAt = e.ExpiresAt
 			h.Encode(headerEnc[:])
 
 			buf.Write(headerEnc[:])
+			buf.WriteByte(c.ID())
 			buf.Write(enc.compressed)
-			return len(headerEnc) + len(enc.compressed)
+			return nil
 		}
 	}
 
 	h.klen = uint32(len(e.Key))
 	h.vlen = uint32(len(e.Value))
 	h.meta = e.Meta
+	h.userMeta = e.UserMeta
 	h.casCounter = e.casCounter
 	h.casCounterCheck = e.CASCounterCheck
+	h.version = e.version
+	h.expiresAt = e.ExpiresAt
 	h.Encode(headerEnc[:])
 
 	buf.Write(headerEnc[:])
 	buf.Write(e.Key)
 	buf.Write(e.Value)
-	return len(headerEnc) + len(e.Key) + len(e.Value)
+	return nil
 }
 
 func (e Entry) print(prefix string) {
-	y.Printf("%s Key: %s Meta: %d Offset: %d len(val)=%d cas=%d check=%d\n",
-		prefix, e.Key, e.Meta, e.offset, len(e.Value), e.casCounter, e.CASCounterCheck)
+	y.Printf("%s Key: %s Meta: %d Offset: %d len(val)=%d cas=%d check=%d version=%d\n",
+		prefix, e.Key, e.Meta, e.offset, len(e.Value), e.casCounter, e.CASCounterCheck, e.version)
 }
 
+const (
+	// headerBufSize is the size of an encoded header.
+	headerBufSize = 42
+	// crcSize is the size of the CRC32C checksum which follows every entry, of its header and
+	// payload.
+	crcSize = 4
+)
+
 type header struct {
 	klen            uint32
 	vlen            uint32 // len of value or length of compressed kv if entry storessed compressed
 	meta            byte
-	casCounter      uint16
-	casCounterCheck uint16
+	userMeta        byte
+	casCounter      uint64
+	casCounterCheck uint64
+	version         uint64
+	expiresAt       uint64
 }
 
 func (h header) Encode(out []byte) {
-	y.AssertTrue(len(out) >= 13)
+	y.AssertTrue(len(out) >= headerBufSize)
 	binary.BigEndian.PutUint32(out[0:4], h.klen)
 	binary.BigEndian.PutUint32(out[4:8], h.vlen)
 	out[8] = h.meta
-	binary.BigEndian.PutUint16(out[9:11], h.casCounter)
-	binary.BigEndian.PutUint16(out[11:13], h.casCounterCheck)
+	out[9] = h.userMeta
+	binary.BigEndian.PutUint64(out[10:18], h.casCounter)
+	binary.BigEndian.PutUint64(out[18:26], h.casCounterCheck)
+	binary.BigEndian.PutUint64(out[26:34], h.version)
+	binary.BigEndian.PutUint64(out[34:42], h.expiresAt)
 }
 
 // Decodes h from buf. Returns buf without header and number of bytes read.
@@ -388,9 +783,12 @@ func (h *header) Decode(buf []byte) ([]byte, int) {
 	h.klen = binary.BigEndian.Uint32(buf[0:4])
 	h.vlen = binary.BigEndian.Uint32(buf[4:8])
 	h.meta = buf[8]
-	h.casCounter = binary.BigEndian.Uint16(buf[9:11])
-	h.casCounterCheck = binary.BigEndian.Uint16(buf[11:13])
-	return buf[13:], 13
+	h.userMeta = buf[9]
+	h.casCounter = binary.BigEndian.Uint64(buf[10:18])
+	h.casCounterCheck = binary.BigEndian.Uint64(buf[18:26])
+	h.version = binary.BigEndian.Uint64(buf[26:34])
+	h.expiresAt = binary.BigEndian.Uint64(buf[34:42])
+	return buf[headerBufSize:], headerBufSize
 }
 
 type valuePointer struct {
@@ -423,17 +821,29 @@ type valueLog struct {
 	files   []*logFile
 	kv      *KV
 	maxFid  int32
+	// The format version of each value log file. See checkFormat.
+	formats logFormats
 	offset  int64
 	opt     Options
+	// Has the data keys the files are encrypted with.
+	registry *keyRegistry
+	// Guides GC to the files with the most garbage.
+	discards *discardStats
 }
 
 func (l *valueLog) fpath(fid int32) string {
-	return fmt.Sprintf("%s/%06d.vlog", l.dirPath, fid)
+	return vlogFilePath(l.dirPath, fid)
+}
+
+func vlogFilePath(dirPath string, fid int32) string {
+	return fmt.Sprintf("%s/%06d.vlog", dirPath, fid)
 }
 
-func (l *valueLog) openOrCreateFiles() {
+func (l *valueLog) openOrCreateFiles() error {
 	files, err := ioutil.ReadDir(l.dirPath)
-	y.Check(err)
+	if err != nil {
+		return y.Wrapf(err, "Error while opening value log")
+	}
 
 	found := make(map[int]struct{})
 	for _, file := range files {
@@ -442,67 +852,202 @@ func (l *valueLog) openOrCreateFiles() {
 		}
 		fsz := len(file.Name())
 		fid, err := strconv.Atoi(file.Name()[:fsz-5])
-		y.Check(err)
+		if err != nil {
+			return y.Wrapf(err, "Error while parsing value log id for file: %q", file.Name())
+		}
 		if _, ok := found[fid]; ok {
-			y.Fatalf("Found the same file twice: %d", fid)
+			return y.Errorf("Found the same value log file twice: %d", fid)
 		}
 		found[fid] = struct{}{}
 
-		lf := &logFile{fid: int32(fid), path: l.fpath(int32(fid))}
+		lf := &logFile{
+			fid:    int32(fid),
+			path:   l.fpath(int32(fid)),
+			format: l.formats.of(int32(fid)),
+			ref:    1,
+		}
 		l.files = append(l.files, lf)
 	}
 
 	sort.Slice(l.files, func(i, j int) bool {
-		return l.files[i].fid < l.files[i].fid
+		return l.files[i].fid < l.files[j].fid
 	})
 
 	// Open all previous log files as read only. Open the last log file
-	// as read write.
+	// as read write, unless the KV is read-only.
 	for i := range l.files {
 		lf := l.files[i]
-		if i == len(l.files)-1 {
+		if i == len(l.files)-1 && !l.opt.ReadOnly {
 			lf.fd, err = y.OpenSyncedFile(l.fpath(lf.fid), l.opt.SyncWrites)
-			y.Check(err)
-			l.maxFid = lf.fid
+			if err != nil {
+				return y.Wrapf(err, "Unable to open value log file as RDWR")
+			}
+			fi, err := lf.fd.Stat()
+			if err != nil {
+				return y.Wrapf(err, "Unable to check stat for %q", lf.path)
+			}
+			if err := l.mmapFile(lf, l.activeMmapSize(fi.Size())); err != nil {
+				return err
+			}
+			if lf.format >= 5 && fi.Size() < vlogHeaderSize {
+				// The header was torn by a crash right after the file was created.
+				if err := l.writeHeader(lf); err != nil {
+					return err
+				}
+				continue
+			}
 
 		} else {
-			lf.openReadOnly()
+			if err := lf.openReadOnly(); err != nil {
+				return err
+			}
+			if err := l.mmapFile(lf, lf.size); err != nil {
+				return err
+			}
+			if lf.size < vlogHeaderSize && i == len(l.files)-1 {
+				continue // Torn as above, so it has no entries.
+			}
+		}
+		if lf.format >= 5 {
+			if err := lf.readHeader(l.registry); err != nil {
+				return err
+			}
 		}
 	}
 
+	if len(l.files) > 0 {
+		l.maxFid = l.files[len(l.files)-1].fid
+	} else if l.opt.ReadOnly {
+		return y.Errorf("Unable to open value log read-only, as there are no files in %q", l.dirPath)
+	}
+
 	// If no files are found, then create a new file.
 	if len(l.files) == 0 {
-		lf := &logFile{fid: 0, path: l.fpath(0)}
-		lf.fd, err = y.OpenSyncedFile(l.fpath(lf.fid), l.opt.SyncWrites)
-		y.Check(err)
+		lf, err := l.createLogFile(l.formats[len(l.formats)-1])
+		if err != nil {
+			return err
+		}
 		l.files = append(l.files, lf)
+		l.maxFid = lf.fid
+	}
+	return nil
+}
+
+// createLogFile creates the value log file fid, to be written to.
+func (l *valueLog) createLogFile(fid int32) (*logFile, error) {
+	lf := &logFile{fid: fid, path: l.fpath(fid), format: formatVersion, ref: 1}
+	var err error
+	lf.fd, err = y.OpenSyncedFile(lf.path, l.opt.SyncWrites)
+	if err != nil {
+		return nil, y.Wrapf(err, "Unable to create value log file: %q", lf.path)
+	}
+	if err := l.mmapFile(lf, l.activeMmapSize(0)); err != nil {
+		lf.close()
+		return nil, err
+	}
+	if err := l.writeHeader(lf); err != nil {
+		lf.close()
+		return nil, err
+	}
+	return lf, nil
+}
+
+// writeHeader writes the header of lf, which is encrypted with the latest data key, if any.
+func (l *valueLog) writeHeader(lf *logFile) error {
+	key, err := l.registry.latestKey()
+	if err != nil {
+		return err
+	}
+	if err := lf.fd.Truncate(0); err != nil {
+		return y.Wrapf(err, "Unable to truncate %q", lf.path)
+	}
+	return lf.writeHeader(key)
+}
+
+// mmapFile maps the first size bytes of lf, if value log files are memory-mapped.
+func (l *valueLog) mmapFile(lf *logFile, size int64) error {
+	if l.opt.ValueLogLoadingMode != table.MemoryMap {
+		return nil
+	}
+	return lf.mmapFile(size)
+}
+
+// activeMmapSize returns how much to map of the file being written to, once it has fileSize
+// bytes. It is mapped past its end, so the mapping covers the writes to come.
+func (l *valueLog) activeMmapSize(fileSize int64) int64 {
+	size := 2 * l.opt.ValueLogFileSize
+	if size < 2*fileSize {
+		size = 2 * fileSize
 	}
+	return size
 }
 
-func (l *valueLog) Open(kv *KV, opt *Options) {
+func (l *valueLog) Open(kv *KV, opt *Options, formats logFormats, registry *keyRegistry) error {
 	l.dirPath = opt.Dir
-	l.openOrCreateFiles()
 	l.opt = *opt
+	l.formats = formats
+	l.registry = registry
+	var err error
+	if l.discards, err = openDiscardStats(opt.Dir, opt.ReadOnly); err != nil {
+		return err
+	}
+	if err := l.openOrCreateFiles(); err != nil {
+		return err
+	}
 	l.kv = kv
 
 	l.elog = trace.NewEventLog("Badger", "Valuelog")
+	return nil
+}
+
+// end returns the position right after the last entry written, and the IDs of the files up to
+// it. It must run on the writer goroutine, so no entry is being written.
+func (l *valueLog) end() (valuePointer, []int32) {
+	l.RLock()
+	defer l.RUnlock()
+	fids := make([]int32, 0, len(l.files))
+	for _, lf := range l.files {
+		fids = append(fids, lf.fid)
+	}
+	last := l.files[len(l.files)-1]
+	return valuePointer{Fid: uint32(last.fid), Offset: uint64(last.offset)}, fids
+}
+
+// pinFiles is like end, but returns the files, with a reference taken to each, so value log GC
+// doesn't close them. Call decrRef on each when done.
+func (l *valueLog) pinFiles() (valuePointer, []*logFile) {
+	l.RLock()
+	defer l.RUnlock()
+	files := make([]*logFile, len(l.files))
+	for i, lf := range l.files {
+		lf.incrRef()
+		files[i] = lf
+	}
+	last := l.files[len(l.files)-1]
+	return valuePointer{Fid: uint32(last.fid), Offset: uint64(last.offset)}, files
 }
 
-func (l *valueLog) Close() {
+func (l *valueLog) Close() error {
 	l.elog.Printf("Stopping garbage collection of values.")
+	var err error
 	for _, f := range l.files {
-		y.Check(f.fd.Close())
+		if closeErr := f.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
 	}
 	l.elog.Finish()
+	return err
 }
 
 // Replay replays the value log. The kv provided is only valid for the lifetime of function call.
-func (l *valueLog) Replay(ptr valuePointer, fn logEntry) {
+func (l *valueLog) Replay(ptr valuePointer, fn logEntry) error {
 	fid := int32(ptr.Fid)
-	offset := int64(ptr.Offset)
+	// The entry at ptr is already in the LSM tree. Applying it again would be harmless for most
+	// entries, but not for a merge operand which a compaction has since folded.
+	offset := int64(ptr.Offset) + int64(ptr.Len)
 	y.Printf("Seeking at value pointer: %+v\n", ptr)
 
-	for _, f := range l.files {
+	for i, f := range l.files {
 		if f.fid < fid {
 			continue
 		}
@@ -511,55 +1056,142 @@ func (l *valueLog) Replay(ptr valuePointer, fn logEntry) {
 			of = 0
 		}
 		err := f.iterate(of, fn)
-		y.Check(err)
+		if bad, ok := err.(*badRecordError); ok && i == len(l.files)-1 {
+			err = l.truncateTail(f, bad)
+		}
+		if err != nil {
+			return y.Wrapf(err, "Unable to replay value log: %q", f.path)
+		}
+	}
+
+	last := l.files[len(l.files)-1]
+	if last.format != formatVersion && !l.opt.ReadOnly {
+		// Written in an older format. Write the new entries to a new file.
+		if err := last.doneWriting(); err != nil {
+			return err
+		}
+		lf, err := l.createLogFile(l.formats[len(l.formats)-1])
+		if err != nil {
+			return err
+		}
+		l.Lock()
+		l.files = append(l.files, lf)
+		l.maxFid = lf.fid
+		l.Unlock()
+		return nil
 	}
 
 	// Seek to the end to start writing.
 	var err error
-	last := l.files[len(l.files)-1]
 	last.offset, err = last.fd.Seek(0, io.SeekEnd)
-	y.Checkf(err, "Unable to seek to the end")
+	return y.Wrapf(err, "Unable to seek to the end")
+}
+
+// truncateTail truncates f, the last value log file, at bad, unless a good entry follows it. A
+// write torn by a crash leaves no good entries behind, while corruption in the middle of the file
+// is reported as bad.
+func (l *valueLog) truncateTail(f *logFile, bad *badRecordError) error {
+	if bad.next >= 0 {
+		var good bool
+		err := f.iterate(bad.next, func(Entry) bool {
+			good = true
+			return false
+		})
+		if good {
+			return bad
+		}
+		if _, ok := err.(*badRecordError); err != nil && !ok {
+			return err
+		}
+	}
+	y.Printf("Truncating torn value log tail: %v\n", bad)
+	if l.opt.ReadOnly {
+		return nil // The entries after bad are left out all the same.
+	}
+	return y.Wrapf(f.fd.Truncate(bad.offset), "Unable to truncate %q", f.path)
 }
 
 type request struct {
 	Entries []*Entry
 	Ptrs    []valuePointer
 	Wg      sync.WaitGroup
+	Err     error           // Set if the request as a whole failed to be written.
+	ctx     context.Context // Request is dropped if this is done before it reaches the value log.
+
+	// If set, called by the writer once the request is done, instead of marking Wg done.
+	callback func(error)
+
+	// Version assigned to all the entries in this request by the writer. If keepVersion is set,
+	// the entries already have a version and CAS counter, as they are being moved by value log GC.
+	version     uint64
+	keepVersion bool
+
+	// Set for transaction commits. The request fails with ErrConflict if any of the keys in reads
+	// has been written after readTs.
+	reads  [][]byte
+	readTs uint64
+
+	// If set, the writer runs exclusive instead of writing the request, once the requests sent
+	// before it have been written, and before writing any of the ones sent after it.
+	exclusive func() error
 }
 
+func (req *request) finish(err error) {
+	req.Err = err
+	if req.callback != nil {
+		req.callback(err)
+		return
+	}
+	req.Wg.Done()
+}
+
+// maxWriteBufSize is how big valueLog.Write lets its buffer get before writing it out, so a big
+// batch doesn't keep a buffer the size of a value log file around.
+const maxWriteBufSize = 64 << 20
+
 // Write is thread-unsafe by design and should not be called concurrently.
-func (l *valueLog) Write(reqs []*request) {
+func (l *valueLog) Write(reqs []*request) error {
 	l.RLock()
 	curlf := l.files[len(l.files)-1]
 	l.RUnlock()
 
-	toDisk := func() {
+	toDisk := func() error {
 		if l.buf.Len() == 0 {
-			return
+			return nil
 		}
 		l.elog.Printf("Flushing %d blocks of total size: %d", len(reqs), l.buf.Len())
 		n, err := curlf.fd.Write(l.buf.Bytes())
 		if err != nil {
-			y.Fatalf("Unable to write to value log: %v", err)
+			return y.Wrapf(err, "Unable to write to value log file: %q", curlf.path)
 		}
 		l.elog.Printf("Done")
 		curlf.offset += int64(n)
 		l.buf.Reset()
 
-		if curlf.offset > LogSize {
-			var err error
-			curlf.doneWriting()
+		if curlf.mmap != nil && curlf.offset > int64(len(curlf.mmap)) {
+			curlf.Lock()
+			err := curlf.mmapFile(l.activeMmapSize(curlf.offset))
+			curlf.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		if curlf.offset > l.opt.ValueLogFileSize {
+			if err := curlf.doneWriting(); err != nil {
+				return err
+			}
 
-			newlf := &logFile{fid: atomic.AddInt32(&l.maxFid, 1), offset: 0}
-			newlf.path = l.fpath(newlf.fid)
-			newlf.fd, err = y.OpenSyncedFile(newlf.path, l.opt.SyncWrites)
-			y.Check(err)
+			newlf, err := l.createLogFile(atomic.AddInt32(&l.maxFid, 1))
+			if err != nil {
+				return err
+			}
 
 			l.Lock()
 			l.files = append(l.files, newlf)
 			l.Unlock()
 			curlf = newlf
 		}
+		return nil
 	}
 
 	entryEncoder := &entryEncoder{
@@ -576,7 +1208,9 @@ func (l *valueLog) Write(reqs []*request) {
 			y.AssertTruef(e.Meta&BitCompressed == 0, "Cannot set BitCompressed outside valueLog")
 			var p valuePointer
 
-			if !l.opt.SyncWrites && len(e.Value) < l.opt.ValueThreshold {
+			// Transactions are always written in full, so replay can tell whether they committed.
+			if !l.opt.SyncWrites && len(e.Value) < l.opt.ValueThreshold &&
+				e.Meta&(BitTxn|BitFinTxn) == 0 && !e.logAlways {
 				// No need to write to value log.
 				b.Ptrs = append(b.Ptrs, p)
 				continue
@@ -584,20 +1218,34 @@ func (l *valueLog) Write(reqs []*request) {
 
 			p.Fid = uint32(curlf.fid)
 			p.Offset = uint64(curlf.offset) + uint64(l.buf.Len())
-			p.Len = uint32(entryEncoder.Encode(e, &l.buf))
+			plen, err := entryEncoder.Encode(e, &l.buf, curlf, int64(p.Offset))
+			if err != nil {
+				l.buf.Reset()
+				return err
+			}
+			p.Len = uint32(plen)
 			b.Ptrs = append(b.Ptrs, p)
 
-			if p.Offset > uint64(LogSize) {
-				toDisk()
+			if p.Offset > uint64(l.opt.ValueLogFileSize) || l.buf.Len() > maxWriteBufSize {
+				if err := toDisk(); err != nil {
+					l.buf.Reset()
+					return err
+				}
 			}
 		}
 	}
-	toDisk()
+	if err := toDisk(); err != nil {
+		l.buf.Reset()
+		return err
+	}
+	return nil
 
 	// Acquire mutex locks around this manipulation, so that the reads don't try to use
 	// an invalid file descriptor.
 }
 
+// getFile returns the file fid with a reference taken, so value log GC doesn't close it while it
+// is being read from. Call decrRef when done.
 func (l *valueLog) getFile(fid int32) (*logFile, error) {
 	l.RLock()
 	defer l.RUnlock()
@@ -608,41 +1256,135 @@ func (l *valueLog) getFile(fid int32) (*logFile, error) {
 	if idx == len(l.files) || l.files[idx].fid != fid {
 		return nil, Corrupt
 	}
+	l.files[idx].incrRef()
 	return l.files[idx], nil
 }
 
-// Read reads the value log at a given location.
-func (l *valueLog) Read(p valuePointer, s *y.Slice) (e Entry, err error) {
+// decodeBufs has the buffers entries are decompressed into by valueLog.Read.
+var decodeBufs = sync.Pool{New: func() interface{} { return []byte(nil) }}
+
+// Read reads the value log at a given location. The entry is copied into s.
+func (l *valueLog) Read(p valuePointer, s *y.Slice) (Entry, error) {
+	e, _, err := l.read(p, s, false)
+	return e, err
+}
+
+// readShared is like Read, but the entry points into the mapping of the file instead, if the file
+// is sealed, memory-mapped and the entry is stored as it is. The file is returned then, and the
+// caller has to call decrRef on it once it is done with the entry.
+func (l *valueLog) readShared(p valuePointer, s *y.Slice) (Entry, *logFile, error) {
+	return l.read(p, s, true)
+}
+
+func (l *valueLog) read(p valuePointer, s *y.Slice, shared bool) (
+	e Entry, held *logFile, err error) {
 	lf, err := l.getFile(int32(p.Fid))
 	if err != nil {
-		return e, err
+		return e, nil, err
 	}
+	defer func() {
+		if err != nil {
+			held = nil
+		}
+		if held != nil {
+			return
+		}
+		if derr := lf.decrRef(); err == nil {
+			err = derr
+		}
+	}()
 
 	if s == nil {
 		s = new(y.Slice)
 	}
-	buf := s.Resize(int(p.Len))
-	if err := lf.read(buf, int64(p.Offset)); err != nil {
-		return e, err
+	// Encrypted entries are decrypted in place, which the mapping can't take.
+	buf, mapped, err := lf.read(int64(p.Offset), int(p.Len), s, shared && lf.dataKey == nil)
+	if err != nil {
+		return e, nil, err
+	}
+	if lf.format >= 3 {
+		if len(buf) < headerBufSize+crcSize {
+			return e, nil, y.Errorf("Corrupt value log entry at %+v: too short", p)
+		}
+		n := len(buf) - crcSize
+		if crc32.Checksum(buf[:n], castagnoli) != binary.BigEndian.Uint32(buf[n:]) {
+			return e, nil, y.Errorf("Checksum mismatch in value log entry at %+v", p)
+		}
+		buf = buf[:n]
+	}
+	if lf.dataKey != nil {
+		lf.xorKeyStream(buf, buf, int64(p.Offset))
 	}
 	var h header
 	buf, _ = h.Decode(buf)
 	if h.meta&BitCompressed > 0 {
-		// TODO: reuse generated buffer
-		y.AssertTrue(uint32(len(buf)) == h.vlen)
-		decoded, err := lz4.Decode(nil, buf)
-		y.Check(err)
+		if uint32(len(buf)) != h.vlen {
+			return e, nil, y.Errorf("Corrupt value log entry at %+v: compressed length %d, expected %d",
+				p, len(buf), h.vlen)
+		}
+		// Decompress into a buffer of the pool, and have s keep it, so the caller reuses it. The one
+		// s had goes to the pool. It may hold the compressed entry, which nothing points into.
+		decoded, err := decompress(decodeBufs.Get().([]byte), buf, lf.format)
+		if err != nil {
+			return e, nil, y.Wrapf(err, "Unable to decompress value log entry at %+v", p)
+		}
+		if old := s.Swap(decoded); old != nil {
+			decodeBufs.Put(old)
+		}
 
-		y.AssertTrue(len(decoded) > int(h.klen))
+		if len(decoded) < int(h.klen) {
+			return e, nil, y.Errorf("Corrupt value log entry at %+v: decoded length %d, key length %d",
+				p, len(decoded), h.klen)
+		}
 		h.vlen = uint32(len(decoded)) - h.klen
 		buf = decoded
+		mapped = false
+	}
+	if uint32(len(buf)) < h.klen+h.vlen {
+		return e, nil, y.Errorf("Corrupt value log entry at %+v: got %d bytes, expected %d",
+			p, len(buf), h.klen+h.vlen)
 	}
 	e.Key = buf[0:h.klen]
 	e.Meta = h.meta
+	e.UserMeta = h.userMeta
 	e.casCounter = h.casCounter
 	e.CASCounterCheck = h.casCounterCheck
+	e.version = h.version
+	e.ExpiresAt = h.expiresAt
 	e.Value = buf[h.klen : h.klen+h.vlen]
-	return e, nil
+	if mapped {
+		held = lf
+	}
+	return e, held, nil
+}
+
+// valueSize returns the size of the value pointed to by p. Only the header is read, unless the
+// entry is compressed, in which case the whole entry has to be.
+func (l *valueLog) valueSize(p valuePointer) (int, error) {
+	lf, err := l.getFile(int32(p.Fid))
+	if err != nil {
+		return 0, err
+	}
+	hbuf, _, err := lf.read(int64(p.Offset), headerBufSize, new(y.Slice), false)
+	if derr := lf.decrRef(); err == nil {
+		err = derr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if lf.dataKey != nil {
+		lf.xorKeyStream(hbuf, hbuf, int64(p.Offset))
+	}
+	var h header
+	h.Decode(hbuf)
+	if h.meta&BitCompressed == 0 {
+		return int(h.vlen), nil
+	}
+	e, err := l.Read(p, nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(e.Value), nil
 }
 
 func (l *valueLog) runGCInLoop(lc *y.LevelCloser) {
@@ -657,121 +1399,49 @@ func (l *valueLog) runGCInLoop(lc *y.LevelCloser) {
 		case <-lc.HasBeenClosed():
 			return
 		case <-tick.C:
-			l.doRunGC()
+			if err := l.doRunGC(); err != nil {
+				l.kv.setErr(y.Wrapf(err, "While running value log GC"))
+			}
 		}
 	}
 }
 
+// pickLog returns the file with the highest share of discarded bytes, if it reaches
+// Options.ValueGCThreshold. The file being written to isn't picked.
 func (l *valueLog) pickLog() *logFile {
 	l.RLock()
 	defer l.RUnlock()
-	if len(l.files) <= 1 {
-		return nil
+	var picked *logFile
+	var pickedRatio float64
+	for _, lf := range l.files[:len(l.files)-1] {
+		size := lf.size - lf.dataStart()
+		if size <= 0 {
+			continue
+		}
+		if ratio := float64(l.discards.get(lf.fid)) / float64(size); ratio > pickedRatio {
+			picked, pickedRatio = lf, ratio
+		}
 	}
-	// This file shouldn't be being written to.
-	lfi := rand.Intn(len(l.files))
-	if lfi > 0 {
-		lfi = rand.Intn(lfi) // Another level of rand to favor smaller fids.
+	if picked == nil || pickedRatio < l.opt.ValueGCThreshold {
+		return nil
 	}
-	return l.files[lfi]
+	y.Printf("Fid: %d Discard ratio=%.2f\n", picked.fid, pickedRatio)
+	return picked
 }
 
-func (vlog *valueLog) doRunGC() {
+// doRunGC rewrites the file pickLog picks, if any. The entries which are still needed are moved
+// to the end of the value log, and the file is removed.
+func (vlog *valueLog) doRunGC() error {
 	lf := vlog.pickLog()
 	if lf == nil {
-		return
-	}
-
-	type reason struct {
-		total   float64
-		keep    float64
-		discard float64
-	}
-
-	var r reason
-	var window float64 = 100.0
-	count := 0
-
-	// Pick a random start point for the log.
-	skipFirstM := float64(rand.Int63n(LogSize/int64(M))) - window
-	var skipped float64
-
-	start := time.Now()
-	y.AssertTrue(vlog.kv != nil)
-	err := lf.iterate(0, func(e Entry) bool {
-		esz := float64(len(e.Key)+len(e.Value)+1+4) / (1 << 20) // in MBs. +4 for the CAS stuff.
-		skipped += esz
-		if skipped < skipFirstM {
-			return true
-		}
-
-		count++
-		if count%100 == 0 {
-			time.Sleep(time.Millisecond)
-		}
-		r.total += esz
-		if r.total > window {
-			return false
-		}
-		if time.Since(start) > 10*time.Second {
-			return false
-		}
-
-		vs := vlog.kv.get(e.Key)
-		if (vs.Meta & BitDelete) > 0 {
-			// Key has been deleted. Discard.
-			r.discard += esz
-			return true
-		}
-		if (vs.Meta & BitValuePointer) == 0 {
-			// Value is stored alongside key. Discard.
-			r.discard += esz
-			return true
-		}
-
-		// Value is still present in value log.
-		y.AssertTrue(len(vs.Value) > 0)
-		var vp valuePointer
-		vp.Decode(vs.Value)
-
-		if int32(vp.Fid) > lf.fid {
-			// Value is present in a later log. Discard.
-			r.discard += esz
-			return true
-		}
-		if int64(vp.Offset) > e.offset {
-			// Value is present in a later offset, but in the same log.
-			r.discard += esz
-			return true
-		}
-		if int32(vp.Fid) == lf.fid && int64(vp.Offset) == e.offset {
-			// This is still the active entry. This would need to be rewritten.
-			r.keep += esz
-
-		} else {
-			fmt.Printf("Reason=%+v\n", r)
-			ne, err := vlog.Read(vp, nil)
-			y.Check(err)
-			ne.offset = int64(vp.Offset)
-			if ne.casCounter == e.casCounter {
-				ne.print("Latest Entry in LSM")
-				e.print("Latest Entry in Log")
-				y.Fatalf("This shouldn't happen. Latest Pointer:%+v. Meta:%v.", vp, vs.Meta)
-			}
-		}
-		return true
-	})
-
-	y.Checkf(err, "While iterating for RunGC.")
-	y.Printf("Fid: %d Data status=%+v\n", lf.fid, r)
-
-	if r.total < 10.0 || r.keep >= vlog.opt.ValueGCThreshold*r.total {
-		y.Printf("Skipping GC on fid: %d\n\n", lf.fid)
-		return
+		return nil
 	}
 
 	y.Printf("=====> REWRITING VLOG %d\n", lf.fid)
-	vlog.rewrite(lf)
+	if err := vlog.rewrite(lf); err != nil {
+		return err
+	}
 	y.Printf("REWRITE DONE\n")
 	vlog.elog.Printf("Done rewriting.")
+	return nil
 }
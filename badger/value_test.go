@@ -17,14 +17,17 @@
 package badger
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/dgraph-io/badger/table"
 	"github.com/dgraph-io/badger/y"
 )
 
@@ -32,7 +35,9 @@ func TestValueBasic(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	y.Check(err)
 
-	kv := NewKV(getTestOptions(dir))
+	kv, err := NewKV(getTestOptions(dir))
+
+	require.NoError(t, err)
 	defer kv.Close()
 	log := &kv.vlog
 
@@ -88,7 +93,9 @@ func TestCompression(t *testing.T) {
 	opt := getTestOptions(dir)
 	opt.ValueCompressionMinSize = 16
 
-	kv := NewKV(opt)
+	kv, err := NewKV(opt)
+
+	require.NoError(t, err)
 	defer kv.Close()
 	log := &kv.vlog
 
@@ -140,7 +147,8 @@ func TestValueGC(t *testing.T) {
 	dir, err := ioutil.TempDir("/tmp", "badger")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
-	kv := NewKV(getTestOptions(dir))
+	kv, err := NewKV(getTestOptions(dir))
+	require.NoError(t, err)
 	defer kv.Close()
 
 	sz := 20 << 20
@@ -153,13 +161,13 @@ func TestValueGC(t *testing.T) {
 			Value: v,
 		})
 	}
-	kv.BatchSet(entries)
+	require.NoError(t, kv.BatchSet(entries))
 	for _, e := range entries {
 		require.NoError(t, e.Error, "entry with error: %+v", e)
 	}
 
 	for i := 0; i < 45; i++ {
-		kv.Delete([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, kv.Delete([]byte(fmt.Sprintf("key%d", i))))
 	}
 
 	kv.vlog.RLock()
@@ -173,12 +181,348 @@ func TestValueGC(t *testing.T) {
 
 	kv.vlog.rewrite(lf)
 	for i := 45; i < 100; i++ {
-		val, _ := kv.Get([]byte(fmt.Sprintf("key%d", i)))
+		val, _, err := kv.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
 		require.NotNil(t, val)
 		require.True(t, len(val) == sz, "Size found: %d", len(val))
 	}
 }
 
+func TestDiscardStats(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.MaxLevels = 2
+	opt.DoNotCompact = true
+	opt.ValueLogFileSize = 1 << 16
+	opt.ValueGCThreshold = 0.5
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	val := func(round, i int) []byte {
+		v := make([]byte, 1<<10)
+		rand.New(rand.NewSource(int64(100*round + i))).Read(v) // Not compressible.
+		return v
+	}
+	// Each round goes to a level 0 table. The second one overwrites the first.
+	for round := 0; round < 2; round++ {
+		kv, err := NewKV(opt)
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, kv.Set(key(i), val(round, i)))
+		}
+		require.NoError(t, kv.Close())
+	}
+
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	require.Nil(t, kv.vlog.pickLog()) // Nothing has been discarded yet.
+	require.NoError(t, kv.lc.doCompact(0))
+	// The first file only has values of the first round, which are all gone.
+	first := kv.vlog.files[0]
+	require.Equal(t, first.size-first.dataStart(), kv.vlog.discards.get(first.fid))
+	require.Equal(t, first, kv.vlog.pickLog())
+	require.NoError(t, kv.vlog.doRunGC())
+	require.NotEqual(t, first.fid, kv.vlog.files[0].fid)
+	require.Zero(t, kv.vlog.discards.get(first.fid))
+	second := kv.vlog.files[0]
+	discarded := kv.vlog.discards.get(second.fid)
+	require.True(t, discarded > 0)
+	require.NoError(t, kv.Close())
+
+	// The stats are kept across restarts.
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	require.Equal(t, discarded, kv.vlog.discards.get(second.fid))
+	for i := 0; i < 100; i++ {
+		v, _, err := kv.Get(key(i))
+		require.NoError(t, err)
+		require.Equal(t, val(1, i), v)
+	}
+}
+
+func TestDiscardStatsUnreferenced(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.DoNotCompact = true
+	opt.ValueLogFileSize = 1 << 12
+	opt.ValueGCThreshold = 0.9
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	val := func(i int) []byte { return []byte(fmt.Sprintf("val%03d", i)) } // Kept in the LSM tree.
+	checkDiscarded := func(kv *KV) {
+		// Nothing points to the entries, so all of each file is garbage, and counted once.
+		for _, lf := range kv.vlog.files[:len(kv.vlog.files)-1] {
+			require.Equal(t, lf.size-lf.dataStart(), kv.vlog.discards.get(lf.fid))
+		}
+	}
+
+	// Transactions, which are only counted when replayed after a crash.
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	for i := 0; i < 100; i += 2 {
+		txn := kv.NewTransaction(true)
+		require.NoError(t, txn.Set(key(i), val(i)))
+		require.NoError(t, txn.Set(key(i+1), val(i+1)))
+		require.NoError(t, txn.Commit())
+	}
+	kv.dirLock.release() // As if the process had died, so the directory can be opened again.
+	closeCrashed(kv)
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	require.NoError(t, kv.Close())
+
+	// Small values, which are counted when written.
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	for i := 100; i < 200; i++ {
+		require.NoError(t, kv.Set(key(i), val(i)))
+	}
+	require.NoError(t, kv.Close())
+
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+	require.True(t, len(kv.vlog.files) > 2)
+	checkDiscarded(kv)
+	first := kv.vlog.files[0]
+	require.Equal(t, first, kv.vlog.pickLog())
+	require.NoError(t, kv.vlog.doRunGC())
+	require.NotEqual(t, first.fid, kv.vlog.files[0].fid)
+	for i := 0; i < 200; i++ {
+		v, _, err := kv.Get(key(i))
+		require.NoError(t, err)
+		require.Equal(t, val(i), v)
+	}
+}
+
+func TestRewriteClosesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 10 // A file per value.
+	opt.ValueLogLoadingMode = table.MemoryMap
+	opt.ValueCompression = nil
+
+	key := []byte("key")
+	val := func(i int) []byte {
+		v := make([]byte, 1<<10)
+		rand.New(rand.NewSource(int64(i))).Read(v)
+		return v
+	}
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	require.NoError(t, kv.Set(key, val(0)))
+	v0 := kv.Version()
+	require.NoError(t, kv.Set(key, val(1)))
+	require.NoError(t, kv.Close())
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	old, _, err := kv.GetAt(key, v0)
+	require.NoError(t, err)
+	lf := kv.vlog.files[0]
+	require.NotNil(t, lf.mmap)
+	_, err = kv.vlog.getFile(lf.fid) // As a read in flight would.
+	require.NoError(t, err)
+	require.NoError(t, kv.vlog.rewrite(lf))
+	_, err = kv.vlog.getFile(lf.fid)
+	require.Equal(t, Corrupt, err)
+
+	// The read in flight can go on, and closes the file once done.
+	var s y.Slice
+	_, _, err = lf.read(lf.dataStart(), headerBufSize, &s, false)
+	require.NoError(t, err)
+	require.NoError(t, lf.decrRef())
+	require.Nil(t, lf.mmap)
+	require.Error(t, lf.fd.Close()) // Closed already.
+	// Values read from the file don't point into its mapping, which is gone.
+	require.Equal(t, val(0), old)
+	v, _, err := kv.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, val(1), v)
+}
+
+func TestIteratorValueKeepsFileOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 10 // A file per value.
+	opt.ValueLogLoadingMode = table.MemoryMap
+	opt.ValueCompression = nil
+
+	val := bytes.Repeat([]byte("a"), 1<<10)
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+	require.NoError(t, kv.Set([]byte("a"), val))
+	require.NoError(t, kv.Set([]byte("b"), val))
+	require.NoError(t, kv.Close())
+	kv, err = NewKV(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	lf := kv.vlog.files[0]
+	it := kv.NewIterator(IteratorOptions{PrefetchSize: 1, FetchValues: true})
+	it.Seek([]byte("a"))
+	require.Equal(t, []byte("a"), it.Item().Key())
+	v, err := it.Item().Value()
+	require.NoError(t, err)
+	// The value points into the mapping, and the item holds a reference to the file.
+	require.EqualValues(t, 2, atomic.LoadInt32(&lf.ref))
+
+	// Value log GC removes the file, which stays mapped until the iterator is done with it.
+	require.NoError(t, kv.vlog.rewrite(lf))
+	require.NotNil(t, lf.mmap)
+	require.Equal(t, val, v)
+	it.Close()
+	require.Nil(t, lf.mmap)
+
+	v, _, err = kv.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, val, v)
+}
+
+func TestValueLogTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	kv, err := NewKV(opt)
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	lastPtr := func() valuePointer {
+		kv.RLock()
+		defer kv.RUnlock()
+		return kv.vptr
+	}
+	// Reopens the KV without closing it, as if the process had died.
+	var crashed []*KV
+	defer func() {
+		for _, kv := range crashed {
+			closeCrashed(kv)
+		}
+	}()
+	crash := func() error {
+		kv.dirLock.release()
+		crashed = append(crashed, kv)
+		kv, err = NewKV(opt)
+		return err
+	}
+	check := func(n int) {
+		for i := 0; i < 20; i++ {
+			_, err := kv.GetItem(key(i))
+			if i < n {
+				require.NoError(t, err, string(key(i)))
+			} else {
+				require.Equal(t, ErrKeyNotFound, err, string(key(i)))
+			}
+		}
+	}
+	var mid valuePointer
+	for i := 0; i < 10; i++ {
+		require.NoError(t, kv.Set(key(i), []byte("value")))
+		if i == 3 {
+			mid = lastPtr()
+		}
+	}
+	path := kv.vlog.fpath(int32(mid.Fid))
+
+	// The last entry is cut short.
+	last := lastPtr()
+	require.NoError(t, os.Truncate(path, int64(last.Offset+uint64(last.Len))-3))
+	require.NoError(t, crash())
+	check(9)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.EqualValues(t, last.Offset, fi.Size())
+
+	// The checksum of the last entry doesn't match.
+	require.NoError(t, kv.Set(key(9), []byte("value")))
+	last = lastPtr()
+	flipByte(t, path, int64(last.Offset+uint64(last.Len))-1)
+	require.NoError(t, crash())
+	check(9)
+
+	// A value read from the log is checked too.
+	big := make([]byte, opt.ValueThreshold+10)
+	require.NoError(t, kv.Set(key(9), big))
+	last = lastPtr()
+	flipByte(t, path, int64(last.Offset+uint64(last.Len))-10)
+	_, _, err = kv.Get(key(9))
+	require.Error(t, err)
+
+	// Good entries follow a corrupt one.
+	flipByte(t, path, int64(mid.Offset)+headerBufSize)
+	require.Error(t, crash())
+}
+
+func TestValueLogLoadingMode(t *testing.T) {
+	for _, mode := range []int{table.FileIO, table.MemoryMap} {
+		dir, err := ioutil.TempDir("/tmp", "badger")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		opt := getTestOptions(dir)
+		opt.ValueLogFileSize = 1 << 16
+		opt.ValueLogLoadingMode = mode
+		kv, err := NewKV(opt)
+		require.NoError(t, err)
+
+		key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+		val := func(i int) []byte {
+			v := make([]byte, 1<<10)
+			if i == 399 { // More than the file being written to is mapped for.
+				v = make([]byte, 3*opt.ValueLogFileSize)
+			}
+			rand.New(rand.NewSource(int64(i))).Read(v) // Not compressible.
+			return v
+		}
+		set := func(from, to int) {
+			var entries []*Entry
+			for i := from; i < to; i++ {
+				entries = append(entries, &Entry{Key: key(i), Value: val(i)})
+			}
+			require.NoError(t, kv.BatchSet(entries))
+		}
+		for i := 0; i < 400; i += 10 {
+			set(i, i+10)
+		}
+		check := func() {
+			for i := 0; i < 400; i++ {
+				v, _, err := kv.Get(key(i))
+				require.NoError(t, err)
+				require.Equal(t, val(i), v, "mode %d, key %s", mode, key(i))
+			}
+		}
+		check()
+		require.True(t, len(kv.vlog.files) > 1)
+		require.NoError(t, kv.Close())
+
+		kv, err = NewKV(opt)
+		require.NoError(t, err)
+		check()
+		require.NoError(t, kv.Close())
+	}
+}
+
+func flipByte(t *testing.T, path string, offset int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	var b [1]byte
+	_, err = f.ReadAt(b[:], offset)
+	require.NoError(t, err)
+	b[0]++
+	_, err = f.WriteAt(b[:], offset)
+	require.NoError(t, err)
+}
+
 func BenchmarkReadWrite(b *testing.B) {
 	rwRatio := []float32{
 		0.1, 0.2, 0.5, 1.0,
@@ -191,7 +535,7 @@ func BenchmarkReadWrite(b *testing.B) {
 		for _, rw := range rwRatio {
 			b.Run(fmt.Sprintf("%3.1f,%04d", rw, vsz), func(b *testing.B) {
 				var vl valueLog
-				vl.Open(nil, getTestOptions("vlog"))
+				vl.Open(nil, getTestOptions("vlog"), newLogFormats(), nil)
 				defer os.Remove("vlog")
 				b.ResetTimer()
 
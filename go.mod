@@ -5,6 +5,8 @@ go 1.21.5
 require (
 	github.com/AndreasBriese/bbloom v0.0.0-20190825152654-46b345b51c96
 	github.com/bkaradzic/go-lz4 v1.0.0
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.17.9
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.9.0
 	golang.org/x/net v0.24.0
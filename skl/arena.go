@@ -7,6 +7,10 @@ import (
 	"github.com/dgraph-io/badger/y"
 )
 
+// valHeaderSize is the size of the meta and user meta bytes, CAS counter and expiry stored before
+// each value.
+const valHeaderSize = 1 + 1 + 8 + 8
+
 // Arena should be lock-free.
 type Arena struct {
 	n   uint32
@@ -34,15 +38,17 @@ func (s *Arena) Reset() {
 // size of val. We could also store this size inside arena but the encoding and
 // decoding will incur some overhead.
 func (s *Arena) PutVal(v y.ValueStruct) uint32 {
-	l := uint32(len(v.Value)) + 3
+	l := uint32(len(v.Value)) + valHeaderSize
 	n := atomic.AddUint32(&s.n, l)
 	y.AssertTruef(int(n) <= len(s.buf),
 		"Arena too small, toWrite:%d newTotal:%d limit:%d",
 		l, n, len(s.buf))
 	m := n - l
 	s.buf[m] = v.Meta
-	binary.BigEndian.PutUint16(s.buf[m+1:m+3], v.CASCounter)
-	copy(s.buf[m+3:n], v.Value)
+	s.buf[m+1] = v.UserMeta
+	binary.BigEndian.PutUint64(s.buf[m+2:m+10], v.CASCounter)
+	binary.BigEndian.PutUint64(s.buf[m+10:m+valHeaderSize], v.ExpiresAt)
+	copy(s.buf[m+valHeaderSize:n], v.Value)
 	return m
 }
 
@@ -66,9 +72,11 @@ func (s *Arena) GetKey(offset uint32, size uint16) []byte {
 // size and should NOT include the meta byte.
 func (s *Arena) GetVal(offset uint32, size uint16) y.ValueStruct {
 	out := y.ValueStruct{
-		Value:      s.buf[offset+3 : offset+3+uint32(size)],
+		Value:      s.buf[offset+valHeaderSize : offset+valHeaderSize+uint32(size)],
 		Meta:       s.buf[offset],
-		CASCounter: binary.BigEndian.Uint16(s.buf[offset+1 : offset+3]),
+		UserMeta:   s.buf[offset+1],
+		CASCounter: binary.BigEndian.Uint64(s.buf[offset+2 : offset+10]),
+		ExpiresAt:  binary.BigEndian.Uint64(s.buf[offset+10 : offset+valHeaderSize]),
 	}
 	return out
 }
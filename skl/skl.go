@@ -19,11 +19,10 @@ Adapted from RocksDB inline skiplist.
 
 Key differences:
 - No optimization for sequential inserts (no "prev").
-- No custom comparator.
-- Support overwrites. This requires care when we see the same key when inserting.
-  For RocksDB or LevelDB, overwrites are implemented as a newer sequence number in the key, so
-	there is no need for values. We don't intend to support versioning. In-place updates of values
-	would be more efficient.
+- Keys are compared with y.CompareKeys. Every key carries a version suffix (see y.KeyWithTs),
+  so writing a newer version of a key inserts a new node, and older versions stay readable.
+- Support overwrites of the same key and version. This requires care when we see the same key
+  when inserting.
 - We discard all non-concurrent code.
 - We do not support Splices. This simplifies the code a lot.
 - No AllocateNode or other pointer arithmetic.
@@ -33,7 +32,6 @@ Key differences:
 package skl
 
 import (
-	"bytes"
 	"math"
 	"math/rand"
 	"sync"
@@ -210,7 +208,7 @@ func (s *Skiplist) findNear(key []byte, less bool, allowEqual bool) (*node, bool
 		}
 
 		nextKey := next.key(s.arena)
-		cmp := bytes.Compare(key, nextKey)
+		cmp := y.CompareKeys(key, nextKey)
 		if cmp > 0 {
 			// x.key < next.key < key. We can continue to move right.
 			x = next
@@ -265,7 +263,7 @@ func (s *Skiplist) findSpliceForLevel(key []byte, before *node, level int) (*nod
 			return before, next
 		}
 		nextKey := next.key(s.arena)
-		cmp := bytes.Compare(key, nextKey)
+		cmp := y.CompareKeys(key, nextKey)
 		if cmp == 0 {
 			// Equality case.
 			return next, next
@@ -367,13 +365,22 @@ func (s *Skiplist) findLast() *node {
 	}
 }
 
+// Get returns the value of the newest version of key, which is not newer than the version in
+// key. The returned ValueStruct has its Version set. If no such version exists, an empty
+// ValueStruct is returned.
 func (s *Skiplist) Get(key []byte) y.ValueStruct {
-	n, found := s.findNear(key, false, true) // findGreaterOrEqual.
-	if !found {
+	n, _ := s.findNear(key, false, true) // findGreaterOrEqual.
+	if n == nil {
+		return y.ValueStruct{}
+	}
+	nodeKey := n.key(s.arena)
+	if !y.SameKey(key, nodeKey) {
 		return y.ValueStruct{}
 	}
 	valOffset, valSize := n.getValueOffset()
-	return s.arena.GetVal(valOffset, valSize)
+	vs := s.arena.GetVal(valOffset, valSize)
+	vs.Version = y.ParseTs(nodeKey)
+	return vs
 }
 
 func (s *Skiplist) NewIterator() *Iterator {
@@ -383,6 +390,9 @@ func (s *Skiplist) NewIterator() *Iterator {
 
 func (s *Skiplist) Size() int64 { return s.arena.Size() }
 
+// Empty returns true if the skiplist has no entries.
+func (s *Skiplist) Empty() bool { return s.findLast() == nil }
+
 // Iterator is an iterator over skiplist object. For new objects, you just
 // need to initialize Iterator.list.
 type Iterator struct {
@@ -450,12 +460,19 @@ func (s *Iterator) Name() string { return "SkiplistIterator" }
 type UniIterator struct {
 	iter     *Iterator
 	reversed bool
+	bounds   y.KeyRange
 }
 
 func (s *Skiplist) NewUniIterator(reversed bool) *UniIterator {
+	return s.NewUniRangeIterator(reversed, y.KeyRange{})
+}
+
+// NewUniRangeIterator returns a UniIterator which only returns keys in r.
+func (s *Skiplist) NewUniRangeIterator(reversed bool, r y.KeyRange) *UniIterator {
 	return &UniIterator{
 		iter:     s.NewIterator(),
 		reversed: reversed,
+		bounds:   r,
 	}
 }
 
@@ -468,6 +485,10 @@ func (s *UniIterator) Next() {
 }
 
 func (s *UniIterator) Rewind() {
+	if start := s.bounds.Start(s.reversed); start != nil {
+		s.Seek(start)
+		return
+	}
 	if !s.reversed {
 		s.iter.SeekToFirst()
 	} else {
@@ -476,6 +497,7 @@ func (s *UniIterator) Rewind() {
 }
 
 func (s *UniIterator) Seek(key []byte) {
+	key = s.bounds.Clamp(key, s.reversed)
 	if !s.reversed {
 		s.iter.Seek(key)
 	} else {
@@ -483,8 +505,11 @@ func (s *UniIterator) Seek(key []byte) {
 	}
 }
 
+func (s *UniIterator) Valid() bool {
+	return s.iter.Valid() && s.bounds.Contains(s.iter.Key())
+}
+
 func (s *UniIterator) Key() []byte          { return s.iter.Key() }
 func (s *UniIterator) Value() y.ValueStruct { return s.iter.Value() }
-func (s *UniIterator) Valid() bool          { return s.iter.Valid() }
 func (s *UniIterator) Name() string         { return "UniMemtableIterator" }
 func (s *UniIterator) Close()               { s.iter.Close() }
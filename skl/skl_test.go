@@ -19,6 +19,7 @@ package skl
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 	"math/rand"
 	"strconv"
 	"sync"
@@ -48,7 +49,7 @@ func length(s *Skiplist) int {
 }
 
 func TestEmpty(t *testing.T) {
-	key := []byte("aaa")
+	key := y.KeyWithTs([]byte("aaa"), 0)
 	l := NewSkiplist(arenaPool)
 
 	v := l.Get(key)
@@ -91,39 +92,78 @@ func TestBasic(t *testing.T) {
 
 	// Try inserting values.
 	// Somehow require.Nil doesn't work when checking for unsafe.Pointer(nil).
-	l.Put([]byte("key1"), y.ValueStruct{val1, 55, 60000})
-	l.Put([]byte("key3"), y.ValueStruct{val3, 56, 60001})
-	l.Put([]byte("key2"), y.ValueStruct{val2, 57, 60002})
+	l.Put(y.KeyWithTs([]byte("key1"), 0), y.ValueStruct{Value: val1, Meta: 55, CASCounter: 60000 << 32})
+	l.Put(y.KeyWithTs([]byte("key3"), 0), y.ValueStruct{Value: val3, Meta: 56, CASCounter: 60001})
+	l.Put(y.KeyWithTs([]byte("key2"), 0), y.ValueStruct{Value: val2, Meta: 57, CASCounter: 60002})
 
-	v := l.Get([]byte("key"))
+	v := l.Get(y.KeyWithTs([]byte("key"), 0))
 	require.True(t, v.Value == nil)
 
-	v = l.Get([]byte("key1"))
+	v = l.Get(y.KeyWithTs([]byte("key1"), 0))
 	require.True(t, v.Value != nil)
 	require.EqualValues(t, "00042", string(v.Value))
 	require.EqualValues(t, 55, v.Meta)
-	require.EqualValues(t, 60000, v.CASCounter)
+	require.EqualValues(t, uint64(60000)<<32, v.CASCounter)
 
-	v = l.Get([]byte("key2"))
+	v = l.Get(y.KeyWithTs([]byte("key2"), 0))
 	require.True(t, v.Value != nil)
 	require.EqualValues(t, "00052", string(v.Value))
 	require.EqualValues(t, 57, v.Meta)
 	require.EqualValues(t, 60002, v.CASCounter)
 
-	v = l.Get([]byte("key3"))
+	v = l.Get(y.KeyWithTs([]byte("key3"), 0))
 	require.True(t, v.Value != nil)
 	require.EqualValues(t, "00062", string(v.Value))
 	require.EqualValues(t, 56, v.Meta)
 	require.EqualValues(t, 60001, v.CASCounter)
 
-	l.Put([]byte("key2"), y.ValueStruct{val4, 12, 50000})
-	v = l.Get([]byte("key2"))
+	l.Put(y.KeyWithTs([]byte("key2"), 0), y.ValueStruct{Value: val4, Meta: 12, CASCounter: 50000})
+	v = l.Get(y.KeyWithTs([]byte("key2"), 0))
 	require.True(t, v.Value != nil)
 	require.EqualValues(t, "00072", string(v.Value))
 	require.EqualValues(t, 12, v.Meta)
 	require.EqualValues(t, 50000, v.CASCounter)
 }
 
+// TestVersions checks that newer versions of a key do not overwrite older ones.
+func TestVersions(t *testing.T) {
+	l := NewSkiplist(arenaPool)
+	defer l.DecrRef()
+	key := []byte("key")
+	l.Put(y.KeyWithTs(key, 2), y.ValueStruct{Value: newValue(2), CASCounter: 2})
+	l.Put(y.KeyWithTs(key, 5), y.ValueStruct{Value: newValue(5), CASCounter: 5})
+	l.Put(y.KeyWithTs([]byte("kex"), 9), y.ValueStruct{Value: newValue(9)})
+	l.Put(y.KeyWithTs([]byte("key0"), 1), y.ValueStruct{Value: newValue(1)})
+	require.EqualValues(t, 4, length(l))
+
+	v := l.Get(y.KeyWithTs(key, 1))
+	require.True(t, v.Value == nil)
+
+	for _, readTs := range []uint64{2, 3, 4} {
+		v = l.Get(y.KeyWithTs(key, readTs))
+		require.EqualValues(t, newValue(2), v.Value)
+		require.EqualValues(t, 2, v.Version)
+	}
+	for _, readTs := range []uint64{5, 6, math.MaxUint64} {
+		v = l.Get(y.KeyWithTs(key, readTs))
+		require.EqualValues(t, newValue(5), v.Value)
+		require.EqualValues(t, 5, v.Version)
+	}
+
+	// Newer versions come first when iterating.
+	it := l.NewIterator()
+	defer it.Close()
+	it.Seek(y.KeyWithTs(key, math.MaxUint64))
+	require.True(t, it.Valid())
+	require.EqualValues(t, 5, y.ParseTs(it.Key()))
+	it.Next()
+	require.True(t, it.Valid())
+	require.EqualValues(t, 2, y.ParseTs(it.Key()))
+	it.Next()
+	require.True(t, it.Valid())
+	require.EqualValues(t, "key0", string(y.ParseKey(it.Key())))
+}
+
 // TestConcurrentBasic tests concurrent writes followed by concurrent reads.
 func TestConcurrentBasic(t *testing.T) {
 	const n = 1000
@@ -133,8 +173,8 @@ func TestConcurrentBasic(t *testing.T) {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			l.Put([]byte(fmt.Sprintf("%05d", i)),
-				y.ValueStruct{newValue(i), 0, uint16(i)})
+			l.Put(y.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0),
+				y.ValueStruct{Value: newValue(i), Meta: 0, CASCounter: uint64(i)})
 		}(i)
 	}
 	wg.Wait()
@@ -143,7 +183,7 @@ func TestConcurrentBasic(t *testing.T) {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			v := l.Get([]byte(fmt.Sprintf("%05d", i)))
+			v := l.Get(y.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0))
 			require.True(t, v.Value != nil)
 			require.EqualValues(t, newValue(i), v.Value)
 			require.EqualValues(t, i, v.CASCounter)
@@ -156,7 +196,7 @@ func TestConcurrentBasic(t *testing.T) {
 // TestOneKey will read while writing to one single key.
 func TestOneKey(t *testing.T) {
 	const n = 100
-	key := []byte("thekey")
+	key := y.KeyWithTs([]byte("thekey"), 0)
 	l := NewSkiplist(arenaPool)
 	defer l.DecrRef()
 
@@ -165,7 +205,7 @@ func TestOneKey(t *testing.T) {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			l.Put(key, y.ValueStruct{newValue(i), 0, uint16(i)})
+			l.Put(key, y.ValueStruct{Value: newValue(i), Meta: 0, CASCounter: uint64(i)})
 		}(i)
 	}
 	// We expect that at least some write made it such that some read returns a value.
@@ -195,103 +235,103 @@ func TestFindNear(t *testing.T) {
 	defer l.DecrRef()
 	for i := 0; i < 1000; i++ {
 		key := fmt.Sprintf("%05d", i*10+5)
-		l.Put([]byte(key), y.ValueStruct{newValue(i), 0, uint16(i)})
+		l.Put(y.KeyWithTs([]byte(key), 0), y.ValueStruct{Value: newValue(i), Meta: 0, CASCounter: uint64(i)})
 	}
 
-	n, eq := l.findNear([]byte("00001"), false, false)
+	n, eq := l.findNear(y.KeyWithTs([]byte("00001"), 0), false, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, "00005", string(n.key(l.arena)))
+	require.EqualValues(t, "00005", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("00001"), false, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("00001"), 0), false, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, "00005", string(n.key(l.arena)))
+	require.EqualValues(t, "00005", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("00001"), true, false)
+	n, eq = l.findNear(y.KeyWithTs([]byte("00001"), 0), true, false)
 	require.Nil(t, n)
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("00001"), true, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("00001"), 0), true, true)
 	require.Nil(t, n)
 	require.False(t, eq)
 
-	n, eq = l.findNear([]byte("00005"), false, false)
+	n, eq = l.findNear(y.KeyWithTs([]byte("00005"), 0), false, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, "00015", string(n.key(l.arena)))
+	require.EqualValues(t, "00015", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("00005"), false, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("00005"), 0), false, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, "00005", string(n.key(l.arena)))
+	require.EqualValues(t, "00005", string(y.ParseKey(n.key(l.arena))))
 	require.True(t, eq)
-	n, eq = l.findNear([]byte("00005"), true, false)
+	n, eq = l.findNear(y.KeyWithTs([]byte("00005"), 0), true, false)
 	require.Nil(t, n)
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("00005"), true, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("00005"), 0), true, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, "00005", string(n.key(l.arena)))
+	require.EqualValues(t, "00005", string(y.ParseKey(n.key(l.arena))))
 	require.True(t, eq)
 
-	n, eq = l.findNear([]byte("05555"), false, false)
+	n, eq = l.findNear(y.KeyWithTs([]byte("05555"), 0), false, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, "05565", string(n.key(l.arena)))
+	require.EqualValues(t, "05565", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("05555"), false, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("05555"), 0), false, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, "05555", string(n.key(l.arena)))
+	require.EqualValues(t, "05555", string(y.ParseKey(n.key(l.arena))))
 	require.True(t, eq)
-	n, eq = l.findNear([]byte("05555"), true, false)
+	n, eq = l.findNear(y.KeyWithTs([]byte("05555"), 0), true, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, "05545", string(n.key(l.arena)))
+	require.EqualValues(t, "05545", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("05555"), true, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("05555"), 0), true, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, "05555", string(n.key(l.arena)))
+	require.EqualValues(t, "05555", string(y.ParseKey(n.key(l.arena))))
 	require.True(t, eq)
 
-	n, eq = l.findNear([]byte("05558"), false, false)
+	n, eq = l.findNear(y.KeyWithTs([]byte("05558"), 0), false, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, "05565", string(n.key(l.arena)))
+	require.EqualValues(t, "05565", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("05558"), false, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("05558"), 0), false, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, "05565", string(n.key(l.arena)))
+	require.EqualValues(t, "05565", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("05558"), true, false)
+	n, eq = l.findNear(y.KeyWithTs([]byte("05558"), 0), true, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, "05555", string(n.key(l.arena)))
+	require.EqualValues(t, "05555", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("05558"), true, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("05558"), 0), true, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, "05555", string(n.key(l.arena)))
+	require.EqualValues(t, "05555", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
 
-	n, eq = l.findNear([]byte("09995"), false, false)
+	n, eq = l.findNear(y.KeyWithTs([]byte("09995"), 0), false, false)
 	require.Nil(t, n)
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("09995"), false, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("09995"), 0), false, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, "09995", string(n.key(l.arena)))
+	require.EqualValues(t, "09995", string(y.ParseKey(n.key(l.arena))))
 	require.True(t, eq)
-	n, eq = l.findNear([]byte("09995"), true, false)
+	n, eq = l.findNear(y.KeyWithTs([]byte("09995"), 0), true, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, "09985", string(n.key(l.arena)))
+	require.EqualValues(t, "09985", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("09995"), true, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("09995"), 0), true, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, "09995", string(n.key(l.arena)))
+	require.EqualValues(t, "09995", string(y.ParseKey(n.key(l.arena))))
 	require.True(t, eq)
 
-	n, eq = l.findNear([]byte("59995"), false, false)
+	n, eq = l.findNear(y.KeyWithTs([]byte("59995"), 0), false, false)
 	require.Nil(t, n)
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("59995"), false, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("59995"), 0), false, true)
 	require.Nil(t, n)
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("59995"), true, false)
+	n, eq = l.findNear(y.KeyWithTs([]byte("59995"), 0), true, false)
 	require.NotNil(t, n)
-	require.EqualValues(t, "09995", string(n.key(l.arena)))
+	require.EqualValues(t, "09995", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
-	n, eq = l.findNear([]byte("59995"), true, true)
+	n, eq = l.findNear(y.KeyWithTs([]byte("59995"), 0), true, true)
 	require.NotNil(t, n)
-	require.EqualValues(t, "09995", string(n.key(l.arena)))
+	require.EqualValues(t, "09995", string(y.ParseKey(n.key(l.arena))))
 	require.False(t, eq)
 }
 
@@ -306,8 +346,8 @@ func TestIteratorNext(t *testing.T) {
 	it.SeekToFirst()
 	require.False(t, it.Valid())
 	for i := n - 1; i >= 0; i-- {
-		l.Put([]byte(fmt.Sprintf("%05d", i)),
-			y.ValueStruct{newValue(i), 0, uint16(i)})
+		l.Put(y.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0),
+			y.ValueStruct{Value: newValue(i), Meta: 0, CASCounter: uint64(i)})
 	}
 	it.SeekToFirst()
 	for i := 0; i < n; i++ {
@@ -330,8 +370,8 @@ func TestIteratorPrev(t *testing.T) {
 	it.SeekToFirst()
 	require.False(t, it.Valid())
 	for i := 0; i < n; i++ {
-		l.Put([]byte(fmt.Sprintf("%05d", i)),
-			y.ValueStruct{newValue(i), 0, uint16(i)})
+		l.Put(y.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0),
+			y.ValueStruct{Value: newValue(i), Meta: 0, CASCounter: uint64(i)})
 	}
 	it.SeekToLast()
 	for i := n - 1; i >= 0; i-- {
@@ -359,51 +399,51 @@ func TestIteratorSeek(t *testing.T) {
 	// 1000, 1010, 1020, ..., 1990.
 	for i := n - 1; i >= 0; i-- {
 		v := i*10 + 1000
-		l.Put([]byte(fmt.Sprintf("%05d", i*10+1000)), y.ValueStruct{newValue(v), 0, 555})
+		l.Put(y.KeyWithTs([]byte(fmt.Sprintf("%05d", i*10+1000)), 0), y.ValueStruct{Value: newValue(v), Meta: 0, CASCounter: 555})
 	}
-	it.Seek([]byte(""))
+	it.Seek(y.KeyWithTs([]byte(""), 0))
 	require.True(t, it.Valid())
 	v := it.Value()
 	require.EqualValues(t, "01000", v.Value)
 
-	it.Seek([]byte("01000"))
+	it.Seek(y.KeyWithTs([]byte("01000"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01000", v.Value)
 
-	it.Seek([]byte("01005"))
+	it.Seek(y.KeyWithTs([]byte("01005"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01010", v.Value)
 
-	it.Seek([]byte("01010"))
+	it.Seek(y.KeyWithTs([]byte("01010"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01010", v.Value)
 
-	it.Seek([]byte("99999"))
+	it.Seek(y.KeyWithTs([]byte("99999"), 0))
 	require.False(t, it.Valid())
 
 	// Try SeekForPrev.
-	it.SeekForPrev([]byte(""))
+	it.SeekForPrev(y.KeyWithTs([]byte(""), 0))
 	require.False(t, it.Valid())
 
-	it.SeekForPrev([]byte("01000"))
+	it.SeekForPrev(y.KeyWithTs([]byte("01000"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01000", v.Value)
 
-	it.SeekForPrev([]byte("01005"))
+	it.SeekForPrev(y.KeyWithTs([]byte("01005"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01000", v.Value)
 
-	it.SeekForPrev([]byte("01010"))
+	it.SeekForPrev(y.KeyWithTs([]byte("01010"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01010", v.Value)
 
-	it.SeekForPrev([]byte("99999"))
+	it.SeekForPrev(y.KeyWithTs([]byte("99999"), 0))
 	require.True(t, it.Valid())
 	v = it.Value()
 	require.EqualValues(t, "01990", v.Value)
@@ -415,7 +455,7 @@ func randomKey() []byte {
 	key2 := rand.Uint32()
 	binary.LittleEndian.PutUint32(b, key)
 	binary.LittleEndian.PutUint32(b[4:], key2)
-	return b
+	return y.KeyWithTs(b, 0)
 }
 
 // Standard test. Some fraction is read. Some fraction is write. Writes have
@@ -437,7 +477,7 @@ func BenchmarkReadWrite(b *testing.B) {
 							count++
 						}
 					} else {
-						l.Put(randomKey(), y.ValueStruct{value, 0, 0})
+						l.Put(randomKey(), y.ValueStruct{Value: value, Meta: 0, CASCounter: 0})
 					}
 				}
 			})
@@ -475,3 +515,37 @@ func BenchmarkReadWriteMap(b *testing.B) {
 		})
 	}
 }
+
+// TestUniRangeIterator tests that a bounded iterator stays within its range in both directions.
+func TestUniRangeIterator(t *testing.T) {
+	l := NewSkiplist(arenaPool)
+	defer l.DecrRef()
+	for i := 0; i < 100; i++ {
+		l.Put(y.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0),
+			y.ValueStruct{Value: newValue(i), Meta: 0, CASCounter: uint64(i)})
+	}
+	r := y.KeyRange{Lower: []byte("00010"), Upper: []byte("00020")}
+
+	it := l.NewUniRangeIterator(false, r)
+	defer it.Close()
+	var got []int
+	for it.Rewind(); it.Valid(); it.Next() {
+		got = append(got, int(it.Value().CASCounter))
+	}
+	require.Equal(t, 10, len(got))
+	require.Equal(t, 10, got[0])
+	require.Equal(t, 19, got[9])
+	it.Seek(y.KeyWithTs([]byte("00002"), 0))
+	require.True(t, it.Valid())
+	require.EqualValues(t, 10, it.Value().CASCounter)
+
+	rit := l.NewUniRangeIterator(true, r)
+	defer rit.Close()
+	got = got[:0]
+	for rit.Rewind(); rit.Valid(); rit.Next() {
+		got = append(got, int(rit.Value().CASCounter))
+	}
+	require.Equal(t, 10, len(got))
+	require.Equal(t, 19, got[0])
+	require.Equal(t, 10, got[9])
+}
@@ -18,6 +18,8 @@ package table
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -62,6 +64,10 @@ func (p *bufferPool) Get() *bytes.Buffer {
 	}
 }
 
+// valHeaderSize is the size of the meta and user meta bytes, CAS counter and expiry stored before
+// each value.
+const valHeaderSize = 1 + 1 + 8 + 8
+
 type header struct {
 	plen int // Overlap with base key.
 	klen int // Length of the diff.
@@ -105,6 +111,9 @@ type TableBuilder struct {
 
 	keyBuf   *bytes.Buffer
 	keyCount int
+
+	block cipher.Block // Encrypts the blocks if not nil. See SetEncryption.
+	keyID uint64
 }
 
 func NewTableBuilder() *TableBuilder {
@@ -121,6 +130,13 @@ func (b *TableBuilder) Close() {
 	bufPool.Put(b.keyBuf)
 }
 
+// SetEncryption makes Finish encrypt the blocks, the index and the bloom filter of the table with
+// block, the data key keyID refers to. OpenEncryptedTable is given the key ID back to read the
+// table.
+func (b *TableBuilder) SetEncryption(keyID uint64, block cipher.Block) {
+	b.keyID, b.block = keyID, block
+}
+
 func (b *TableBuilder) Empty() bool { return b.buf.Len() == 0 }
 
 // keyDiff returns a suffix of newKey that is different from b.baseKey.
@@ -135,13 +151,6 @@ func (b TableBuilder) keyDiff(newKey []byte) []byte {
 }
 
 func (b *TableBuilder) addHelper(key []byte, v y.ValueStruct) {
-	// Add key to bloom filter.
-	var klen [2]byte
-	binary.BigEndian.PutUint16(klen[:], uint16(len(key)))
-	b.keyBuf.Write(klen[:])
-	b.keyBuf.Write(key)
-	b.keyCount++
-
 	// diffKey stores the difference of key with baseKey.
 	var diffKey []byte
 	if len(b.baseKey) == 0 {
@@ -156,8 +165,8 @@ func (b *TableBuilder) addHelper(key []byte, v y.ValueStruct) {
 	h := header{
 		plen: len(key) - len(diffKey),
 		klen: len(diffKey),
-		vlen: len(v.Value) + 1 + 2, // Include meta byte and casCounter.
-		prev: b.prevOffset,         // prevOffset is the location of the last key-value added.
+		vlen: len(v.Value) + valHeaderSize, // Include meta bytes, casCounter and expiry.
+		prev: b.prevOffset,                 // prevOffset is the location of the last key-value added.
 	}
 	b.prevOffset = b.buf.Len() - b.baseOffset // Remember current offset for the next Add call.
 
@@ -167,9 +176,11 @@ func (b *TableBuilder) addHelper(key []byte, v y.ValueStruct) {
 	b.buf.Write(hbuf[:])
 	b.buf.Write(diffKey)    // We only need to store the key difference.
 	b.buf.WriteByte(v.Meta) // Meta byte precedes actual value.
-	var casBytes [2]byte
-	binary.BigEndian.PutUint16(casBytes[:], v.CASCounter)
-	b.buf.Write(casBytes[:])
+	b.buf.WriteByte(v.UserMeta)
+	var casAndExpiry [16]byte
+	binary.BigEndian.PutUint64(casAndExpiry[0:8], v.CASCounter)
+	binary.BigEndian.PutUint64(casAndExpiry[8:16], v.ExpiresAt)
+	b.buf.Write(casAndExpiry[:])
 	b.buf.Write(v.Value)
 	b.counter++ // Increment number of keys added for this current block.
 }
@@ -192,6 +203,15 @@ func (b *TableBuilder) Add(key []byte, value y.ValueStruct) error {
 		b.baseOffset = b.buf.Len()
 		b.prevOffset = math.MaxUint32 // First key-value pair of block has header.prev=MaxUint32.
 	}
+
+	// Add key to bloom filter. We leave out the version, so that a lookup at any version can use it.
+	userKey := y.ParseKey(key)
+	var klen [2]byte
+	binary.BigEndian.PutUint16(klen[:], uint16(len(userKey)))
+	b.keyBuf.Write(klen[:])
+	b.keyBuf.Write(userKey)
+	b.keyCount++
+
 	b.addHelper(key, value)
 	return nil // Currently, there is no meaningful error.
 }
@@ -225,7 +245,7 @@ func (b *TableBuilder) blockIndex() []byte {
 var emptySlice = make([]byte, 100)
 
 // Finish finishes the table by appending the index.
-func (b *TableBuilder) Finish(metadata []byte) []byte {
+func (b *TableBuilder) Finish(metadata []byte) ([]byte, error) {
 	bf := bbloom.New(float64(b.keyCount), 0.01)
 	var klen [2]byte
 	key := make([]byte, 1024)
@@ -257,9 +277,29 @@ func (b *TableBuilder) Finish(metadata []byte) []byte {
 	binary.BigEndian.PutUint32(buf[:], uint32(n))
 	b.buf.Write(buf[:])
 
+	// Everything up to the metadata is encrypted as one stream. The metadata is left as is, so
+	// Table.SetMetadata can overwrite it.
+	var iv uint64
+	if b.block != nil {
+		var ivBuf [8]byte
+		if _, err := rand.Read(ivBuf[:]); err != nil {
+			return nil, y.Wrapf(err, "Unable to generate IV")
+		}
+		iv = binary.BigEndian.Uint64(ivBuf[:])
+		data := b.buf.Bytes()
+		y.XORKeyStream(data, data, b.block, iv, 0)
+	}
+
 	b.buf.Write(metadata)
 	binary.BigEndian.PutUint32(buf[:], uint32(len(metadata)))
 	b.buf.Write(buf[:])
 
-	return b.buf.Bytes()
+	if b.block != nil {
+		var footer [encryptionFooterSize]byte
+		binary.BigEndian.PutUint64(footer[0:8], b.keyID)
+		binary.BigEndian.PutUint64(footer[8:16], iv)
+		binary.BigEndian.PutUint32(footer[16:20], encryptionMagic)
+		b.buf.Write(footer[:])
+	}
+	return b.buf.Bytes(), nil
 }
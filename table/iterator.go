@@ -83,7 +83,7 @@ func (itr *BlockIterator) Seek(key []byte, whence int) {
 	var done bool
 	for itr.Init(); itr.Valid(); itr.Next() {
 		k := itr.Key()
-		if bytes.Compare(k, key) >= 0 {
+		if y.CompareKeys(k, key) >= 0 {
 			// We are done as k is >= key.
 			done = true
 			break
@@ -194,6 +194,7 @@ type TableIterator struct {
 	bi   *BlockIterator
 	err  error
 	init bool
+	buf  []byte // The blocks of an encrypted table are decrypted into it.
 
 	// Internally, TableIterator is bidirectional. However, we only expose the
 	// unidirectional functionality for now.
@@ -211,6 +212,16 @@ func (itr *TableIterator) Close() {
 	itr.t.DecrRef()
 }
 
+// block returns block idx of the table, reusing the buffer of the block before it, whose keys and
+// values are no longer valid.
+func (itr *TableIterator) block(idx int) (Block, error) {
+	block, err := itr.t.block(idx, itr.buf)
+	if err == nil && itr.t.dataKey != nil {
+		itr.buf = block.data
+	}
+	return block, err
+}
+
 func (itr *TableIterator) reset() {
 	itr.bpos = 0
 	itr.err = nil
@@ -237,7 +248,7 @@ func (itr *TableIterator) seekToFirst() {
 		return
 	}
 	itr.bpos = 0
-	block, err := itr.t.block(itr.bpos)
+	block, err := itr.block(itr.bpos)
 	if err != nil {
 		itr.err = err
 		return
@@ -254,7 +265,7 @@ func (itr *TableIterator) seekToLast() {
 		return
 	}
 	itr.bpos = numBlocks - 1
-	block, err := itr.t.block(itr.bpos)
+	block, err := itr.block(itr.bpos)
 	if err != nil {
 		itr.err = err
 		return
@@ -266,7 +277,7 @@ func (itr *TableIterator) seekToLast() {
 
 func (itr *TableIterator) seekHelper(blockIdx int, key []byte) {
 	itr.bpos = blockIdx
-	block, err := itr.t.block(blockIdx)
+	block, err := itr.block(blockIdx)
 	if err != nil {
 		itr.err = err
 		return
@@ -287,7 +298,8 @@ func (itr *TableIterator) seekFrom(key []byte, whence int) {
 
 	idx := sort.Search(len(itr.t.blockIndex), func(idx int) bool {
 		ko := itr.t.blockIndex[idx]
-		return bytes.Compare(ko.key, key) > 0
+		// The key is not read for a table with a single block.
+		return len(ko.key) > 0 && y.CompareKeys(ko.key, key) > 0
 	})
 	if idx == 0 {
 		// The smallest key in our table is already strictly > key. We can return that.
@@ -339,7 +351,7 @@ func (itr *TableIterator) next() {
 	}
 
 	if itr.bi == nil {
-		block, err := itr.t.block(itr.bpos)
+		block, err := itr.block(itr.bpos)
 		if err != nil {
 			itr.err = err
 			return
@@ -351,6 +363,10 @@ func (itr *TableIterator) next() {
 
 	itr.bi.Next()
 	if !itr.bi.Valid() {
+		if err := itr.bi.Error(); err != io.EOF {
+			itr.err = err
+			return
+		}
 		itr.bpos++
 		itr.bi = nil
 		itr.next()
@@ -366,7 +382,7 @@ func (itr *TableIterator) prev() {
 	}
 
 	if itr.bi == nil {
-		block, err := itr.t.block(itr.bpos)
+		block, err := itr.block(itr.bpos)
 		if err != nil {
 			itr.err = err
 			return
@@ -378,6 +394,10 @@ func (itr *TableIterator) prev() {
 
 	itr.bi.Prev()
 	if !itr.bi.Valid() {
+		if err := itr.bi.Error(); err != io.EOF {
+			itr.err = err
+			return
+		}
 		itr.bpos--
 		itr.bi = nil
 		itr.prev()
@@ -391,10 +411,19 @@ func (itr *TableIterator) Key() []byte {
 
 func (itr *TableIterator) Value() y.ValueStruct {
 	v := itr.bi.Value()
+	if itr.t.legacy {
+		return y.ValueStruct{
+			Value:      v[3:],
+			Meta:       v[0],
+			CASCounter: uint64(binary.BigEndian.Uint16(v[1:3])),
+		}
+	}
 	return y.ValueStruct{
-		Value:      v[3:],
+		Value:      v[valHeaderSize:],
 		Meta:       v[0],
-		CASCounter: binary.BigEndian.Uint16(v[1:3]),
+		UserMeta:   v[1],
+		CASCounter: binary.BigEndian.Uint64(v[2:10]),
+		ExpiresAt:  binary.BigEndian.Uint64(v[10:valHeaderSize]),
 	}
 }
 
@@ -430,9 +459,25 @@ type ConcatIterator struct {
 	iters    []*TableIterator // Corresponds to tables.
 	tables   []*Table         // Disregarding reversed, this is in ascending order.
 	reversed bool
+	bounds   y.KeyRange
 }
 
 func NewConcatIterator(tbls []*Table, reversed bool) *ConcatIterator {
+	return NewConcatRangeIterator(tbls, reversed, y.KeyRange{})
+}
+
+// NewConcatRangeIterator returns a ConcatIterator which only returns keys in r. Tables which
+// can't have any key in r, going by their smallest and biggest keys, are left out altogether.
+func NewConcatRangeIterator(tbls []*Table, reversed bool, r y.KeyRange) *ConcatIterator {
+	if !r.IsUnbounded() {
+		var inRange []*Table
+		for _, t := range tbls {
+			if r.Overlaps(t.Smallest(), t.Biggest()) {
+				inRange = append(inRange, t)
+			}
+		}
+		tbls = inRange
+	}
 	iters := make([]*TableIterator, len(tbls))
 	for i := 0; i < len(tbls); i++ {
 		iters[i] = tbls[i].NewIterator(reversed)
@@ -441,6 +486,7 @@ func NewConcatIterator(tbls []*Table, reversed bool) *ConcatIterator {
 		reversed: reversed,
 		iters:    iters,
 		tables:   tbls,
+		bounds:   r,
 		idx:      -1, // Not really necessary because s.it.Valid()=false, but good to have.
 	}
 }
@@ -458,6 +504,10 @@ func (s *ConcatIterator) Rewind() {
 	if len(s.iters) == 0 {
 		return
 	}
+	if start := s.bounds.Start(s.reversed); start != nil {
+		s.Seek(start)
+		return
+	}
 	if !s.reversed {
 		s.setIdx(0)
 	} else {
@@ -467,7 +517,7 @@ func (s *ConcatIterator) Rewind() {
 }
 
 func (s *ConcatIterator) Valid() bool {
-	return s.cur.Valid()
+	return s.cur.Valid() && s.bounds.Contains(s.cur.Key())
 }
 
 func (s *ConcatIterator) Name() string { return "ConcatIterator" }
@@ -482,15 +532,16 @@ func (s *ConcatIterator) Value() y.ValueStruct {
 
 // Seek brings us to element >= key if reversed is false. Otherwise, <= key.
 func (s *ConcatIterator) Seek(key []byte) {
+	key = s.bounds.Clamp(key, s.reversed)
 	var idx int
 	if !s.reversed {
 		idx = sort.Search(len(s.tables), func(i int) bool {
-			return bytes.Compare(s.tables[i].Biggest(), key) >= 0
+			return y.CompareKeys(s.tables[i].Biggest(), key) >= 0
 		})
 	} else {
 		n := len(s.tables)
 		idx = n - 1 - sort.Search(n, func(i int) bool {
-			return bytes.Compare(s.tables[n-1-i].Smallest(), key) <= 0
+			return y.CompareKeys(s.tables[n-1-i].Smallest(), key) <= 0
 		})
 	}
 	if idx >= len(s.tables) || idx < 0 {
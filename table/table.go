@@ -17,9 +17,10 @@
 package table
 
 import (
-	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -37,10 +38,22 @@ import (
 
 const fileSuffix = ".sst"
 
+// How a file is accessed, for Options.MapTablesTo and Options.ValueLogLoadingMode in badger.
 const (
-	Nothing = iota
+	Nothing = iota // Read with pread, same as FileIO.
 	MemoryMap
-	LoadToRAM
+	LoadToRAM // Tables only.
+)
+
+// FileIO reads with pread. It is the same as Nothing.
+const FileIO = Nothing
+
+// Encrypted tables end with a footer of the data key ID, the base IV and encryptionMagic, which
+// can't be mistaken for the metadata size other tables end with. All but the metadata, its size and
+// the footer is encrypted.
+const (
+	encryptionFooterSize        = 8 + 8 + 4
+	encryptionMagic      uint32 = 0xbadce7ab
 )
 
 type keyOffset struct {
@@ -67,6 +80,12 @@ type Table struct {
 	id                uint64
 
 	bf bbloom.Bloom
+
+	legacy bool // Written before keys had versions, with 16-bit CAS counters.
+
+	dataKey    cipher.Block // Decrypts the blocks of an encrypted table. Nil otherwise.
+	iv         uint64
+	footerSize int // Of the encryption footer.
 }
 
 func (s *Table) Ref() int32 { return atomic.LoadInt32(&s.ref) }
@@ -75,15 +94,20 @@ func (s *Table) IncrRef() {
 	atomic.AddInt32(&s.ref, 1)
 }
 
-func (s *Table) DecrRef() {
+func (s *Table) DecrRef() error {
 	newRef := atomic.AddInt32(&s.ref, -1)
 	if newRef == 0 {
 		// We can safely delete this file, because for all the current files, we always have
 		// at least one reference pointing to them.
 		filename := s.fd.Name()
-		y.Check(s.fd.Close())
-		os.Remove(filename)
+		if err := s.fd.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 type Block struct {
@@ -99,10 +123,30 @@ type byKey []keyOffset
 
 func (b byKey) Len() int               { return len(b) }
 func (b byKey) Swap(i int, j int)      { b[i], b[j] = b[j], b[i] }
-func (b byKey) Less(i int, j int) bool { return bytes.Compare(b[i].key, b[j].key) < 0 }
+func (b byKey) Less(i int, j int) bool { return y.CompareKeys(b[i].key, b[j].key) < 0 }
 
 // OpenTable assumes file has only one table and opens it.
 func OpenTable(fd *os.File, mapTableTo int) (*Table, error) {
+	return openTable(fd, mapTableTo, false, nil)
+}
+
+// OpenEncryptedTable is like OpenTable, but also opens tables whose blocks were encrypted, see
+// TableBuilder.SetEncryption. dataKey returns the data key with the ID the table was written with.
+func OpenEncryptedTable(fd *os.File, mapTableTo int,
+	dataKey func(keyID uint64) (cipher.Block, error)) (*Table, error) {
+	return openTable(fd, mapTableTo, false, dataKey)
+}
+
+// OpenLegacyTable opens a table written before keys had versions, and CAS counters were widened
+// to 64 bits. Its keys are returned as they were written, and CAS counters are widened on read.
+// It's only meant to be read in order from start to end, to migrate the data. Seeks and lookups
+// don't work on it.
+func OpenLegacyTable(fd *os.File) (*Table, error) {
+	return openTable(fd, LoadToRAM, true, nil)
+}
+
+func openTable(fd *os.File, mapTableTo int, legacy bool,
+	dataKey func(keyID uint64) (cipher.Block, error)) (*Table, error) {
 	id, ok := ParseFileID(fd.Name())
 	if !ok {
 		return nil, y.Errorf("Invalid filename: %s", fd.Name())
@@ -112,6 +156,7 @@ func OpenTable(fd *os.File, mapTableTo int) (*Table, error) {
 		ref:        1, // Caller is given one reference.
 		id:         id,
 		mapTableTo: mapTableTo,
+		legacy:     legacy,
 	}
 	fileInfo, err := fd.Stat()
 	if err != nil {
@@ -123,12 +168,17 @@ func OpenTable(fd *os.File, mapTableTo int) (*Table, error) {
 		t.mmap, err = syscall.Mmap(int(fd.Fd()), 0, int(fileInfo.Size()),
 			syscall.PROT_READ, syscall.MAP_SHARED)
 		if err != nil {
-			y.Fatalf("Unable to map file: %v", err)
+			return nil, y.Wrapf(err, "Unable to map file: %s", fd.Name())
 		}
 	} else if mapTableTo == LoadToRAM {
-		t.LoadToRAM()
+		if err := t.LoadToRAM(); err != nil {
+			return nil, err
+		}
 	}
 
+	if err := t.readEncryptionFooter(dataKey); err != nil {
+		return nil, err
+	}
 	if err := t.readIndex(); err != nil {
 		return nil, err
 	}
@@ -149,21 +199,64 @@ func OpenTable(fd *os.File, mapTableTo int) (*Table, error) {
 	return t, nil
 }
 
-func (s *Table) Close() {
-	s.fd.Close()
+func (s *Table) Close() error {
 	if s.mapTableTo == MemoryMap {
 		syscall.Munmap(s.mmap)
 	}
+	return s.fd.Close()
 }
 
 // SetMetadata updates our metadata to the new metadata.
-// For now, they must be of the same size.
+// For now, they must be of the same size. If the file has other hard links, as it does once a
+// checkpoint has been taken, it is copied first, so the other links keep the old metadata. The
+// table keeps reading from its open file, which has the same data.
 func (t *Table) SetMetadata(meta []byte) error {
-	y.AssertTrue(len(meta) == len(t.metadata))
-	pos := t.tableSize - 4 - len(t.metadata)
-	written, err := t.fd.WriteAt(meta, int64(pos))
-	y.AssertTrue(written == len(meta))
-	return err
+	if len(meta) != len(t.metadata) {
+		return y.Errorf("Metadata size mismatch: %d vs %d", len(meta), len(t.metadata))
+	}
+	fd, err := openUnshared(t.fd.Name())
+	if err != nil {
+		return err
+	}
+	pos := t.tableSize - t.footerSize - 4 - len(t.metadata)
+	if _, err := fd.WriteAt(meta, int64(pos)); err != nil {
+		fd.Close()
+		return y.Wrapf(err, "While updating metadata of table: %s", t.fd.Name())
+	}
+	return fd.Close()
+}
+
+// openUnshared opens the file at fname for synced writes. If the file has more than one hard
+// link, it is replaced by a copy first.
+func openUnshared(fname string) (*os.File, error) {
+	fd, err := os.OpenFile(fname, os.O_RDWR|syscall.O_DSYNC, 0)
+	if err != nil {
+		return nil, y.Wrapf(err, "Unable to open table: %s", fname)
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, y.Wrapf(err, "Unable to stat table: %s", fname)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || st.Nlink <= 1 {
+		return fd, nil
+	}
+	defer fd.Close()
+
+	tmpName := fname + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC|syscall.O_DSYNC, 0666)
+	if err != nil {
+		return nil, y.Wrapf(err, "Unable to create %s", tmpName)
+	}
+	if _, err = io.Copy(tmp, fd); err == nil {
+		err = os.Rename(tmpName, fname)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return nil, y.Wrapf(err, "Unable to copy table: %s", fname)
+	}
+	return tmp, nil
 }
 
 var EOF = errors.New("End of mapped region")
@@ -181,34 +274,111 @@ func (t *Table) read(off int, sz int) ([]byte, error) {
 	return res, err
 }
 
-func (t *Table) readNoFail(off int, sz int) []byte {
-	res, err := t.read(off, sz)
-	y.Check(err)
-	return res
+// readAt is like read, but checks that the region lies within the table. A
+// region outside the table can only come from a corrupted index.
+func (t *Table) readAt(off int, sz int) ([]byte, error) {
+	if off < 0 || sz < 0 || off+sz > t.tableSize {
+		return nil, y.Errorf("Table %s is corrupt: reading [%d, %d) of size %d",
+			t.fd.Name(), off, off+sz, t.tableSize)
+	}
+	return t.read(off, sz)
+}
+
+// readBlock reads from the blocks of the table, decrypting them if need be. They are decrypted
+// into dst if it is big enough, so the caller can reuse it.
+func (t *Table) readBlock(off int, sz int, dst []byte) ([]byte, error) {
+	buf, err := t.read(off, sz)
+	if err != nil {
+		return nil, err
+	}
+	return t.decrypt(dst, buf, off), nil
+}
+
+// readIndexAt is like readAt, but decrypts the index and the bloom filter if need be.
+func (t *Table) readIndexAt(off int, sz int) ([]byte, error) {
+	buf, err := t.readAt(off, sz)
+	if err != nil {
+		return nil, err
+	}
+	return t.decrypt(nil, buf, off), nil
+}
+
+// decrypt returns the plaintext of buf, read from offset off. The mmap is read-only, so it is
+// decrypted into dst, or a new buffer if dst is too small. Otherwise buf was read for the caller,
+// and is decrypted in place.
+func (t *Table) decrypt(dst, buf []byte, off int) []byte {
+	if t.dataKey == nil {
+		return buf
+	}
+	if t.mmap == nil {
+		dst = buf
+	} else if cap(dst) < len(buf) {
+		dst = make([]byte, len(buf))
+	}
+	dst = dst[:len(buf)]
+	y.XORKeyStream(dst, buf, t.dataKey, t.iv, int64(off))
+	return dst
+}
+
+func (t *Table) readEncryptionFooter(dataKey func(keyID uint64) (cipher.Block, error)) error {
+	buf, err := t.readAt(t.tableSize-4, 4)
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(buf) != encryptionMagic {
+		return nil
+	}
+	if dataKey == nil {
+		return y.Errorf("Table %s is encrypted", t.fd.Name())
+	}
+	if buf, err = t.readAt(t.tableSize-encryptionFooterSize, encryptionFooterSize); err != nil {
+		return err
+	}
+	keyID := binary.BigEndian.Uint64(buf[0:8])
+	if t.dataKey, err = dataKey(keyID); err != nil {
+		return y.Wrapf(err, "While opening table: %s", t.fd.Name())
+	}
+	t.iv = binary.BigEndian.Uint64(buf[8:16])
+	t.footerSize = encryptionFooterSize
+	return nil
 }
 
 func (t *Table) readIndex() error {
-	readPos := t.tableSize - 4
-	buf := t.readNoFail(t.tableSize-4, 4)
+	readPos := t.tableSize - t.footerSize - 4
+	buf, err := t.readAt(readPos, 4)
+	if err != nil {
+		return err
+	}
 
 	metadataSize := int(binary.BigEndian.Uint32(buf))
 	readPos -= metadataSize
-	t.metadata = t.readNoFail(readPos, metadataSize)
+	if t.metadata, err = t.readAt(readPos, metadataSize); err != nil {
+		return err
+	}
 
 	// Read bloom filter.
 	readPos -= 4
-	buf = t.readNoFail(readPos, 4)
+	if buf, err = t.readIndexAt(readPos, 4); err != nil {
+		return err
+	}
 	bloomLen := int(binary.BigEndian.Uint32(buf))
 	readPos -= bloomLen
-	data := t.readNoFail(readPos, bloomLen)
+	data, err := t.readIndexAt(readPos, bloomLen)
+	if err != nil {
+		return err
+	}
 	t.bf = bbloom.JSONUnmarshal(data)
 
 	readPos -= 4
-	buf = t.readNoFail(readPos, 4)
+	if buf, err = t.readIndexAt(readPos, 4); err != nil {
+		return err
+	}
 	restartsLen := int(binary.BigEndian.Uint32(buf))
 
 	readPos -= 4 * restartsLen
-	buf = t.readNoFail(readPos, 4*restartsLen)
+	if buf, err = t.readIndexAt(readPos, 4*restartsLen); err != nil {
+		return err
+	}
 
 	offsets := make([]int, restartsLen)
 	for i := 0; i < restartsLen; i++ {
@@ -244,18 +414,21 @@ func (t *Table) readIndex() error {
 			var h header
 
 			offset := ko.offset
-			buf, err := t.read(offset, h.Size())
+			buf, err := t.readBlock(offset, h.Size(), nil)
 			if err != nil {
 				che <- errors.Wrap(err, "While reading first header in block")
 				return
 			}
 
 			h.Decode(buf)
-			y.AssertTrue(h.plen == 0)
+			if h.plen != 0 {
+				che <- y.Errorf("First key in block at offset %d has a prefix", offset)
+				return
+			}
 
 			offset += h.Size()
 			buf = make([]byte, h.klen)
-			if out, err := t.read(offset, h.klen); err != nil {
+			if out, err := t.readBlock(offset, h.klen, nil); err != nil {
 				che <- errors.Wrap(err, "While reading first key in block")
 				return
 			} else {
@@ -273,14 +446,18 @@ func (t *Table) readIndex() error {
 			return err
 		}
 	}
-	sort.Sort(byKey(t.blockIndex))
+	if !t.legacy {
+		sort.Sort(byKey(t.blockIndex))
+	}
 	return nil
 }
 
 // Metadata returns metadata. Do not mutate this.
 func (t *Table) Metadata() []byte { return t.metadata }
 
-func (t *Table) block(idx int) (Block, error) {
+// block returns block idx. If the table is encrypted, the block is decrypted into buf if it is
+// big enough. See readBlock.
+func (t *Table) block(idx int, buf []byte) (Block, error) {
 	y.AssertTruef(idx >= 0, "idx=%d", idx)
 	if idx >= len(t.blockIndex) {
 		return Block{}, errors.New("Block out of index.")
@@ -291,17 +468,20 @@ func (t *Table) block(idx int) (Block, error) {
 		offset: ko.offset,
 	}
 	var err error
-	if block.data, err = t.read(block.offset, ko.len); err != nil {
+	if block.data, err = t.readBlock(block.offset, ko.len, buf); err != nil {
 		return block, err
 	}
 	return block, nil
 }
 
-func (t *Table) Size() int64                 { return int64(t.tableSize) }
-func (t *Table) Smallest() []byte            { return t.smallest }
-func (t *Table) Biggest() []byte             { return t.biggest }
-func (t *Table) Filename() string            { return t.fd.Name() }
-func (t *Table) ID() uint64                  { return t.id }
+func (t *Table) Size() int64      { return int64(t.tableSize) }
+func (t *Table) Smallest() []byte { return t.smallest }
+func (t *Table) Biggest() []byte  { return t.biggest }
+func (t *Table) Filename() string { return t.fd.Name() }
+func (t *Table) ID() uint64       { return t.id }
+
+// DoesNotHave returns true if (but not "only if") the table does not have the key. The key
+// passed in should not have a version.
 func (t *Table) DoesNotHave(key []byte) bool { return !t.bf.Has(key) }
 
 func ParseFileID(name string) (uint64, bool) {
@@ -323,10 +503,14 @@ func NewFilename(id uint64, dir string) string {
 	return filepath.Join(dir, fmt.Sprintf("%06d", id)+fileSuffix)
 }
 
-func (t *Table) LoadToRAM() {
+func (t *Table) LoadToRAM() error {
 	t.mmap = make([]byte, t.tableSize)
 	read, err := t.fd.ReadAt(t.mmap, 0)
-	if err != nil || read != t.tableSize {
-		y.Fatalf("Unable to load file in memory: %v. Read: %v", err, read)
+	if err != nil {
+		return y.Wrapf(err, "Unable to load file in memory: %s", t.fd.Name())
 	}
+	if read != t.tableSize {
+		return y.Errorf("Unable to load file in memory: %s. Read: %v", t.fd.Name(), read)
+	}
+	return nil
 }
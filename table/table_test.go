@@ -17,7 +17,12 @@
 package table
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"sort"
@@ -62,14 +67,20 @@ func buildTable(t *testing.T, keyValues [][]string) *os.File {
 	})
 	for i, kv := range keyValues {
 		y.AssertTrue(len(kv) == 2)
-		err := b.Add([]byte(kv[0]), y.ValueStruct{[]byte(kv[1]), 'A', uint16(i)})
+		err := b.Add(y.KeyWithTs([]byte(kv[0]), 0), y.ValueStruct{Value: []byte(kv[1]), Meta: 'A', CASCounter: uint64(i)})
 		if t != nil {
 			require.NoError(t, err)
 		} else {
 			y.Check(err)
 		}
 	}
-	f.Write(b.Finish([]byte("somemetadata")))
+	data, err := b.Finish([]byte("somemetadata"))
+	if t != nil {
+		require.NoError(t, err)
+	} else {
+		y.Check(err)
+	}
+	f.Write(data)
 	f.Close()
 	f, err = y.OpenSyncedFile(filename, true)
 	return f
@@ -144,13 +155,13 @@ func TestSeek(t *testing.T) {
 	}
 
 	for _, tt := range data {
-		it.seek([]byte(tt.in))
+		it.seek(y.KeyWithTs([]byte(tt.in), 0))
 		if !tt.valid {
 			require.False(t, it.Valid())
 			continue
 		}
 		require.True(t, it.Valid())
-		k := it.Key()
+		k := y.ParseKey(it.Key())
 		require.EqualValues(t, tt.out, string(k))
 	}
 }
@@ -179,13 +190,13 @@ func TestSeekForPrev(t *testing.T) {
 	}
 
 	for _, tt := range data {
-		it.seekForPrev([]byte(tt.in))
+		it.seekForPrev(y.KeyWithTs([]byte(tt.in), 0))
 		if !tt.valid {
 			require.False(t, it.Valid())
 			continue
 		}
 		require.True(t, it.Valid())
-		k := it.Key()
+		k := y.ParseKey(it.Key())
 		require.EqualValues(t, tt.out, string(k))
 	}
 }
@@ -201,7 +212,7 @@ func TestIterateFromStart(t *testing.T) {
 			ti := table.NewIterator(false)
 			defer ti.Close()
 			ti.reset()
-			ti.seek([]byte(""))
+			ti.seek(y.KeyWithTs([]byte(""), 0))
 			require.True(t, ti.Valid())
 			// No need to do a Next.
 			// ti.Seek brings us to the first key >= "". Essentially a SeekToFirst.
@@ -229,7 +240,7 @@ func TestIterateFromEnd(t *testing.T) {
 			ti := table.NewIterator(false)
 			defer ti.Close()
 			ti.reset()
-			ti.seek([]byte("zzzzzz")) // Seek to end, an invalid element.
+			ti.seek(y.KeyWithTs([]byte("zzzzzz"), 0)) // Seek to end, an invalid element.
 			require.False(t, ti.Valid())
 			for i := n - 1; i >= 0; i-- {
 				ti.prev()
@@ -254,8 +265,8 @@ func TestTable(t *testing.T) {
 	defer ti.Close()
 	kid := 1010
 	seek := []byte(key("key", kid))
-	for ti.seek(seek); ti.Valid(); ti.next() {
-		k := ti.Key()
+	for ti.seek(y.KeyWithTs(seek, 0)); ti.Valid(); ti.next() {
+		k := y.ParseKey(ti.Key())
 		require.EqualValues(t, k, key("key", kid))
 		kid++
 	}
@@ -263,15 +274,162 @@ func TestTable(t *testing.T) {
 		t.Errorf("Expected kid: 10000. Got: %v", kid)
 	}
 
-	ti.seek([]byte(key("key", 99999)))
+	ti.seek(y.KeyWithTs([]byte(key("key", 99999)), 0))
 	require.False(t, ti.Valid())
 
-	ti.seek([]byte(key("key", -1)))
+	ti.seek(y.KeyWithTs([]byte(key("key", -1)), 0))
 	require.True(t, ti.Valid())
-	k := ti.Key()
+	k := y.ParseKey(ti.Key())
 	require.EqualValues(t, k, key("key", 0))
 }
 
+func TestSetMetadataHardLinked(t *testing.T) {
+	f := buildTestTable(t, "key", 1000)
+	tbl, err := OpenTable(f, MemoryMap)
+	require.NoError(t, err)
+	defer tbl.DecrRef()
+	link := fmt.Sprintf("/tmp/%d.sst", rand.Int63())
+	require.NoError(t, os.Link(f.Name(), link))
+	defer os.Remove(link)
+
+	require.NoError(t, tbl.SetMetadata([]byte("newmetadata!")))
+	metadata := func(fname string) string {
+		fd, err := os.Open(fname)
+		require.NoError(t, err)
+		other, err := OpenTable(fd, Nothing)
+		require.NoError(t, err)
+		defer other.Close()
+		return string(other.Metadata())
+	}
+	require.Equal(t, "newmetadata!", metadata(f.Name()))
+	require.Equal(t, "somemetadata", metadata(link)) // The link keeps its own copy.
+
+	// The table can still be read.
+	it := tbl.NewIterator(false)
+	defer it.Close()
+	var count int
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	require.Equal(t, 1000, count)
+}
+
+func TestEncryptedTable(t *testing.T) {
+	dataKey, err := aes.NewCipher(bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	b := NewTableBuilder()
+	defer b.Close()
+	b.SetEncryption(3, dataKey)
+	plain := NewTableBuilder()
+	defer plain.Close()
+	for i := 0; i < 1000; i++ {
+		k := y.KeyWithTs([]byte(key("key", i)), 0)
+		require.NoError(t, b.Add(k, y.ValueStruct{Value: []byte(key("secret", i))}))
+		require.NoError(t, plain.Add(k, y.ValueStruct{Value: []byte(key("secret", i))}))
+	}
+	data, err := b.Finish([]byte("somemetadata"))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(data, []byte("secret")))
+	require.False(t, bytes.Contains(data, []byte("key")))
+	require.False(t, bytes.Contains(data, []byte("FilterSet"))) // From the bloom filter's JSON.
+	// Nor the index: the restart offsets in front of the bloom filter of the same table unencrypted.
+	plainData, err := plain.Finish([]byte("somemetadata"))
+	require.NoError(t, err)
+	pos := len(plainData) - 4 - len("somemetadata") - 4
+	pos -= int(binary.BigEndian.Uint32(plainData[pos:])) + 4
+	restarts := plainData[pos-4*int(binary.BigEndian.Uint32(plainData[pos:])) : pos]
+	require.True(t, len(restarts) > 4)
+	require.False(t, bytes.Contains(data, restarts))
+	filename := fmt.Sprintf("/tmp/%d.sst", rand.Int63())
+	require.NoError(t, ioutil.WriteFile(filename, data, 0666))
+	defer os.Remove(filename)
+
+	fd, err := os.Open(filename)
+	require.NoError(t, err)
+	_, err = OpenTable(fd, Nothing) // The data key is needed.
+	require.Error(t, err)
+	var keyIDs []uint64
+	keys := func(keyID uint64) (cipher.Block, error) {
+		keyIDs = append(keyIDs, keyID)
+		return dataKey, nil
+	}
+	metadata := "somemetadata"
+	for _, mode := range []int{Nothing, MemoryMap, LoadToRAM} {
+		fd, err := os.OpenFile(filename, os.O_RDWR, 0666)
+		require.NoError(t, err)
+		tbl, err := OpenEncryptedTable(fd, mode, keys)
+		require.NoError(t, err)
+		require.Equal(t, metadata, string(tbl.Metadata()))
+		it := tbl.NewIterator(false)
+		it.Seek(y.KeyWithTs([]byte(key("key", 500)), 0))
+		for i := 500; i < 1000; i++ {
+			require.True(t, it.Valid())
+			require.EqualValues(t, key("secret", i), it.Value().Value)
+			it.Next()
+		}
+		require.False(t, it.Valid())
+		if mode != Nothing {
+			// The mapping is left as is, and the blocks are decrypted into a buffer the iterator
+			// reuses.
+			it.Rewind()
+			buf := it.buf
+			it.Rewind()
+			require.True(t, &buf[0] == &it.buf[0])
+		}
+		it.Close()
+		metadata = fmt.Sprintf("newmetadata%d", mode)
+		require.NoError(t, tbl.SetMetadata([]byte(metadata)))
+		require.NoError(t, tbl.Close())
+	}
+	require.Equal(t, []uint64{3, 3, 3}, keyIDs)
+
+	// Unencrypted tables open too.
+	tbl, err := OpenEncryptedTable(buildTestTable(t, "key", 100), MemoryMap, keys)
+	require.NoError(t, err)
+	defer tbl.DecrRef()
+	require.Equal(t, "somemetadata", string(tbl.Metadata()))
+}
+
+func TestTableVersions(t *testing.T) {
+	b := NewTableBuilder()
+	defer b.Close()
+	filename := fmt.Sprintf("/tmp/%d.sst", rand.Int63())
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	// Newer versions of a key sort before older ones, and "a" sorts before "aa".
+	require.NoError(t, b.Add(y.KeyWithTs([]byte("a"), 9), y.ValueStruct{Value: []byte("a9")}))
+	require.NoError(t, b.Add(y.KeyWithTs([]byte("a"), 3), y.ValueStruct{Value: []byte("a3")}))
+	require.NoError(t, b.Add(y.KeyWithTs([]byte("aa"), 1), y.ValueStruct{Value: []byte("aa1")}))
+	buf, err := b.Finish([]byte("somemetadata"))
+	require.NoError(t, err)
+	_, err = f.Write(buf)
+	require.NoError(t, err)
+
+	table, err := OpenTable(f, MemoryMap)
+	require.NoError(t, err)
+	defer table.DecrRef()
+	require.False(t, table.DoesNotHave([]byte("a")))
+	require.False(t, table.DoesNotHave([]byte("aa")))
+
+	it := table.NewIterator(false)
+	defer it.Close()
+	var data = []struct {
+		readTs uint64
+		out    string
+	}{
+		{10, "a9"},
+		{9, "a9"},
+		{5, "a3"},
+		{3, "a3"},
+		{2, "aa1"}, // No version of "a" is visible, so we land on the next key.
+	}
+	for _, tt := range data {
+		it.seek(y.KeyWithTs([]byte("a"), tt.readTs))
+		require.True(t, it.Valid())
+		require.EqualValues(t, tt.out, string(it.Value().Value))
+	}
+}
+
 func TestIterateBackAndForth(t *testing.T) {
 	f := buildTestTable(t, "key", 10000)
 	table, err := OpenTable(f, MemoryMap)
@@ -281,35 +439,35 @@ func TestIterateBackAndForth(t *testing.T) {
 	seek := []byte(key("key", 1010))
 	it := table.NewIterator(false)
 	defer it.Close()
-	it.seek(seek)
+	it.seek(y.KeyWithTs(seek, 0))
 	require.True(t, it.Valid())
-	k := it.Key()
+	k := y.ParseKey(it.Key())
 	require.EqualValues(t, seek, k)
 
 	it.prev()
 	it.prev()
 	require.True(t, it.Valid())
-	k = it.Key()
+	k = y.ParseKey(it.Key())
 	require.EqualValues(t, key("key", 1008), string(k))
 
 	it.next()
 	it.next()
 	require.True(t, it.Valid())
-	k = it.Key()
+	k = y.ParseKey(it.Key())
 	require.EqualValues(t, key("key", 1010), k)
 
-	it.seek([]byte(key("key", 2000)))
+	it.seek(y.KeyWithTs([]byte(key("key", 2000)), 0))
 	require.True(t, it.Valid())
-	k = it.Key()
+	k = y.ParseKey(it.Key())
 	require.EqualValues(t, key("key", 2000), k)
 
 	it.prev()
 	require.True(t, it.Valid())
-	k = it.Key()
+	k = y.ParseKey(it.Key())
 	require.EqualValues(t, key("key", 1999), k)
 
 	it.seekToFirst()
-	k = it.Key()
+	k = y.ParseKey(it.Key())
 	require.EqualValues(t, key("key", 0), string(k))
 }
 
@@ -362,7 +520,7 @@ func TestConcatIteratorOneTable(t *testing.T) {
 
 	it.Rewind()
 	require.True(t, it.Valid())
-	k := it.Key()
+	k := y.ParseKey(it.Key())
 	require.EqualValues(t, "k1", string(k))
 	vs := it.Value()
 	require.EqualValues(t, "a1", string(vs.Value))
@@ -397,22 +555,22 @@ func TestConcatIterator(t *testing.T) {
 		}
 		require.EqualValues(t, 30000, count)
 
-		it.Seek([]byte("a"))
-		require.EqualValues(t, "keya0000", string(it.Key()))
+		it.Seek(y.KeyWithTs([]byte("a"), 0))
+		require.EqualValues(t, "keya0000", string(y.ParseKey(it.Key())))
 		vs := it.Value()
 		require.EqualValues(t, "0", string(vs.Value))
 
-		it.Seek([]byte("keyb"))
-		require.EqualValues(t, "keyb0000", string(it.Key()))
+		it.Seek(y.KeyWithTs([]byte("keyb"), 0))
+		require.EqualValues(t, "keyb0000", string(y.ParseKey(it.Key())))
 		vs = it.Value()
 		require.EqualValues(t, "0", string(vs.Value))
 
-		it.Seek([]byte("keyb9999b"))
-		require.EqualValues(t, "keyc0000", string(it.Key()))
+		it.Seek(y.KeyWithTs([]byte("keyb9999b"), 0))
+		require.EqualValues(t, "keyc0000", string(y.ParseKey(it.Key())))
 		vs = it.Value()
 		require.EqualValues(t, "0", string(vs.Value))
 
-		it.Seek([]byte("keyd"))
+		it.Seek(y.KeyWithTs([]byte("keyd"), 0))
 		require.False(t, it.Valid())
 	}
 	{
@@ -429,26 +587,63 @@ func TestConcatIterator(t *testing.T) {
 		}
 		require.EqualValues(t, 30000, count)
 
-		it.Seek([]byte("a"))
+		it.Seek(y.KeyWithTs([]byte("a"), 0))
 		require.False(t, it.Valid())
 
-		it.Seek([]byte("keyb"))
-		require.EqualValues(t, "keya9999", string(it.Key()))
+		it.Seek(y.KeyWithTs([]byte("keyb"), 0))
+		require.EqualValues(t, "keya9999", string(y.ParseKey(it.Key())))
 		vs := it.Value()
 		require.EqualValues(t, "9999", string(vs.Value))
 
-		it.Seek([]byte("keyb9999b"))
-		require.EqualValues(t, "keyb9999", string(it.Key()))
+		it.Seek(y.KeyWithTs([]byte("keyb9999b"), 0))
+		require.EqualValues(t, "keyb9999", string(y.ParseKey(it.Key())))
 		vs = it.Value()
 		require.EqualValues(t, "9999", string(vs.Value))
 
-		it.Seek([]byte("keyd"))
-		require.EqualValues(t, "keyc9999", string(it.Key()))
+		it.Seek(y.KeyWithTs([]byte("keyd"), 0))
+		require.EqualValues(t, "keyc9999", string(y.ParseKey(it.Key())))
 		vs = it.Value()
 		require.EqualValues(t, "9999", string(vs.Value))
 	}
 }
 
+func TestConcatRangeIterator(t *testing.T) {
+	f := buildTestTable(t, "keya", 10000)
+	f2 := buildTestTable(t, "keyb", 10000)
+	f3 := buildTestTable(t, "keyc", 10000)
+	tbl, err := OpenTable(f, MemoryMap)
+	require.NoError(t, err)
+	defer tbl.DecrRef()
+	tbl2, err := OpenTable(f2, LoadToRAM)
+	require.NoError(t, err)
+	defer tbl2.DecrRef()
+	tbl3, err := OpenTable(f3, LoadToRAM)
+	require.NoError(t, err)
+	defer tbl3.DecrRef()
+
+	r := y.KeyRange{Lower: []byte("keyb0100"), Upper: []byte("keyc")}
+	for _, reversed := range []bool{false, true} {
+		it := NewConcatRangeIterator([]*Table{tbl, tbl2, tbl3}, reversed, r)
+		defer it.Close()
+		// Only the table for keyb can have keys in the range.
+		require.Equal(t, 1, len(it.tables))
+
+		var count int
+		for it.Rewind(); it.Valid(); it.Next() {
+			count++
+		}
+		require.EqualValues(t, 9900, count)
+
+		if !reversed {
+			it.Seek(y.KeyWithTs([]byte("a"), 0))
+			require.EqualValues(t, "keyb0100", string(y.ParseKey(it.Key())))
+		} else {
+			it.Seek(y.KeyWithTs([]byte("keyd"), 0))
+			require.EqualValues(t, "keyb9999", string(y.ParseKey(it.Key())))
+		}
+	}
+}
+
 func TestMergingIterator(t *testing.T) {
 	f1 := buildTable(t, [][]string{
 		{"k1", "a1"},
@@ -471,7 +666,7 @@ func TestMergingIterator(t *testing.T) {
 
 	it.Rewind()
 	require.True(t, it.Valid())
-	k := it.Key()
+	k := y.ParseKey(it.Key())
 	require.EqualValues(t, "k1", string(k))
 	vs := it.Value()
 	require.EqualValues(t, "a1", string(vs.Value))
@@ -479,7 +674,7 @@ func TestMergingIterator(t *testing.T) {
 	it.Next()
 
 	require.True(t, it.Valid())
-	k = it.Key()
+	k = y.ParseKey(it.Key())
 	require.EqualValues(t, "k2", string(k))
 	vs = it.Value()
 	require.EqualValues(t, "a2", string(vs.Value))
@@ -511,7 +706,7 @@ func TestMergingIteratorReversed(t *testing.T) {
 
 	it.Rewind()
 	require.True(t, it.Valid())
-	k := it.Key()
+	k := y.ParseKey(it.Key())
 	require.EqualValues(t, "k2", string(k))
 	vs := it.Value()
 	require.EqualValues(t, "a2", string(vs.Value))
@@ -519,7 +714,7 @@ func TestMergingIteratorReversed(t *testing.T) {
 	it.Next()
 
 	require.True(t, it.Valid())
-	k = it.Key()
+	k = y.ParseKey(it.Key())
 	require.EqualValues(t, "k1", string(k))
 	vs = it.Value()
 	require.EqualValues(t, "a1", string(vs.Value))
@@ -551,7 +746,7 @@ func TestMergingIteratorTakeOne(t *testing.T) {
 
 	it.Rewind()
 	require.True(t, it.Valid())
-	k := it.Key()
+	k := y.ParseKey(it.Key())
 	require.EqualValues(t, "k1", string(k))
 	vs := it.Value()
 	require.EqualValues(t, "a1", string(vs.Value))
@@ -559,7 +754,7 @@ func TestMergingIteratorTakeOne(t *testing.T) {
 	it.Next()
 
 	require.True(t, it.Valid())
-	k = it.Key()
+	k = y.ParseKey(it.Key())
 	require.EqualValues(t, "k2", string(k))
 	vs = it.Value()
 	require.EqualValues(t, "a2", string(vs.Value))
@@ -591,7 +786,7 @@ func TestMergingIteratorTakeTwo(t *testing.T) {
 
 	it.Rewind()
 	require.True(t, it.Valid())
-	k := it.Key()
+	k := y.ParseKey(it.Key())
 	require.EqualValues(t, "k1", string(k))
 	vs := it.Value()
 	require.EqualValues(t, "a1", string(vs.Value))
@@ -599,7 +794,7 @@ func TestMergingIteratorTakeTwo(t *testing.T) {
 	it.Next()
 
 	require.True(t, it.Valid())
-	k = it.Key()
+	k = y.ParseKey(it.Key())
 	require.EqualValues(t, "k2", string(k))
 	vs = it.Value()
 	require.EqualValues(t, "a2", string(vs.Value))
@@ -618,10 +813,12 @@ func BenchmarkRead(b *testing.B) {
 	for i := 0; i < n; i++ {
 		k := fmt.Sprintf("%016x", i)
 		v := fmt.Sprintf("%d", i)
-		y.Check(builder.Add([]byte(k), y.ValueStruct{[]byte(v), 123, 5555}))
+		y.Check(builder.Add(y.KeyWithTs([]byte(k), 0), y.ValueStruct{Value: []byte(v), Meta: 123, CASCounter: 5555}))
 	}
 
-	f.Write(builder.Finish([]byte("somemetadata")))
+	data, err := builder.Finish([]byte("somemetadata"))
+	y.Check(err)
+	f.Write(data)
 	tbl, err := OpenTable(f, MemoryMap)
 	y.Check(err)
 	defer tbl.DecrRef()
@@ -648,10 +845,12 @@ func BenchmarkReadAndBuild(b *testing.B) {
 	for i := 0; i < n; i++ {
 		k := fmt.Sprintf("%016x", i)
 		v := fmt.Sprintf("%d", i)
-		y.Check(builder.Add([]byte(k), y.ValueStruct{[]byte(v), 123, 5555}))
+		y.Check(builder.Add(y.KeyWithTs([]byte(k), 0), y.ValueStruct{Value: []byte(v), Meta: 123, CASCounter: 5555}))
 	}
 
-	f.Write(builder.Finish([]byte("somemetadata")))
+	data, err := builder.Finish([]byte("somemetadata"))
+	y.Check(err)
+	f.Write(data)
 	tbl, err := OpenTable(f, MemoryMap)
 	y.Check(err)
 	defer tbl.DecrRef()
@@ -668,7 +867,7 @@ func BenchmarkReadAndBuild(b *testing.B) {
 				vs := it.Value()
 				newBuilder.Add(it.Key(), vs)
 			}
-			newBuilder.Finish([]byte("somemetadata"))
+			y.Check2(newBuilder.Finish([]byte("somemetadata")))
 		}()
 	}
 }
@@ -688,9 +887,11 @@ func BenchmarkReadMerged(b *testing.B) {
 			// id := i*tableSize+j (not interleaved)
 			k := fmt.Sprintf("%016x", id)
 			v := fmt.Sprintf("%d", id)
-			y.Check(builder.Add([]byte(k), y.ValueStruct{[]byte(v), 123, 5555}))
+			y.Check(builder.Add(y.KeyWithTs([]byte(k), 0), y.ValueStruct{Value: []byte(v), Meta: 123, CASCounter: 5555}))
 		}
-		f.Write(builder.Finish([]byte("somemetadata")))
+		data, err := builder.Finish([]byte("somemetadata"))
+		y.Check(err)
+		f.Write(data)
 		tbl, err := OpenTable(f, MemoryMap)
 		y.Check(err)
 		tables = append(tables, tbl)
@@ -0,0 +1,39 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package y
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+)
+
+// XORKeyStream sets dst to src XORed with the AES-CTR key stream of block, for the bytes found at
+// offset in a file encrypted with the base IV iv. Every offset has bytes of the key stream of its
+// own, so any range of the file can be encrypted or decrypted by itself. dst and src may be the
+// same slice.
+func XORKeyStream(dst, src []byte, block cipher.Block, iv uint64, offset int64) {
+	var counter [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(counter[:8], iv)
+	binary.BigEndian.PutUint64(counter[8:], uint64(offset)/aes.BlockSize)
+	stream := cipher.NewCTR(block, counter[:])
+	if skip := offset % aes.BlockSize; skip > 0 {
+		var discard [aes.BlockSize]byte
+		stream.XORKeyStream(discard[:skip], discard[:skip])
+	}
+	stream.XORKeyStream(dst, src)
+}
@@ -59,7 +59,7 @@ func Check2(_ interface{}, err error) {
 
 // Check2f acts as convenience wrapper around Checkf, using the 2nd argument as error.
 func Check2f(_ interface{}, err error, format string, args ...interface{}) {
-	Checkf(err, format, args)
+	Checkf(err, format, args...)
 }
 
 // AssertTrue asserts that b is true. Otherwise, it would log fatal.
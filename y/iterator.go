@@ -19,13 +19,19 @@ package y
 import (
 	"bytes"
 	"container/heap"
+	"math"
 	//	"fmt"
 )
 
 type ValueStruct struct {
 	Value      []byte
 	Meta       byte
-	CASCounter uint16
+	UserMeta   byte // Set by the application. Not interpreted by Badger.
+	CASCounter uint64
+	ExpiresAt  uint64 // Unix time in seconds after which the value is gone. Zero means never.
+
+	// Version is parsed from the key a value was read with. It is not encoded with the value.
+	Version uint64
 }
 
 // Iterator is an interface for a basic iterator.
@@ -42,6 +48,65 @@ type Iterator interface {
 	Close()
 }
 
+// KeyRange is a range of user keys, from Lower (inclusive) to Upper (exclusive). An empty bound
+// leaves that end of the range open.
+type KeyRange struct {
+	Lower []byte
+	Upper []byte
+}
+
+// IsUnbounded returns true if the range covers all keys.
+func (r KeyRange) IsUnbounded() bool {
+	return len(r.Lower) == 0 && len(r.Upper) == 0
+}
+
+// Contains returns true if the user key of key, which has a timestamp, is in the range.
+func (r KeyRange) Contains(key []byte) bool {
+	if r.IsUnbounded() {
+		return true
+	}
+	k := ParseKey(key)
+	if len(r.Lower) > 0 && bytes.Compare(k, r.Lower) < 0 {
+		return false
+	}
+	return len(r.Upper) == 0 || bytes.Compare(k, r.Upper) < 0
+}
+
+// Overlaps returns true if any key from smallest to biggest, both with timestamps, could be in
+// the range.
+func (r KeyRange) Overlaps(smallest, biggest []byte) bool {
+	if len(r.Upper) > 0 && bytes.Compare(ParseKey(smallest), r.Upper) >= 0 {
+		return false
+	}
+	return len(r.Lower) == 0 || bytes.Compare(ParseKey(biggest), r.Lower) >= 0
+}
+
+// Start returns the key with timestamp an iterator should seek to instead of rewinding: before
+// all the versions of Lower going forward, or of Upper going backward. It returns nil if that
+// end of the range is open.
+func (r KeyRange) Start(reversed bool) []byte {
+	if !reversed && len(r.Lower) > 0 {
+		return KeyWithTs(r.Lower, math.MaxUint64)
+	}
+	if reversed && len(r.Upper) > 0 {
+		return KeyWithTs(r.Upper, math.MaxUint64)
+	}
+	return nil
+}
+
+// Clamp returns the key an iterator should seek to when asked to seek to key, so that it
+// doesn't land before the start of the range.
+func (r KeyRange) Clamp(key []byte, reversed bool) []byte {
+	start := r.Start(reversed)
+	if start == nil {
+		return key
+	}
+	if cmp := CompareKeys(key, start); (!reversed && cmp < 0) || (reversed && cmp > 0) {
+		return start
+	}
+	return key
+}
+
 type elem struct {
 	itr      Iterator
 	nice     int
@@ -62,7 +127,7 @@ func (eh *elemHeap) Pop() interface{} {
 	return x
 }
 func (eh elemHeap) Less(i, j int) bool {
-	cmp := bytes.Compare(eh[i].itr.Key(), eh[j].itr.Key())
+	cmp := CompareKeys(eh[i].itr.Key(), eh[j].itr.Key())
 	if cmp < 0 {
 		return !eh[i].reversed
 	}
@@ -79,13 +144,21 @@ type MergeIterator struct {
 	h        elemHeap
 	curKey   []byte
 	reversed bool
+	bounds   KeyRange
 
 	all []Iterator
 }
 
 // NewMergeIterator returns a new MergeIterator from a list of Iterators.
 func NewMergeIterator(iters []Iterator, reversed bool) *MergeIterator {
-	m := &MergeIterator{all: iters, reversed: reversed}
+	return NewMergeRangeIterator(iters, reversed, KeyRange{})
+}
+
+// NewMergeRangeIterator returns a new MergeIterator which only returns keys in r. Rewind and Seek
+// are passed on to the iterators as seeks to the start of r, so that they never have to go
+// through keys before it.
+func NewMergeRangeIterator(iters []Iterator, reversed bool, r KeyRange) *MergeIterator {
+	m := &MergeIterator{all: iters, reversed: reversed, bounds: r}
 	m.h = make(elemHeap, 0, len(iters))
 	m.initHeap()
 	return m
@@ -132,7 +205,7 @@ func (s *MergeIterator) Valid() bool {
 	if len(s.h) == 0 {
 		return false
 	}
-	return s.h[0].itr.Valid()
+	return s.h[0].itr.Valid() && s.bounds.Contains(s.h[0].itr.Key())
 }
 
 func (s *MergeIterator) Key() []byte {
@@ -178,6 +251,10 @@ func (s *MergeIterator) Next() {
 
 // Rewind seeks to first element (or last element for reverse iterator).
 func (s *MergeIterator) Rewind() {
+	if start := s.bounds.Start(s.reversed); start != nil {
+		s.Seek(start)
+		return
+	}
 	for _, itr := range s.all {
 		itr.Rewind()
 	}
@@ -186,6 +263,7 @@ func (s *MergeIterator) Rewind() {
 
 // Seek brings us to element with key >= given key.
 func (s *MergeIterator) Seek(key []byte) {
+	key = s.bounds.Clamp(key, s.reversed)
 	for _, itr := range s.all {
 		itr.Seek(key)
 	}
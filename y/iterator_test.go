@@ -18,7 +18,6 @@ package y
 
 import (
 	//	"fmt"
-	"bytes"
 	"sort"
 	"testing"
 
@@ -58,19 +57,19 @@ func (s *SimpleIterator) Rewind() {
 func (s *SimpleIterator) Seek(key []byte) {
 	if !s.reversed {
 		s.idx = sort.Search(len(s.keys), func(i int) bool {
-			return bytes.Compare(s.keys[i], key) >= 0
+			return CompareKeys(s.keys[i], key) >= 0
 		})
 	} else {
 		n := len(s.keys)
 		s.idx = n - 1 - sort.Search(n, func(i int) bool {
-			return bytes.Compare(s.keys[n-1-i], key) <= 0
+			return CompareKeys(s.keys[n-1-i], key) <= 0
 		})
 	}
 }
 
 func (s *SimpleIterator) Key() []byte { return s.keys[s.idx] }
 func (s *SimpleIterator) Value() ValueStruct {
-	return ValueStruct{s.vals[s.idx], 55, 12345}
+	return ValueStruct{Value: s.vals[s.idx], Meta: 55, CASCounter: 12345}
 }
 func (s *SimpleIterator) Valid() bool {
 	return s.idx >= 0 && s.idx < len(s.keys)
@@ -81,7 +80,7 @@ func newSimpleIterator(keys []string, vals []string, reversed bool) *SimpleItera
 	v := make([][]byte, len(vals))
 	AssertTrue(len(keys) == len(vals))
 	for i := 0; i < len(keys); i++ {
-		k[i] = []byte(keys[i])
+		k[i] = KeyWithTs([]byte(keys[i]), 0)
 		v[i] = []byte(vals[i])
 	}
 	return &SimpleIterator{
@@ -96,7 +95,7 @@ func getAll(it Iterator) ([]string, []string) {
 	var keys, vals []string
 	for ; it.Valid(); it.Next() {
 		k := it.Key()
-		keys = append(keys, string(k))
+		keys = append(keys, string(ParseKey(k)))
 		v := it.Value()
 		vals = append(vals, string(v.Value))
 	}
@@ -189,7 +188,7 @@ func TestMergeIteratorSeek(t *testing.T) {
 	it3 := newSimpleIterator([]string{"1"}, []string{"c1"}, false)
 	it4 := newSimpleIterator([]string{"1", "7", "9"}, []string{"d1", "d7", "d9"}, false)
 	mergeIt := NewMergeIterator([]Iterator{it, it2, it3, it4}, false)
-	mergeIt.Seek([]byte("4"))
+	mergeIt.Seek(KeyWithTs([]byte("4"), 0))
 	k, v := getAll(mergeIt)
 	require.EqualValues(t, []string{"5", "7", "9"}, k)
 	require.EqualValues(t, []string{"b5", "a7", "d9"}, v)
@@ -202,7 +201,7 @@ func TestMergeIteratorSeekReversed(t *testing.T) {
 	it3 := newSimpleIterator([]string{"1"}, []string{"c1"}, true)
 	it4 := newSimpleIterator([]string{"1", "7", "9"}, []string{"d1", "d7", "d9"}, true)
 	mergeIt := NewMergeIterator([]Iterator{it, it2, it3, it4}, true)
-	mergeIt.Seek([]byte("5"))
+	mergeIt.Seek(KeyWithTs([]byte("5"), 0))
 	k, v := getAll(mergeIt)
 	require.EqualValues(t, []string{"5", "3", "2", "1"}, k)
 	require.EqualValues(t, []string{"b5", "a3", "b2", "a1"}, v)
@@ -215,7 +214,7 @@ func TestMergeIteratorSeekInvalid(t *testing.T) {
 	it3 := newSimpleIterator([]string{"1"}, []string{"c1"}, false)
 	it4 := newSimpleIterator([]string{"1", "7", "9"}, []string{"d1", "d7", "d9"}, false)
 	mergeIt := NewMergeIterator([]Iterator{it, it2, it3, it4}, false)
-	mergeIt.Seek([]byte("f"))
+	mergeIt.Seek(KeyWithTs([]byte("f"), 0))
 	require.False(t, mergeIt.Valid())
 	closeAndCheck(t, mergeIt, 4)
 }
@@ -226,7 +225,65 @@ func TestMergeIteratorSeekInvalidReversed(t *testing.T) {
 	it3 := newSimpleIterator([]string{"1"}, []string{"c1"}, true)
 	it4 := newSimpleIterator([]string{"1", "7", "9"}, []string{"d1", "d7", "d9"}, true)
 	mergeIt := NewMergeIterator([]Iterator{it, it2, it3, it4}, true)
-	mergeIt.Seek([]byte("0"))
+	mergeIt.Seek(KeyWithTs([]byte("0"), 0))
 	require.False(t, mergeIt.Valid())
 	closeAndCheck(t, mergeIt, 4)
 }
+
+func TestMergeIteratorRange(t *testing.T) {
+	newIters := func(reversed bool) []Iterator {
+		it := newSimpleIterator([]string{"1", "3", "7"}, []string{"a1", "a3", "a7"}, reversed)
+		it2 := newSimpleIterator([]string{"2", "3", "5"}, []string{"b2", "b3", "b5"}, reversed)
+		it3 := newSimpleIterator([]string{"1", "7", "9"}, []string{"c1", "c7", "c9"}, reversed)
+		return []Iterator{it, it2, it3}
+	}
+	r := KeyRange{Lower: []byte("2"), Upper: []byte("7")}
+
+	mergeIt := NewMergeRangeIterator(newIters(false), false, r)
+	mergeIt.Rewind()
+	k, v := getAll(mergeIt)
+	require.EqualValues(t, []string{"2", "3", "5"}, k)
+	require.EqualValues(t, []string{"b2", "a3", "b5"}, v)
+	// Seeking before the range lands on its start.
+	mergeIt.Seek(KeyWithTs([]byte("0"), 0))
+	k, _ = getAll(mergeIt)
+	require.EqualValues(t, []string{"2", "3", "5"}, k)
+	mergeIt.Seek(KeyWithTs([]byte("4"), 0))
+	k, _ = getAll(mergeIt)
+	require.EqualValues(t, []string{"5"}, k)
+	closeAndCheck(t, mergeIt, 3)
+
+	mergeIt = NewMergeRangeIterator(newIters(true), true, r)
+	mergeIt.Rewind()
+	k, v = getAll(mergeIt)
+	require.EqualValues(t, []string{"5", "3", "2"}, k)
+	require.EqualValues(t, []string{"b5", "a3", "b2"}, v)
+	mergeIt.Seek(KeyWithTs([]byte("9"), 0))
+	k, _ = getAll(mergeIt)
+	require.EqualValues(t, []string{"5", "3", "2"}, k)
+	closeAndCheck(t, mergeIt, 3)
+
+	// Open ends.
+	mergeIt = NewMergeRangeIterator(newIters(false), false, KeyRange{Lower: []byte("6")})
+	mergeIt.Rewind()
+	k, _ = getAll(mergeIt)
+	require.EqualValues(t, []string{"7", "9"}, k)
+	closeAndCheck(t, mergeIt, 3)
+	mergeIt = NewMergeRangeIterator(newIters(false), false, KeyRange{Upper: []byte("3")})
+	mergeIt.Rewind()
+	k, _ = getAll(mergeIt)
+	require.EqualValues(t, []string{"1", "2"}, k)
+	closeAndCheck(t, mergeIt, 3)
+}
+
+func TestKeyRangeOverlaps(t *testing.T) {
+	key := func(k string) []byte { return KeyWithTs([]byte(k), 1) }
+	r := KeyRange{Lower: []byte("c"), Upper: []byte("f")}
+	require.True(t, r.Overlaps(key("a"), key("c")))
+	require.True(t, r.Overlaps(key("d"), key("e")))
+	require.True(t, r.Overlaps(key("a"), key("z")))
+	require.True(t, r.Overlaps(key("e"), key("z")))
+	require.False(t, r.Overlaps(key("a"), key("b")))
+	require.False(t, r.Overlaps(key("f"), key("z")))
+	require.True(t, KeyRange{}.Overlaps(key("a"), key("b")))
+}
@@ -17,7 +17,10 @@
 package y
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math"
 	"sync"
 	"sync/atomic"
 
@@ -44,6 +47,51 @@ func Safecopy(a []byte, src []byte) []byte {
 	return a
 }
 
+// KeyWithTs generates a new key by appending ts to key. The timestamp is stored as
+// math.MaxUint64-ts, so that for the same key, newer versions sort first.
+func KeyWithTs(key []byte, ts uint64) []byte {
+	out := make([]byte, len(key)+8)
+	copy(out, key)
+	binary.BigEndian.PutUint64(out[len(key):], math.MaxUint64-ts)
+	return out
+}
+
+// ParseTs parses the timestamp from the key bytes.
+func ParseTs(key []byte) uint64 {
+	if len(key) < 8 {
+		return 0
+	}
+	return math.MaxUint64 - binary.BigEndian.Uint64(key[len(key)-8:])
+}
+
+// ParseKey parses the actual key from the key bytes.
+func ParseKey(key []byte) []byte {
+	if key == nil {
+		return nil
+	}
+	AssertTruef(len(key) >= 8, "Key %q is too short to have a timestamp", key)
+	return key[:len(key)-8]
+}
+
+// CompareKeys checks the key without timestamp and checks the timestamp if keyNoTs
+// is same. a<timestamp> would be sorted higher than aa<timestamp> if we use bytes.compare.
+// All keys should have timestamp.
+func CompareKeys(key1 []byte, key2 []byte) int {
+	AssertTrue(len(key1) >= 8 && len(key2) >= 8)
+	if cmp := bytes.Compare(key1[:len(key1)-8], key2[:len(key2)-8]); cmp != 0 {
+		return cmp
+	}
+	return bytes.Compare(key1[len(key1)-8:], key2[len(key2)-8:])
+}
+
+// SameKey checks for key equality ignoring the timestamp.
+func SameKey(src, dst []byte) bool {
+	if len(src) != len(dst) {
+		return false
+	}
+	return bytes.Equal(ParseKey(src), ParseKey(dst))
+}
+
 type Slice struct {
 	buf []byte
 }
@@ -55,6 +103,13 @@ func (s *Slice) Resize(sz int) []byte {
 	return s.buf[0:sz]
 }
 
+// Swap makes buf the buffer of s, to be reused by Resize, and returns the one s had.
+func (s *Slice) Swap(buf []byte) []byte {
+	old := s.buf
+	s.buf = buf
+	return old
+}
+
 type LevelCloser struct {
 	Name    string
 	running int32